@@ -9,11 +9,11 @@ import (
 
 func main() {
 	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "USAGE: <Sqlite3 DB file> <FEATCAT-FILES>\nTab separated files of source-featname, target-featname, featvalue\n")
+		fmt.Fprintf(os.Stderr, "USAGE: <Sqlite3 DB file> <FEATCAT-FILES>\nTab separated files of source-featname, target-featname, featvalue\nParent categories are declared by header lines: %s<TAB>category<TAB>parent category\n", dbapi.ChunkFeatCatParentPrefix)
 		os.Exit(0)
 	}
 
-	err := dbapi.Open(os.Args[1])
+	db, err := dbapi.Open(os.Args[1])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to open db file '%s' : %v\n", os.Args[1], err)
 		os.Exit(1)
@@ -21,17 +21,22 @@ func main() {
 
 	for _, fn := range os.Args[2:] {
 
-		sourceFeatName, cats, err := dbapi.ParseChunkFeatCatFile(fn)
+		sourceFeatName, cats, parents, err := dbapi.ParseChunkFeatCatFile(fn)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to read featcat file '%s' : %v\n", os.Args[1], err)
 			os.Exit(1)
 		}
 
-		n, err := dbapi.AddChunkFeatCats(sourceFeatName, cats)
+		n, err := db.AddChunkFeatCats(sourceFeatName, cats)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to add feat cats : %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Fprintf(os.Stderr, "Completed %s (inserted %d)\n", fn, n)
+		nParents, err := db.AddChunkFeatCatParents(parents)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to add feat cat parents : %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Completed %s (inserted %d, parents %d)\n", fn, n, nParents)
 	}
 }
@@ -23,13 +23,13 @@ func main() {
 	}
 
 	fn := flag.Args()[0]
-	err := dbapi.Open(fn)
+	db, err := dbapi.Open(fn)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to connect to db '%s' : %v\n", fn, err)
 		os.Exit(1)
 	}
 
-	tx, err := dbapi.Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to start db transaction : %v\n", err)
 		os.Exit(1)
@@ -45,24 +45,24 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Couldn't commit db transaction : %v\n", err)
 		os.Exit(1)
 	}
-	tx, err = dbapi.Begin()
+	tx, err = db.Begin()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to start db transaction : %v\n", err)
 		os.Exit(1)
 	}
-	// err = dbapi.ForeignKeysOff()
+	// err = db.ForeignKeysOff()
 	// if err != nil {
 	// 	fmt.Fprintf(os.Stderr, "Failed ForeignKeysOff : %v\n", err)
 	// 	os.Exit(1)
 	// }
 
-	err = dbapi.SynchronousOff()
+	err = db.SynchronousOff()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed SynchronousOff : %v\n", err)
 		os.Exit(1)
 	}
 
-	err = dbapi.CacheSize(10000)
+	err = db.CacheSize(10000)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed CacheSize : %v\n", err)
 		os.Exit(1)
@@ -103,13 +103,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Couldn't commit transaction : %v\n", err)
 		os.Exit(1)
 	}
-	// err = dbapi.Close()
+	// err = db.Close()
 	// if err != nil {
 	// 	fmt.Fprintf(os.Stderr, "Couldn't close db : %v\n", err)
 	// 	os.Exit(1)
 	// }
 
-	nFeats, err := dbapi.BulkInsertChunkFeats(fn, sents...)
+	nFeats, err := db.BulkInsertChunkFeats(sents...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Bulk insert failed: %v\n", err)
 		os.Exit(1)
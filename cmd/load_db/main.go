@@ -105,9 +105,9 @@ func keepSent(s text.Sentence) bool {
 	return true
 }
 
-func bulkInsertChunkFeats(dbFile string, sents ...text.Sentence) {
+func bulkInsertChunkFeats(db *dbapi.DB, sents ...text.Sentence) {
 	log.Printf("Bulk inserting chunkfeats...")
-	nFeats, err := dbapi.BulkInsertChunkFeats(dbFile, sents...)
+	nFeats, err := db.BulkInsertChunkFeats(sents...)
 	if err != nil {
 		log.Fatalf("Bulk insert failed: %v\n", err)
 	}
@@ -146,10 +146,15 @@ func main() {
 		log.Fatalf("Expected folder, found file: %s", chunkFeatCatFolder)
 	}
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
-		log.Fatalf("No such file %s\n", dbFile)
+		log.Printf("Creating db file %s", dbFile)
+		db, err := dbapi.CreateDB(dbFile)
+		if err != nil {
+			log.Fatalf("Failed to create db file '%s' : %v", dbFile, err)
+		}
+		db.Close()
 	}
 
-	err = dbapi.Open(dbFile, "PRAGMA synchronous = OFF", "PRAGMA journal_mode = MEMORY", "PRAGMA foreign_keys=OFF", "PRAGMA cache_size=10000")
+	db, err := dbapi.Open(dbFile, "PRAGMA synchronous = OFF", "PRAGMA journal_mode = MEMORY", "PRAGMA foreign_keys=OFF", "PRAGMA cache_size=10000")
 	if err != nil {
 		log.Fatalf("Failed to open db file '%s' : %v", dbFile, err)
 	}
@@ -212,7 +217,7 @@ func main() {
 			}
 
 			aN++
-			_, insertedSents, err := dbapi.Add(a, false) // false = insert chunk feats in bulk later
+			_, insertedSents, err := db.Add(a, false) // false = insert chunk feats in bulk later
 			for _, s := range insertedSents {
 				sents = append(sents, s)
 			}
@@ -222,7 +227,7 @@ func main() {
 
 			//if nArticles%*bulkSize == 0 {
 			if len(sents) >= *bulkSize {
-				bulkInsertChunkFeats(dbFile, sents...)
+				bulkInsertChunkFeats(db, sents...)
 				sents = []text.Sentence{}
 			}
 
@@ -236,12 +241,12 @@ func main() {
 
 	// bulk insert chunkfeats
 	if len(sents) > 0 {
-		bulkInsertChunkFeats(dbFile, sents...)
+		bulkInsertChunkFeats(db, sents...)
 	}
 
 	// generate word freqs
 	log.Println("Generating word frequency table...")
-	err = dbapi.PopulateWordFreqTable()
+	err = db.PopulateWordFreqTable()
 	if err != nil {
 		log.Fatalf("failed to create word frequency table : %v", err)
 	}
@@ -249,7 +254,7 @@ func main() {
 
 	// generate lowest word freqs
 	log.Println("Generating lowest word frequency per chunk...")
-	err = dbapi.InsertLowestWordFreqForChunk()
+	err = db.InsertLowestWordFreqForChunk()
 	if err != nil {
 		log.Fatalf("failed to insert lowest word frequency per chunk : %v", err)
 	}
@@ -259,18 +264,23 @@ func main() {
 	// load chunk feat cats
 	chunkFeatCatFiles, _ := filepath.Glob(filepath.Join(chunkFeatCatFolder, "*.txt"))
 	for _, fn := range chunkFeatCatFiles {
-		sourceFeatName, cats, err := dbapi.ParseChunkFeatCatFile(fn)
+		sourceFeatName, cats, parents, err := dbapi.ParseChunkFeatCatFile(fn)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to read featcat file '%s' : %v\n", fn, err)
 			os.Exit(1)
 		}
 
-		n, err := dbapi.AddChunkFeatCats(sourceFeatName, cats)
+		n, err := db.AddChunkFeatCats(sourceFeatName, cats)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to add feat cats : %v\n", err)
 			os.Exit(1)
 		}
-		log.Printf("Completed %s (inserted %d)\n", fn, n)
+		nParents, err := db.AddChunkFeatCatParents(parents)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to add feat cat parents : %v\n", err)
+			os.Exit(1)
+		}
+		log.Printf("Completed %s (inserted %d, parents %d)\n", fn, n, nParents)
 	}
 
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
@@ -37,7 +38,7 @@ func listFilterFeats(cmd string, args []string) {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
 	feats := filter.AvailableFeats()
-	featCats, err := dbapi.ListChunkfeatCats()
+	featCats, err := db.ListChunkfeatCats()
 	if err != nil {
 		log.Printf("failed to list featcats: %v", err)
 		return
@@ -77,6 +78,14 @@ func listSelectorFeats(cmd string, args []string) {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
 	feats := selection.AvailableFeats()
+	featCats, err := db.ListChunkfeatCats()
+	if err != nil {
+		log.Printf("failed to list featcats: %v", err)
+		return
+	}
+	for _, cat := range featCats {
+		feats = append(feats, selection.Feat{Name: cat, Desc: "Feature category from db"})
+	}
 	bts, err := json.MarshalIndent(feats, " ", " ")
 	if err != nil {
 		log.Printf("failed to unmarshal feats: %v", err)
@@ -85,17 +94,48 @@ func listSelectorFeats(cmd string, args []string) {
 	fmt.Println(string(bts))
 }
 
+// parseFreqBandArg parses a rank (e.g. 800) or a percentile (e.g. 10%)
+func parseFreqBandArg(s string) (float64, bool, error) {
+	isPercentile := strings.HasSuffix(s, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	return f, isPercentile, err
+}
+
+func addFreqCat(cmd string, args []string) {
+	if len(args) != 4 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	from, fromIsPercentile, err := parseFreqBandArg(args[2])
+	if err != nil {
+		log.Fatalf("Failed to parse arg %s : %v", args[2], err)
+	}
+	to, toIsPercentile, err := parseFreqBandArg(args[3])
+	if err != nil {
+		log.Fatalf("Failed to parse arg %s : %v", args[3], err)
+	}
+	if fromIsPercentile != toIsPercentile {
+		log.Fatalf("Cannot mix ranks and percentiles: %s, %s", args[2], args[3])
+	}
+	band := dbapi.FreqBand{FeatName: args[0], From: from, To: to, Percentile: fromIsPercentile}
+	n, err := db.AddFreqBandChunkFeatCat(args[1], band)
+	if err != nil {
+		log.Fatalf("Failed to add frequency band category: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Added category %s with %d values (%s)\n", args[1], n, band)
+}
+
 type batchOrScriptInfo struct {
 	Name      string `json:"name"`
 	Size      int    `json:"size,omitempty"`
 	Timestamp string `json:"timestamp,omitempty"`
+	Modified  int64  `json:"modified,omitempty"` // number of corrected sentences (scripts only)
 }
 
 func listBatches(cmd string, args []string) {
 	if len(args) != 0 {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
-	batches, err := dbapi.ListBatchNames()
+	batches, err := db.ListBatchNames()
 	if err != nil {
 		log.Printf("failed to list batches: %v", err)
 		return
@@ -106,7 +146,7 @@ func listBatches(cmd string, args []string) {
 	}
 	res := []batchOrScriptInfo{}
 	for _, name := range batches {
-		meta, err := dbapi.GetBatchProperties(name)
+		meta, err := db.GetBatchProperties(name)
 		if err == nil {
 			res = append(res, batchOrScriptInfo{Name: meta.BatchName, Size: meta.OutputSize, Timestamp: meta.Timestamp})
 		} else {
@@ -125,7 +165,7 @@ func listScripts(cmd string, args []string) {
 	if len(args) != 0 {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
-	scripts, err := dbapi.ListScriptNames()
+	scripts, err := db.ListScriptNames()
 	if err != nil {
 		log.Printf("failed to list scripts: %v", err)
 		return
@@ -134,13 +174,18 @@ func listScripts(cmd string, args []string) {
 		fmt.Println("No scripts in db")
 		return
 	}
+	modified, err := db.ModifiedScripts()
+	if err != nil {
+		log.Printf("failed to list modified scripts: %v", err)
+		return
+	}
 	res := []batchOrScriptInfo{}
 	for _, name := range scripts {
-		meta, err := dbapi.GetScriptProperties(name)
+		meta, err := db.GetScriptProperties(name)
 		if err == nil {
-			res = append(res, batchOrScriptInfo{Name: meta.Options.ScriptName, Size: meta.OutputSize, Timestamp: meta.Timestamp})
+			res = append(res, batchOrScriptInfo{Name: meta.Options.ScriptName, Size: meta.OutputSize, Timestamp: meta.Timestamp, Modified: modified[name]})
 		} else {
-			res = append(res, batchOrScriptInfo{Name: name})
+			res = append(res, batchOrScriptInfo{Name: name, Modified: modified[name]})
 		}
 	}
 	jsn, err := json.MarshalIndent(res, " ", " ")
@@ -151,24 +196,135 @@ func listScripts(cmd string, args []string) {
 	fmt.Println(string(jsn))
 }
 
-func blockSents(cmd string, args []string) {
-	if len(args) == 0 {
-		log.Fatalf("Args required for cmd %s", cmd)
-	}
+// parseIDs parses sentence ids from args, and from idFile (one id per line, # for comments) if non-empty
+func parseIDs(args []string, idFile string) ([]int64, error) {
 	ids := []int64{}
+	if idFile != "" {
+		fh, err := os.Open(idFile)
+		if err != nil {
+			return ids, fmt.Errorf("failed to open id file : %v", err)
+		}
+		defer fh.Close()
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			l := strings.TrimSpace(scanner.Text())
+			if l == "" || strings.HasPrefix(l, "#") {
+				continue
+			}
+			args = append(args, l)
+		}
+		if err = scanner.Err(); err != nil {
+			return ids, fmt.Errorf("failed to read id file : %v", err)
+		}
+	}
 	for _, s := range args {
 		i, err := strconv.ParseInt(s, 10, 64)
 		if err != nil {
-			log.Fatalf("Failed to parse arg to string: %s", s)
+			return ids, fmt.Errorf("failed to parse sentence id: %s", s)
 		}
 		ids = append(ids, i)
 	}
-	err := dbapi.BlockSentIDs(ids...)
+	return ids, nil
+}
+
+func blockSents(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	reason := flags.String("reason", "", "reason for blocking")
+	user := flags.String("user", os.Getenv("USER"), "user blocking the sentences")
+	idFile := flags.String("file", "", "file with sentence ids to block (one id per line)")
+	re := flags.String("re", "", "block sentences matching regular expression")
+	sourceRE := flags.String("source", "", "block sentences from sources matching regular expression")
+	flags.Parse(args)
+
+	ids, err := parseIDs(flags.Args(), *idFile)
 	if err != nil {
-		log.Printf("failed to list scripts: %v", err)
-		return
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, err)
+	}
+	if len(ids) == 0 && *re == "" && *sourceRE == "" {
+		log.Fatalf("Args required for cmd %s", cmd)
+	}
+
+	info := dbapi.BlockInfo{Reason: *reason, User: *user}
+	var n int64
+	if len(ids) > 0 {
+		n, err = db.BlockSentIDsWithInfo(info, ids...)
+		if err != nil {
+			log.Fatalf("Failed to block sents: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Blocked %d of %d sent ids\n", n, len(ids))
+	}
+	if *re != "" {
+		n, err = db.BlockSentsMatchingRE(info, *re)
+		if err != nil {
+			log.Fatalf("Failed to block sents: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Blocked %d sents matching %s\n", n, *re)
+	}
+	if *sourceRE != "" {
+		n, err = db.BlockSentsFromSourceRE(info, *sourceRE)
+		if err != nil {
+			log.Fatalf("Failed to block sents: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Blocked %d sents from sources matching %s\n", n, *sourceRE)
 	}
-	fmt.Fprintf(os.Stderr, "Blocked sent ids %v\n", ids)
+}
+
+func unblockSents(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	idFile := flags.String("file", "", "file with sentence ids to unblock (one id per line)")
+	flags.Parse(args)
+
+	ids, err := parseIDs(flags.Args(), *idFile)
+	if err != nil {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, err)
+	}
+	if len(ids) == 0 {
+		log.Fatalf("Args required for cmd %s", cmd)
+	}
+	n, err := db.UnblockSentIDs(ids...)
+	if err != nil {
+		log.Fatalf("Failed to unblock sents: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Unblocked %d of %d sent ids\n", n, len(ids))
+}
+
+func correctSent(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	user := flags.String("user", os.Getenv("USER"), "user correcting the sentence")
+	comment := flags.String("comment", "", "comment on the correction")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatalf("Failed to parse sentence id: %s", flags.Arg(0))
+	}
+	newText := strings.Join(flags.Args()[1:], " ")
+	edit, err := db.CorrectChunkText(id, newText, *user, *comment)
+	if err != nil {
+		log.Fatalf("Failed to correct sentence: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Corrected sentence %d\n - %s\n + %s\n", id, edit.OldText, edit.NewText)
+}
+
+func sentHistory(cmd string, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		log.Fatalf("Failed to parse sentence id: %s", args[0])
+	}
+	edits, err := db.ChunkHistory(id)
+	if err != nil {
+		log.Fatalf("Failed to read sentence history: %v", err)
+	}
+	bts, err := json.MarshalIndent(edits, " ", " ")
+	if err != nil {
+		log.Fatalf("Failed to marshal sentence history: %v", err)
+	}
+	fmt.Println(string(bts))
 }
 
 type ScriptSet struct {
@@ -182,6 +338,7 @@ type Script struct {
 	BatchMetadata  protocol.BatchMetadata  `json:"batch_metadata"`
 	ScriptMetadata protocol.ScriptMetadata `json:"script_metadata"`
 	Sentences      []text.Sentence         `json:"sentences"`
+	Provenance     []dbapi.Provenance      `json:"provenance,omitempty"` // why each sentence was selected, in selection order
 }
 
 type ScriptWOMeta struct {
@@ -226,7 +383,7 @@ func exportScripts(cmd string, args []string, includeMetaData bool) {
 			"size": 0,
 		},
 	}
-	allScripts, err := dbapi.ListScriptNames()
+	allScripts, err := db.ListScriptNames()
 	if err != nil {
 		log.Fatalf("dbapi.ListScriptNames failed: %v", err)
 	}
@@ -243,7 +400,7 @@ func exportScripts(cmd string, args []string, includeMetaData bool) {
 		scripts = allScripts
 	}
 	for _, scriptName := range scripts {
-		sents, err := dbapi.GetScript(scriptName, 0, 0)
+		sents, err := db.GetScript(scriptName, 0, 0)
 		if err != nil {
 			log.Fatalf("dbapi.GetScript failed: %v", err)
 		}
@@ -252,7 +409,7 @@ func exportScripts(cmd string, args []string, includeMetaData bool) {
 		if includeMetaData {
 			script := Script{Sentences: sents}
 
-			scriptMeta, err := dbapi.GetScriptProperties(scriptName)
+			scriptMeta, err := db.GetScriptProperties(scriptName)
 			if err != nil {
 				log.Fatalf("dbapi.GetScriptProperties failed: %v", err)
 			}
@@ -261,12 +418,27 @@ func exportScripts(cmd string, args []string, includeMetaData bool) {
 			scriptMeta.Options.Debug = false
 			scriptMeta.Options.PrintMetaData = false
 
-			batchMeta, err := dbapi.GetBatchProperties(scriptMeta.Options.FromBatch)
-			if err != nil {
-				log.Fatalf("dbapi.GetBatchProperties failed: %v", err)
+			// scripts created by set operations have no input batch, and the input batch may have been deleted
+			if fromBatch := scriptMeta.Options.FromBatch; fromBatch != "" {
+				exists, err := db.Exists(dbapi.KindBatch, fromBatch)
+				if err != nil {
+					log.Fatalf("dbapi.Exists failed: %v", err)
+				}
+				if exists {
+					batchMeta, err := db.GetBatchProperties(fromBatch)
+					if err != nil {
+						log.Fatalf("dbapi.GetBatchProperties failed: %v", err)
+					}
+					script.BatchMetadata = batchMeta
+				} else {
+					fmt.Fprintf(os.Stderr, "Input batch %s of script %s not found, exporting without batch metadata\n", fromBatch, scriptName)
+				}
 			}
-			script.BatchMetadata = batchMeta
 			script.ScriptMetadata = scriptMeta
+			script.Provenance, err = db.GetScriptProvenance(scriptName)
+			if err != nil {
+				log.Fatalf("dbapi.GetScriptProvenance failed: %v", err)
+			}
 			resWithMeta.Scripts = append(resWithMeta.Scripts, script)
 			resWithMeta.DBName = dbName
 			resWithMeta.Stats["size"] += int64(len(sents))
@@ -307,7 +479,7 @@ func exportScriptMetadata(cmd string, args []string) {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
 	for _, scriptName := range args {
-		metadata, err := dbapi.GetScriptProperties(scriptName)
+		metadata, err := db.GetScriptProperties(scriptName)
 		if err != nil {
 			log.Fatalf("Failed to fetch script metadata %v: %v", scriptName, err)
 		}
@@ -338,7 +510,7 @@ func exportBatches(cmd string, args []string) {
 			"size": 0,
 		},
 	}
-	allBatches, err := dbapi.ListBatchNames()
+	allBatches, err := db.ListBatchNames()
 	if err != nil {
 		log.Fatalf("dbapi.ListBatchNames failed: %v", err)
 	}
@@ -354,13 +526,13 @@ func exportBatches(cmd string, args []string) {
 		batches = allBatches
 	}
 	for _, batchName := range batches {
-		sents, err := dbapi.GetBatch(batchName, 0, 0) //opts.PageNumber, opts.PageSize)
+		sents, err := db.GetBatch(batchName, 0, 0) //opts.PageNumber, opts.PageSize)
 		if err != nil {
 			log.Fatalf("Failed to fetch batch %v: %v", batchName, err)
 		}
 		removeFeats(sents)
 		batch := Batch{Sentences: sents}
-		meta, err := dbapi.GetBatchProperties(batchName)
+		meta, err := db.GetBatchProperties(batchName)
 		if err != nil {
 			log.Fatalf("dbapi.GetBatchProperties failed: %v", err)
 		}
@@ -384,7 +556,7 @@ func exportBatchMetadata(cmd string, args []string) {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
 	for _, batchName := range args {
-		metadata, err := dbapi.GetBatchProperties(batchName)
+		metadata, err := db.GetBatchProperties(batchName)
 		if err != nil {
 			log.Fatalf("Failed to fetch batch metadata %v: %v", batchName, err)
 		}
@@ -397,14 +569,16 @@ func exportBatchMetadata(cmd string, args []string) {
 }
 
 func listBlockedSents(cmd string, args []string) {
-	if len(args) != 0 {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	reason := flags.String("reason", "", "only list sentences blocked for this reason")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
-	sents, err := dbapi.ListBlockedSents()
+	sents, err := db.ListBlocked(*reason)
 	if err != nil {
 		log.Fatalf("Failed to list blocked sents: %v", err)
 	}
-	removeFeats(sents)
 	bts, err := json.MarshalIndent(sents, " ", " ")
 	if err != nil {
 		log.Fatalf("Failed to marshal blocked sents: %v", err)
@@ -416,7 +590,7 @@ func stats(cmd string, args []string) {
 	if len(args) != 0 {
 		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
 	}
-	stats, err := dbapi.GetStats()
+	stats, err := db.GetStats()
 	if err != nil {
 		log.Fatalf("Failed to get stats: %v", err)
 	}
@@ -428,12 +602,153 @@ func stats(cmd string, args []string) {
 	fmt.Println(string(bts))
 }
 
+func migrate(cmd string, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	from, to, err := db.Migrate()
+	if err != nil {
+		log.Fatalf("Failed to migrate db: %v", err)
+	}
+	if from == to {
+		fmt.Fprintf(os.Stderr, "Db schema is up to date (version %d)\n", to)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Migrated db schema from version %d to %d\n", from, to)
+}
+
+func buildFeatBlobs(cmd string, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	n, err := db.BuildFeatBlobs(10000)
+	if err != nil {
+		log.Fatalf("Failed to build feat blobs: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Built feat blobs for %d chunks\n", n)
+}
+
+func buildFTSIndex(cmd string, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	err := db.BuildFTSIndex()
+	if err != nil {
+		log.Fatalf("Failed to build full-text index: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Built full-text index\n")
+}
+
+func search(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	limit := flags.Int("n", 100, "max number of hits (-1 for all hits)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	query := strings.Join(flags.Args(), " ")
+	hits, err := db.Search(query, *limit)
+	if err != nil {
+		log.Fatalf("Search failed: %v", err)
+	}
+	for _, h := range hits {
+		fmt.Printf("%d\t%s\n", h.ID, h.Text)
+	}
+	fmt.Fprintf(os.Stderr, "%d hits\n", len(hits))
+}
+
+func history(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	limit := flags.Int("n", 0, "only list the n latest operations")
+	op := flags.String("op", "", "only list operations of this type ("+strings.Join([]string{dbapi.OpFilter, dbapi.OpSaveScript, dbapi.OpDeleteBatches, dbapi.OpDeleteScripts, dbapi.OpBlock, dbapi.OpUnblock, dbapi.OpCorrectSent, dbapi.OpCreateBatch, dbapi.OpCreateScript, dbapi.OpRenameBatch, dbapi.OpRenameScript, dbapi.OpTruncateScript}, ", ")+")")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	q := dbapi.OpLogQuery{Operation: *op, Limit: *limit, Name: flags.Arg(0)}
+	entries, err := db.ListOpLog(q)
+	if err != nil {
+		log.Fatalf("Failed to read history: %v", err)
+	}
+	bts, err := json.MarshalIndent(entries, " ", " ")
+	if err != nil {
+		log.Fatalf("Failed to marshal history: %v", err)
+	}
+	fmt.Println(string(bts))
+}
+
+// setOp creates a batch or script (kind) from a set operation on other batches and scripts.
+// Operands are of the same kind as the target, unless prefixed with batch: or script:
+func setOp(cmd string, kind string, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	op := args[0]
+	target := args[1]
+	operands := []protocol.SetOperand{}
+	for _, arg := range args[2:] {
+		o := protocol.SetOperand{Kind: kind, Name: arg}
+		for _, k := range []string{dbapi.KindBatch, dbapi.KindScript} {
+			if strings.HasPrefix(arg, k+":") {
+				o = protocol.SetOperand{Kind: k, Name: strings.TrimPrefix(arg, k+":")}
+			}
+		}
+		operands = append(operands, o)
+	}
+	n, err := db.CreateFromSetOp(kind, target, op, operands...)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", kind, err)
+	}
+	fmt.Fprintf(os.Stderr, "Created %s %s with %d sents\n", kind, target, n)
+}
+
+func rename(cmd string, kind string, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	err := db.Rename(kind, args[0], args[1])
+	if err != nil {
+		log.Fatalf("Failed to rename %s: %v", kind, err)
+	}
+	fmt.Fprintf(os.Stderr, "Renamed %s %s to %s\n", kind, args[0], args[1])
+}
+
+func truncateScript(cmd string, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatalf("Failed to parse script size: %s", args[1])
+	}
+	deleted, err := db.TruncateScript(args[0], n)
+	if err != nil {
+		log.Fatalf("Failed to truncate script: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %d sents from script %s\n", deleted, args[0])
+}
+
+func refreshStats(cmd string, args []string) {
+	if len(args) != 0 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	_, err := db.RefreshStats()
+	if err != nil {
+		log.Fatalf("Failed to refresh stats: %v", err)
+	}
+	stats(cStats, args)
+}
+
 func runCmd(cmd string) error {
 	switch cmd {
 	case cHelp:
 		printUsage()
 	case cScriptGen:
 		scriptGen(cmd, os.Args[3:])
+	case cFilterPreview:
+		filterPreview(cmd, os.Args[3:])
+	case cValidateConfig:
+		validateConfigFile(cmd, os.Args[3:])
 	case cListFilterFeats:
 		listFilterFeats(cmd, os.Args[3:])
 	case cListSelectorFeats:
@@ -446,6 +761,24 @@ func runCmd(cmd string) error {
 		blockSents(cmd, os.Args[3:])
 	case cListBlocked:
 		listBlockedSents(cmd, os.Args[3:])
+	case cUnblockSents:
+		unblockSents(cmd, os.Args[3:])
+	case cCorrectSent:
+		correctSent(cmd, os.Args[3:])
+	case cSentHistory:
+		sentHistory(cmd, os.Args[3:])
+	case cHistory:
+		history(cmd, os.Args[3:])
+	case cBatchOp:
+		setOp(cmd, dbapi.KindBatch, os.Args[3:])
+	case cScriptOp:
+		setOp(cmd, dbapi.KindScript, os.Args[3:])
+	case cRenameBatch:
+		rename(cmd, dbapi.KindBatch, os.Args[3:])
+	case cRenameScript:
+		rename(cmd, dbapi.KindScript, os.Args[3:])
+	case cTruncateScript:
+		truncateScript(cmd, os.Args[3:])
 	case cExportScript:
 		exportScripts(cmd, os.Args[3:], true)
 	case cExportScriptWithoutMetadata:
@@ -458,6 +791,18 @@ func runCmd(cmd string) error {
 		exportBatchMetadata(cmd, os.Args[3:])
 	case cStats:
 		stats(cmd, os.Args[3:])
+	case cRefreshStats:
+		refreshStats(cmd, os.Args[3:])
+	case cAddFreqCat:
+		addFreqCat(cmd, os.Args[3:])
+	case cMigrate:
+		migrate(cmd, os.Args[3:])
+	case cBuildFeatBlobs:
+		buildFeatBlobs(cmd, os.Args[3:])
+	case cBuildFTSIndex:
+		buildFTSIndex(cmd, os.Args[3:])
+	case cSearch:
+		search(cmd, os.Args[3:])
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s.", cmd)
 		possible := []string{}
@@ -503,6 +848,8 @@ var terminalAccuPrefix = ""
 
 var dbName string
 
+var db *dbapi.DB
+
 var progName = "scripttool"
 
 type cmd struct {
@@ -515,39 +862,75 @@ type cmd struct {
 const (
 	cHelp                        = "help"
 	cScriptGen                   = "scriptgen"
+	cFilterPreview               = "filter_preview"
+	cValidateConfig              = "validate_config"
 	cListFilterFeats             = "list_filter_feats"
 	cListSelectorFeats           = "list_selector_feats"
 	cListBatches                 = "list_batches"
 	cListScripts                 = "list_scripts"
 	cBlockSents                  = "block_sents"
 	cListBlocked                 = "list_blocked_sents"
+	cUnblockSents                = "unblock_sents"
+	cCorrectSent                 = "correct_sent"
+	cSentHistory                 = "sent_history"
+	cHistory                     = "history"
+	cBatchOp                     = "batch_op"
+	cScriptOp                    = "script_op"
+	cRenameBatch                 = "rename_batch"
+	cRenameScript                = "rename_script"
+	cTruncateScript              = "truncate_script"
 	cExportBatch                 = "export_batch"
 	cExportScript                = "export_script"
 	cExportScriptWithoutMetadata = "export_script_wo_metadata"
 	cExportBatchMetadata         = "export_batch_metadata"
 	cExportScriptMetadata        = "export_script_metadata"
 	cStats                       = "stats"
+	cRefreshStats                = "refresh_stats"
+	cAddFreqCat                  = "add_freq_cat"
+	cMigrate                     = "migrate"
+	cBuildFeatBlobs              = "build_feat_blobs"
+	cBuildFTSIndex               = "build_fts_index"
+	cSearch                      = "search"
 )
 
 var availableCmds = []string{
 	cHelp,
 	cScriptGen,
+	cFilterPreview,
+	cValidateConfig,
 	cListFilterFeats,
 	cListSelectorFeats,
 	cListBatches,
 	cListScripts,
 	cBlockSents,
 	cListBlocked,
+	cUnblockSents,
+	cCorrectSent,
+	cSentHistory,
+	cHistory,
+	cBatchOp,
+	cScriptOp,
+	cRenameBatch,
+	cRenameScript,
+	cTruncateScript,
 	cExportBatch,
 	cExportScript,
 	cExportScriptWithoutMetadata,
 	cStats,
+	cRefreshStats,
+	cAddFreqCat,
+	cMigrate,
+	cBuildFeatBlobs,
+	cBuildFTSIndex,
+	cSearch,
 }
 
 var usage = []cmd{
 	{name: cHelp, desc: "print help and exit"},
 
-	{name: cScriptGen, args: []string{"config file"}, desc: "run batch filtering and/or script generation as specified in the input config file\nsample config files can be found in the config folder"},
+	{name: cScriptGen, args: []string{"-dry-run", "-n sample size (default 10)", "config file"}, desc: "run batch filtering and/or script generation as specified in the input config file\nsample config files can be found in the config folder\nwith -dry-run, the filter output is previewed (see filter_preview), and no batch or script is created"},
+	{name: cFilterPreview, args: []string{"-n sample size (default 10)", "config file"}, desc: "preview the filter in the input config file without creating a batch\nprints the number of matching sentences and a random sample of them"},
+	{name: cValidateConfig, args: []string{"config file"}, desc: "check the filter and selector options in the input config file against the db\nprints all problems found, with JSON paths"},
 
 	{name: cListFilterFeats, desc: "list available filter features"},
 	{name: cListSelectorFeats, desc: "list available script features"},
@@ -555,18 +938,39 @@ var usage = []cmd{
 	{name: cListBatches, desc: "list existing batches"},
 	{name: cListScripts, desc: "list existing scripts"},
 
-	{name: cBlockSents, args: []string{"ids"}, desc: "block specified sentence ids"},
-	{name: cListBlocked, desc: "list blocked sentences"},
+	{name: cBlockSents, args: []string{"-reason r", "-user u", "-file id file", "-re regexp", "-source source regexp", "ids"}, desc: "block specified sentence ids, sentence ids listed in a file, sentences matching a regexp, or sentences from matching sources\nthe reason and user (default $USER) are saved with the blocked sentences"},
+	{name: cUnblockSents, args: []string{"-file id file", "ids"}, desc: "unblock specified sentence ids, or sentence ids listed in a file"},
+	{name: cListBlocked, args: []string{"-reason r"}, desc: "list blocked sentences, optionally only those blocked for a certain reason"},
+
+	{name: cCorrectSent, args: []string{"-user u", "-comment c", "id", "corrected text"}, desc: "correct the text of a sentence, recomputing its features\nthe old text is saved in the sentence history, and scripts containing the sentence are flagged as modified"},
+	{name: cSentHistory, args: []string{"id"}, desc: "list the text corrections of a sentence"},
+
+	{name: cHistory, args: []string{"-n limit", "-op operation", "batch or script name"}, desc: "list the operations changing batches, scripts, blocked sentences and sentence texts, oldest first\noptionally only the latest operations, operations of a certain type, or operations on a certain batch or script"},
+
+	{name: cBatchOp, args: []string{"union|intersect|diff|copy", "target batch", "operands"}, desc: "create a batch from the sentences of other batches (diff: the first operand minus the others)\noperands are batches, unless prefixed with script: (e.g. script:myscript)\nblocked sentences are excluded, and the operation is saved in the batch metadata"},
+	{name: cScriptOp, args: []string{"union|intersect|diff|copy", "target script", "operands"}, desc: "create a script from the sentences of other scripts (diff: the first operand minus the others)\noperands are scripts, unless prefixed with batch: (e.g. batch:mybatch)\nblocked sentences are excluded, and the operation is saved in the script metadata"},
+	{name: cRenameBatch, args: []string{"from", "to"}, desc: "rename a batch"},
+	{name: cRenameScript, args: []string{"from", "to"}, desc: "rename a script"},
+	{name: cTruncateScript, args: []string{"script name", "size"}, desc: "keep the first sentences of a script (in selection order), deleting the rest"},
 
 	{name: cExportBatch, args: []string{"batch names"}, desc: "export named batches (leave empty to export all batches)"},
-	{name: cExportScript, args: []string{"script names"}, desc: "export named scripts (leave empty to export all scripts)"},
+	{name: cExportScript, args: []string{"script names"}, desc: "export named scripts, with metadata and the selection provenance of each sentence (leave empty to export all scripts)"},
 
 	{name: cExportScriptWithoutMetadata, args: []string{"script names"}, desc: "export named scripts without metadata (leave empty to export all batches)"},
 
 	{name: cExportBatchMetadata, args: []string{"batch names"}, desc: "export metadata for named batches"},
 	{name: cExportScriptMetadata, args: []string{"script names"}, desc: "export metadata for named scripts"},
 
-	{name: cStats, desc: "print db statistics"},
+	{name: cStats, desc: "print db statistics (cached, except for blocked sentences and batch and script sizes)\nthe cache is cleared when sentences, features or categories are added or corrected, computed_at shows when it was computed"},
+	{name: cRefreshStats, desc: "recompute cached db statistics, and print them"},
+
+	{name: cAddFreqCat, args: []string{"feature", "category", "from", "to"}, desc: "add a feature category from the values of a feature ranked by chunk frequency\nfrom/to are ranks (e.g. 1 500 for the top 500) or percentiles (e.g. 0% 10%)\nany existing category with the same name is replaced"},
+
+	{name: cMigrate, desc: "upgrade the db schema to the current version"},
+	{name: cBuildFeatBlobs, desc: "create feat blobs (used for fast sentence loading) for chunks that don't have one\nrun after migrating a db created before feat blobs were introduced"},
+
+	{name: cBuildFTSIndex, desc: "create the full-text index used by search and the text_match filter (requires building with -tags sqlite_fts5)\nthe index is kept up to date when sentences are added"},
+	{name: cSearch, args: []string{"-n limit (default 100)", "query"}, desc: "full-text search, printing matching sentence ids and texts\nquery syntax: words, \"phrases\", prefixes (word*), AND, OR, NOT"},
 }
 
 func printUsage() {
@@ -603,21 +1007,27 @@ func main() {
 	}
 
 	dbFile := os.Args[1]
-	err := dbapi.Open(dbFile)
+	cmd := os.Args[2]
+
+	var err error
+	if cmd == cMigrate {
+		db, err = dbapi.OpenForMigration(dbFile)
+	} else {
+		db, err = dbapi.Open(dbFile)
+	}
 	if err != nil {
 		log.Fatalf("Couldn't open db from file %s : %v", dbFile, err)
 	}
+	db.SetUser(os.Getenv("USER"))
 	dbName = path.Base(dbFile)
 	dbName = strings.TrimSuffix(dbName, path.Ext(dbName))
 
-	cmd := os.Args[2]
-
 	err = runCmd(cmd)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't run cmd %s: %v", cmd, err)
 	}
 
-	err = dbapi.Close()
+	err = db.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't close db: %v", err)
 	}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
 	"github.com/stts-se/wikispeech-manuscriptor/filter"
 	"github.com/stts-se/wikispeech-manuscriptor/protocol"
 	"github.com/stts-se/wikispeech-manuscriptor/selection"
@@ -20,7 +22,7 @@ func createScript(config protocol.Config) {
 		log.Fatalf("Invalid selector option(s): %v", err)
 	}
 
-	selector, err := selection.NewSelector(opts)
+	selector, err := selection.NewSelector(db, opts)
 	if err != nil {
 		log.Fatalf("NewSelector failed: %v", err)
 	}
@@ -76,7 +78,7 @@ func createScript(config protocol.Config) {
 	selectorMetadata := protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: selector.Options}}
 
 	// save input batch size in script metadata
-	actualBatchSize, err := dbapi.BatchSize(opts.FromBatch)
+	actualBatchSize, err := db.BatchSize(opts.FromBatch)
 	if err != nil {
 		log.Fatalf("dbapi.BatchSize failed : %v", err)
 	}
@@ -104,8 +106,21 @@ func createBatch(config protocol.Config) {
 		log.Fatalf("Couldn't create query builder : %v", err)
 	}
 
+	if from := filter.FromOperands(config.Filter); len(from) > 0 {
+		batchMetadata.Lineage, err = db.Lineage(from...)
+		if err != nil {
+			log.Fatalf("Couldn't read batch lineage : %v", err)
+		}
+	}
+
+	// the funnel is computed before filtering, since the batch itself may be excluded by the filter
+	batchMetadata.Funnel, err = filter.Funnel(db, config.Filter)
+	if err != nil {
+		log.Fatalf("Couldn't compute filter funnel : %v", err)
+	}
+
 	fmt.Fprintf(os.Stderr, "[scripttool] Filtering up to %v sents into batch %s\n", config.Filter.TargetSize, config.Filter.BatchName)
-	n, err := filter.ExecQuery(filterQueryBuilder)
+	n, err := filter.ExecQuery(db, filterQueryBuilder)
 	if err != nil {
 		log.Fatalf("Couldn't exec query : %v", err)
 	}
@@ -118,13 +133,21 @@ func createBatch(config protocol.Config) {
 	fmt.Fprintf(os.Stderr, "Target size: %v\n", batchMetadata.TargetSize)
 	fmt.Fprintf(os.Stderr, "Output size: %v\n", batchMetadata.OutputSize)
 	fmt.Fprintf(os.Stderr, "Timestamp: %s\n", batchMetadata.Timestamp)
+	if len(batchMetadata.Lineage) > 0 {
+		var lineage []string
+		for _, o := range batchMetadata.Lineage {
+			lineage = append(lineage, o.Kind+":"+o.Name)
+		}
+		fmt.Fprintf(os.Stderr, "Lineage (nearest first): %s\n", strings.Join(lineage, ", "))
+	}
+	printFunnel(batchMetadata.Funnel)
 	fmt.Fprintf(os.Stderr, "\n")
 
 	pBytes, err := json.Marshal(batchMetadata)
 	if err != nil {
 		log.Fatalf("failed to marshal filter metadata : %v", err)
 	}
-	err = dbapi.SetBatchProperties(config.Filter.BatchName, pBytes)
+	err = db.SetBatchProperties(config.Filter.BatchName, pBytes)
 	if err != nil {
 		log.Fatalf("failed to save batch properties : %v", err)
 	}
@@ -134,11 +157,23 @@ func createBatch(config protocol.Config) {
 	}
 }
 
-func scriptGen(cmd string, args []string) {
-	if len(args) != 1 {
-		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+// printFunnel prints the filter funnel report to stderr
+func printFunnel(funnel []protocol.FunnelStep) {
+	if len(funnel) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n=== FILTER FUNNEL ===\n")
+	fmt.Fprintf(os.Stderr, "%-40s %12s %15s\n", "Criterion", "Remaining", "Rejected alone")
+	for _, step := range funnel {
+		criterion := strings.TrimSpace(step.Criterion + " " + strings.Join(step.Args, " "))
+		if len(criterion) > 40 {
+			criterion = criterion[:37] + "..."
+		}
+		fmt.Fprintf(os.Stderr, "%-40s %12d %15d\n", criterion, step.Remaining, step.RejectedAlone)
 	}
-	configFile := args[0]
+}
+
+func readConfig(configFile string) protocol.Config {
 	var config protocol.Config
 	bts, err := os.ReadFile(configFile)
 	if err != nil {
@@ -148,20 +183,136 @@ func scriptGen(cmd string, args []string) {
 	if err != nil {
 		log.Fatalf("Failed to unmarshal config file %s : %v", configFile, err)
 	}
+	return config
+}
+
+// validateConfig checks the config against the db, and returns all problems found
+func validateConfig(configFile string, config protocol.Config) []protocol.ConfigError {
+	var res []protocol.ConfigError
+
+	// unknown (e.g. misspelled) fields are ignored by readConfig
+	bts, err := os.ReadFile(configFile)
+	if err != nil {
+		log.Fatalf("Failed to read config file %s : %v", configFile, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&protocol.Config{})
+	if err != nil {
+		res = append(res, protocol.ConfigError{Path: "config", Message: err.Error()})
+	}
+
+	newBatch := ""
+	if !config.Filter.Empty() {
+		errs, err := filter.ValidatePayload(db, config.Filter, "filter")
+		if err != nil {
+			log.Fatalf("Filter validation failed : %v", err)
+		}
+		res = append(res, errs...)
+		newBatch = config.Filter.BatchName
+	}
+	if !config.Selector.Empty() {
+		errs, err := selection.ValidateOptions(db, config.Selector, "selector", newBatch)
+		if err != nil {
+			log.Fatalf("Selector validation failed : %v", err)
+		}
+		res = append(res, errs...)
+	}
+	return res
+}
+
+func validateConfigFile(cmd string, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	errs := validateConfig(args[0], readConfig(args[0]))
+	if len(errs) == 0 {
+		fmt.Fprintf(os.Stderr, "[scripttool] Config %s is valid\n", args[0])
+		return
+	}
+	bts, err := json.MarshalIndent(errs, " ", " ")
+	if err != nil {
+		log.Fatalf("Failed to marshal validation errors: %v", err)
+	}
+	fmt.Println(string(bts))
+	os.Exit(1)
+}
+
+// previewBatch prints the result of a filter dry-run as JSON
+func previewBatch(config protocol.Config, sampleSize int) {
+	fmt.Fprintf(os.Stderr, "[scripttool] Dry run: counting sents matching the filter for batch %s\n", config.Filter.BatchName)
+	res, err := filter.Preview(db, config.Filter, sampleSize)
+	if err != nil {
+		log.Fatalf("Filter preview failed : %v", err)
+	}
+	funnel, err := filter.Funnel(db, config.Filter)
+	if err != nil {
+		log.Fatalf("Couldn't compute filter funnel : %v", err)
+	}
+	printFunnel(funnel)
+	bts, err := json.MarshalIndent(res, " ", " ")
+	if err != nil {
+		log.Fatalf("Failed to marshal filter preview: %v", err)
+	}
+	fmt.Println(string(bts))
+}
+
+func filterPreview(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	sampleSize := flags.Int("n", 10, "number of sample sentences")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	config := readConfig(flags.Arg(0))
+	if config.Filter.Empty() {
+		log.Fatalf("No filter config in %s", flags.Arg(0))
+	}
+	previewBatch(config, *sampleSize)
+}
+
+func scriptGen(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "preview the filter output (count and sample sentences) without creating a batch or script")
+	sampleSize := flags.Int("n", 10, "number of sample sentences in dry-run mode")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("Invalid args for cmd %s: %v", cmd, args)
+	}
+	configFile := flags.Arg(0)
+	config := readConfig(configFile)
+	var err error
 
 	if config.Filter.TargetSize == 0 && !config.Filter.Empty() {
 		fmt.Fprintf(os.Stderr, "If filter config is non-empty, target size must be specified\n")
 		os.Exit(1)
 	}
 
+	if errs := validateConfig(configFile, config); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "Invalid config: %v\n", e)
+		}
+		os.Exit(1)
+	}
+
 	if config.Filter.TargetSize > 0 && config.Filter.TargetSize < config.Selector.TargetSize {
 		fmt.Fprintf(os.Stderr, "Batch target size cannot be higher than script target size (%v vs %v)\n", config.Filter.TargetSize, config.Selector.TargetSize)
 		os.Exit(1)
 	}
 
+	if *dryRun {
+		if !config.Filter.Empty() {
+			previewBatch(config, *sampleSize)
+		}
+		if !config.Selector.Empty() {
+			fmt.Fprintf(os.Stderr, "[scripttool] Dry run: skipping selection into script %s\n", config.Selector.ScriptName)
+		}
+		return
+	}
+
 	if config.ClearBatches {
 		fmt.Fprintf(os.Stderr, "[scripttool] Clearing batch %s... ", config.Filter.BatchName)
-		err = dbapi.DeleteBatches(config.Filter.BatchName)
+		err = db.DeleteBatchesWithConfig(config, config.Filter.BatchName)
 		if err != nil {
 			log.Fatalf("DeleteBatches failed: %v", err)
 		}
@@ -169,7 +320,7 @@ func scriptGen(cmd string, args []string) {
 	}
 	if config.ClearScripts {
 		fmt.Fprintf(os.Stderr, "[scripttool] Clearing script %s... ", config.Selector.ScriptName)
-		err = dbapi.DeleteScripts(config.Selector.ScriptName)
+		err = db.DeleteScriptsWithConfig(config, config.Selector.ScriptName)
 		if err != nil {
 			log.Fatalf("DeleteScripts failed: %v", err)
 		}
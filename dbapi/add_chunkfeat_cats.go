@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/stts-se/wikispeech-manuscriptor/text"
@@ -15,17 +16,44 @@ type ChunkFeatCat struct {
 	TargetFeatName string
 }
 
-func ParseChunkFeatCatFile(fn string) (string, []ChunkFeatCat, error) {
+// ChunkFeatCatParent declares Parent as a parent category of the category Name
+type ChunkFeatCatParent struct {
+	Name   string
+	Parent string
+}
+
+// ChunkFeatCatParentPrefix marks a header line declaring a parent category in a chunkfeat cat file:
+//
+//	@parent<TAB>category<TAB>parent category
+const ChunkFeatCatParentPrefix = "@parent"
+
+// ParseChunkFeatCatFile reads a tab separated file of source-featname, target-featname, featvalue.
+// Returns the source feat name, the chunkfeat cats, and any parent categories declared in the file.
+func ParseChunkFeatCatFile(fn string) (string, []ChunkFeatCat, []ChunkFeatCatParent, error) {
 	var res []ChunkFeatCat
+	var parents []ChunkFeatCatParent
 	var sourceFeatName string
 
 	bytes, err := ioutil.ReadFile(fn)
 	if err != nil {
-		return sourceFeatName, res, fmt.Errorf("func lines() failed to read file '%s' : %v", fn, err)
+		return sourceFeatName, res, parents, fmt.Errorf("func lines() failed to read file '%s' : %v", fn, err)
 	}
 
 	lines := strings.Split(strings.TrimSuffix(string(bytes), "\n"), "\n")
 	for _, l := range lines {
+		if strings.HasPrefix(l, ChunkFeatCatParentPrefix) {
+			fs := strings.Split(l, "\t")
+			if len(fs) != 3 {
+				return sourceFeatName, res, parents, fmt.Errorf("invalid parent declaration '%s' in file %s", l, fn)
+			}
+			name := strings.ToLower(strings.TrimSpace(fs[1]))
+			parent := strings.ToLower(strings.TrimSpace(fs[2]))
+			if name == "" || parent == "" || name == parent {
+				return sourceFeatName, res, parents, fmt.Errorf("invalid parent declaration '%s' in file %s", l, fn)
+			}
+			parents = append(parents, ChunkFeatCatParent{Name: name, Parent: parent})
+			continue
+		}
 		if strings.HasPrefix(l, "#") {
 			log.Printf("skipping commented line: '%s'", l)
 			continue
@@ -41,7 +69,7 @@ func ParseChunkFeatCatFile(fn string) (string, []ChunkFeatCat, error) {
 		fn := strings.ToLower(strings.TrimSpace(fs[0]))
 
 		if sourceFeatName != "" && fn != sourceFeatName {
-			return sourceFeatName, res, fmt.Errorf("mixed source feat names: %s, %s in file %s", sourceFeatName, fn, fn)
+			return sourceFeatName, res, parents, fmt.Errorf("mixed source feat names: %s, %s in file %s", sourceFeatName, fn, fn)
 		}
 		sourceFeatName = fn
 
@@ -57,11 +85,11 @@ func ParseChunkFeatCatFile(fn string) (string, []ChunkFeatCat, error) {
 		res = append(res, ChunkFeatCat{TargetFeatName: cat, FeatValue: value})
 	}
 
-	return sourceFeatName, res, nil
+	return sourceFeatName, res, parents, nil
 }
 
 // AddChunkFeatCats takes a list of ChunkFeatCats and inserts the associted FEAT in the chunkfeatcat relation table.
-func AddChunkFeatCats(sourceFeatName string, feats []ChunkFeatCat) (int, error) {
+func (db *DB) AddChunkFeatCats(sourceFeatName string, feats []ChunkFeatCat) (int, error) {
 
 	tmpTableName := fmt.Sprintf("chunk_feats_to_add_%s", text.RandomString(10))
 
@@ -137,6 +165,65 @@ func AddChunkFeatCats(sourceFeatName string, feats []ChunkFeatCat) (int, error)
 
 	}
 
+	err = clearStatsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+
+	return n, nil
+}
+
+// AddChunkFeatCatParents inserts parent category declarations into the chunkfeatcat_parent table. Returns the number of new declarations.
+func (db *DB) AddChunkFeatCatParents(parents []ChunkFeatCatParent) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("AddChunkFeatCatParents failed to start transaction : %v", err)
+	}
+
+	n := 0
+	for _, p := range parents {
+		name := strings.ToLower(strings.TrimSpace(p.Name))
+		parent := strings.ToLower(strings.TrimSpace(p.Parent))
+		if name == "" || parent == "" || name == parent {
+			tx.Rollback()
+			return 0, fmt.Errorf("invalid parent declaration %v", p)
+		}
+
+		xRes, err := tx.Exec(`INSERT OR IGNORE INTO chunkfeatcat_parent (name, parent) VALUES (?, ?)`, name, parent)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to insert into chunkfeatcat_parent table : %v", err)
+		}
+		ra, err := xRes.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed call to RowsAffected : %v", err)
+		}
+		if ra > 0 {
+			n++
+		}
+	}
+
+	ancestors, err := chunkFeatCatAncestorsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for name, as := range ancestors {
+		for _, a := range as {
+			if a == name {
+				tx.Rollback()
+				return 0, fmt.Errorf("category %s is its own ancestor", name)
+			}
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
@@ -144,3 +231,45 @@ func AddChunkFeatCats(sourceFeatName string, feats []ChunkFeatCat) (int, error)
 
 	return n, nil
 }
+
+// chunkFeatCatAncestorsTx returns a map from each category with declared parents to all its ancestor categories
+func chunkFeatCatAncestorsTx(tx *sql.Tx) (map[string][]string, error) {
+	res := make(map[string][]string)
+
+	rows, err := tx.Query(`SELECT name, parent FROM chunkfeatcat_parent`)
+	if err != nil {
+		return res, fmt.Errorf("failed to query chunkfeatcat_parent : %v", err)
+	}
+	defer rows.Close()
+
+	parents := make(map[string][]string)
+	for rows.Next() {
+		var name, parent string
+		err := rows.Scan(&name, &parent)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		parents[name] = append(parents[name], parent)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+
+	for name := range parents {
+		seen := make(map[string]bool)
+		queue := append([]string{}, parents[name]...)
+		for len(queue) > 0 {
+			p := queue[0]
+			queue = queue[1:]
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			res[name] = append(res[name], p)
+			queue = append(queue, parents[p]...)
+		}
+		sort.Strings(res[name])
+	}
+
+	return res, nil
+}
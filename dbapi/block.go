@@ -0,0 +1,238 @@
+package dbapi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// Blocked sentences are stored in the reserved batch text.BlockBatch, which is excluded by all filter and selection queries.
+// The reason for blocking a sentence is stored in the block_info table.
+
+// BlockInfo describes why and by whom sentences are blocked
+type BlockInfo struct {
+	Reason string `json:"reason"`
+	User   string `json:"user"`
+}
+
+// BlockedSent is a blocked sentence, along with its block info
+type BlockedSent struct {
+	ID        int64  `json:"id"`
+	Text      string `json:"text"`
+	Reason    string `json:"reason"`
+	User      string `json:"user"`
+	Timestamp string `json:"timestamp"`
+}
+
+// blockOpConfig is the config saved in the oplog for block operations
+type blockOpConfig struct {
+	BlockInfo
+	IDs      []int64  `json:"ids,omitempty"`
+	Texts    []string `json:"texts,omitempty"`
+	RE       string   `json:"re,omitempty"`
+	SourceRE string   `json:"source_re,omitempty"`
+}
+
+// maxInArgs is the max number of values in the IN list of a single statement, to stay below the sqlite limit on the number of query args
+const maxInArgs = 500
+
+// idsQuery is a query selecting chunk ids, along with its args
+type idsQuery struct {
+	query string
+	args  []interface{}
+}
+
+// inQueries splits values into batches of at most maxInArgs, and returns a query per batch, selecting the ids of the chunks where column is in the batch
+func inQueries(column string, values []interface{}) []idsQuery {
+	res := []idsQuery{}
+	for start := 0; start < len(values); start += maxInArgs {
+		end := start + maxInArgs
+		if end > len(values) {
+			end = len(values)
+		}
+		batch := values[start:end]
+		res = append(res, idsQuery{query: `SELECT id FROM chunk WHERE ` + column + ` IN (` + placeholders(len(batch)) + `)`, args: batch})
+	}
+	return res
+}
+
+// block blocks the chunks selected by chunkIDsQueries, queries selecting chunk ids, in a single transaction.
+// Chunks that are already blocked keep their block info. Returns the number of blocked chunks.
+func (db *DB) block(config blockOpConfig, chunkIDsQueries ...idsQuery) (int64, error) {
+	info := config.BlockInfo
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin db transaction : %v", err)
+	}
+
+	var n int64
+	for _, q := range chunkIDsQueries {
+		infoArgs := append([]interface{}{info.Reason, info.User, text.BlockBatch}, q.args...)
+		_, err = tx.Exec(`INSERT OR IGNORE INTO block_info (chunk_id, reason, blocked_by) SELECT id, ?, ? FROM chunk WHERE id NOT IN (SELECT chunk_id FROM batch WHERE name = ?) AND id IN (`+q.query+`)`, infoArgs...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to insert block info : %v", err)
+		}
+
+		batchArgs := append([]interface{}{text.BlockBatch}, q.args...)
+		res, err := tx.Exec(`INSERT OR IGNORE INTO batch (chunk_id, name) SELECT id, ? FROM chunk WHERE id IN (`+q.query+`)`, batchArgs...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to insert into batch : %v", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+		}
+		n += rows
+	}
+
+	err = db.LogOpTx(tx, OpBlock, []string{text.BlockBatch}, n, config)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return n, nil
+}
+
+func placeholders(n int) string {
+	qs := make([]string, n)
+	for i := range qs {
+		qs[i] = "?"
+	}
+	return strings.Join(qs, ",")
+}
+
+// BlockSentIDsWithInfo blocks the sentences with the given ids. Returns the number of newly blocked sentences.
+func (db *DB) BlockSentIDsWithInfo(info BlockInfo, ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	n, err := db.block(blockOpConfig{BlockInfo: info, IDs: ids}, inQueries("id", args)...)
+	if err != nil {
+		return n, fmt.Errorf("BlockSentIDsWithInfo failed : %v", err)
+	}
+	return n, nil
+}
+
+// BlockSentsWithInfo blocks the sentences with the given texts. Returns the number of newly blocked sentences.
+func (db *DB) BlockSentsWithInfo(info BlockInfo, sents ...string) (int64, error) {
+	if len(sents) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{}
+	for _, s := range sents {
+		args = append(args, s)
+	}
+	n, err := db.block(blockOpConfig{BlockInfo: info, Texts: sents}, inQueries("text", args)...)
+	if err != nil {
+		return n, fmt.Errorf("BlockSentsWithInfo failed : %v", err)
+	}
+	return n, nil
+}
+
+// BlockSentsMatchingRE blocks all sentences matching the regular expression re. Returns the number of newly blocked sentences.
+func (db *DB) BlockSentsMatchingRE(info BlockInfo, re string) (int64, error) {
+	n, err := db.block(blockOpConfig{BlockInfo: info, RE: re}, idsQuery{query: `SELECT id FROM chunk WHERE text REGEXP ?`, args: []interface{}{re}})
+	if err != nil {
+		return n, fmt.Errorf("BlockSentsMatchingRE failed : %v", err)
+	}
+	return n, nil
+}
+
+// BlockSentsFromSourceRE blocks all sentences from the sources with names matching the regular expression sourceRE. Returns the number of newly blocked sentences.
+func (db *DB) BlockSentsFromSourceRE(info BlockInfo, sourceRE string) (int64, error) {
+	n, err := db.block(blockOpConfig{BlockInfo: info, SourceRE: sourceRE}, idsQuery{query: `SELECT source_chunk.chunk_id FROM source, source_chunk WHERE source.id = source_chunk.source_id AND source.name REGEXP ?`, args: []interface{}{sourceRE}})
+	if err != nil {
+		return n, fmt.Errorf("BlockSentsFromSourceRE failed : %v", err)
+	}
+	return n, nil
+}
+
+// UnblockSentIDs unblocks the sentences with the given ids. Returns the number of unblocked sentences.
+func (db *DB) UnblockSentIDs(ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("UnblockSentIDs failed to begin db transaction : %v", err)
+	}
+	var n int64
+	for _, q := range inQueries("id", args) {
+		res, err := tx.Exec(`DELETE FROM batch WHERE name = ? AND chunk_id IN (`+q.query+`)`, append([]interface{}{text.BlockBatch}, q.args...)...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("UnblockSentIDs failed to delete from batch : %v", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+		}
+		n += rows
+		_, err = tx.Exec(`DELETE FROM block_info WHERE chunk_id IN (`+q.query+`)`, q.args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("UnblockSentIDs failed to delete from block_info : %v", err)
+		}
+	}
+	err = db.LogOpTx(tx, OpUnblock, []string{text.BlockBatch}, n, blockOpConfig{IDs: ids})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return n, nil
+}
+
+// ListBlocked lists the blocked sentences, along with their block info. If reason is non-empty, only sentences blocked for this reason are listed.
+// Sentences blocked without block info have an empty reason.
+func (db *DB) ListBlocked(reason string) ([]BlockedSent, error) {
+	res := []BlockedSent{}
+
+	q := `SELECT chunk.id, chunk.text, COALESCE(block_info.reason, ''), COALESCE(block_info.blocked_by, ''), COALESCE(block_info.timestamp, '') FROM batch JOIN chunk ON chunk.id = batch.chunk_id LEFT JOIN block_info ON block_info.chunk_id = batch.chunk_id WHERE batch.name = ?`
+	args := []interface{}{text.BlockBatch}
+	if reason != "" {
+		q += ` AND block_info.reason = ?`
+		args = append(args, reason)
+	}
+	q += ` ORDER BY chunk.id`
+
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return res, fmt.Errorf("ListBlocked failed to query : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s BlockedSent
+		err := rows.Scan(&s.ID, &s.Text, &s.Reason, &s.User, &s.Timestamp)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res = append(res, s)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,69 @@
+package dbapi
+
+import (
+	"database/sql"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// ChunkCount holds pre-computed counts for a chunk, stored in the chunk_count table
+type ChunkCount struct {
+	WordCount      int
+	CommaCount     int
+	DigitCount     int
+	CharCount      int
+	LowestWordFreq int
+	SourceFreq     int // the number of sources (articles) containing the chunk
+}
+
+// ComputeChunkCount computes the counts of a sentence from its text and feats. LowestWordFreq depends on the complete corpus, and is set by InsertLowestWordFreqForChunk.
+// SourceFreq is counted in the db when the chunk count is inserted, and updated when the chunk is added to more sources.
+func ComputeChunkCount(s text.Sentence) ChunkCount {
+	return ChunkCount{
+		WordCount:  s.Feats[text.FeatCount][text.FeatValWordCount],
+		CommaCount: s.Feats[text.FeatPunct][","],
+		DigitCount: s.Feats[text.FeatCount][text.FeatValDigitCount],
+		CharCount:  utf8.RuneCountInString(s.Text),
+	}
+}
+
+func insertChunkCountTx(tx *sql.Tx, chunkID int64, c ChunkCount) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO chunk_count (chunk_id, word_count, comma_count, digit_count, char_count, lowest_word_freq, source_freq) VALUES (?, ?, ?, ?, ?, ?, (SELECT COUNT(*) FROM source_chunk WHERE chunk_id = ?))`, chunkID, c.WordCount, c.CommaCount, c.DigitCount, c.CharCount, c.LowestWordFreq, chunkID)
+	if err != nil {
+		return fmt.Errorf("failed to insert chunk_count : %v", err)
+	}
+	return nil
+}
+
+// GetChunkCount returns the pre-computed counts of a chunk
+func (db *DB) GetChunkCount(chunkID int64) (ChunkCount, error) {
+	var res ChunkCount
+	err := db.conn.QueryRow(`SELECT word_count, comma_count, digit_count, char_count, lowest_word_freq, source_freq FROM chunk_count WHERE chunk_id = ?`, chunkID).Scan(&res.WordCount, &res.CommaCount, &res.DigitCount, &res.CharCount, &res.LowestWordFreq, &res.SourceFreq)
+	if err != nil {
+		return res, fmt.Errorf("failed to get chunk_count for chunk %d : %v", chunkID, err)
+	}
+	return res, nil
+}
+
+const chunkCountSchema = `CREATE TABLE IF NOT EXISTS chunk_count(chunk_id INTEGER NOT NULL PRIMARY KEY, word_count INTEGER NOT NULL DEFAULT 0, comma_count INTEGER NOT NULL DEFAULT 0, digit_count INTEGER NOT NULL DEFAULT 0, char_count INTEGER NOT NULL DEFAULT 0, lowest_word_freq INTEGER NOT NULL DEFAULT 0, foreign key (chunk_id) references chunk(id) ON DELETE CASCADE);
+CREATE INDEX IF NOT EXISTS chunk_count_word_count ON chunk_count(word_count);
+CREATE INDEX IF NOT EXISTS chunk_count_comma_count ON chunk_count(comma_count);
+CREATE INDEX IF NOT EXISTS chunk_count_digit_count ON chunk_count(digit_count);
+CREATE INDEX IF NOT EXISTS chunk_count_char_count ON chunk_count(char_count);
+CREATE INDEX IF NOT EXISTS chunk_count_lowest_word_freq ON chunk_count(lowest_word_freq);`
+
+// sourceFreqMigration adds and fills in the chunk_count.source_freq column
+const sourceFreqMigration = `ALTER TABLE chunk_count ADD COLUMN source_freq INTEGER NOT NULL DEFAULT 0;
+UPDATE chunk_count SET source_freq = (SELECT COUNT(*) FROM source_chunk WHERE source_chunk.chunk_id = chunk_count.chunk_id);
+CREATE INDEX IF NOT EXISTS chunk_count_source_freq ON chunk_count(source_freq);`
+
+// chunkCountBackfill fills in chunk_count from the chunkfeats of existing chunks
+const chunkCountBackfill = `INSERT OR IGNORE INTO chunk_count (chunk_id, word_count, comma_count, digit_count, char_count, lowest_word_freq) SELECT chunk.id,
+COALESCE((SELECT SUM(chunk_chunkfeat.freq) FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunk_id = chunk.id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = 'count' AND chunkfeat.value = 'word_count'), 0),
+COALESCE((SELECT SUM(chunk_chunkfeat.freq) FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunk_id = chunk.id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = 'punct' AND chunkfeat.value = ','), 0),
+COALESCE((SELECT SUM(chunk_chunkfeat.freq) FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunk_id = chunk.id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = 'count' AND chunkfeat.value = 'digit_count'), 0),
+LENGTH(chunk.text),
+COALESCE((SELECT MIN(chunk_chunkfeat.freq) FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunk_id = chunk.id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = 'count' AND chunkfeat.value = 'lowest_word_freq'), 0)
+FROM chunk`
@@ -0,0 +1,206 @@
+package dbapi
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// ChunkEdit is a correction of the text of a chunk, saved in the chunk_edit table
+type ChunkEdit struct {
+	ID        int64  `json:"id"`
+	ChunkID   int64  `json:"chunk_id"`
+	OldText   string `json:"old_text"`
+	NewText   string `json:"new_text"`
+	User      string `json:"user"`
+	Comment   string `json:"comment,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// chunkWordFeatsQ selects the chunkfeat ids of the words of a chunk
+const chunkWordFeatsQ = `SELECT chunk_chunkfeat.chunkfeat_id FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunk_id = ? AND chunkfeat.id = chunk_chunkfeat.chunkfeat_id AND chunkfeat.name = '` + text.FeatWord + `'`
+
+// CorrectChunkText replaces the text of a chunk, and recomputes its chunkfeats (and thereby its chunkfeat categories), feat blob and counts.
+// The word frequencies of the removed and added words are updated, but the lowest word freq of other chunks is not recomputed.
+// The old text is saved in the chunk_edit table, and the chunk is flagged as modified in all scripts containing it.
+func (db *DB) CorrectChunkText(chunkID int64, newText, user, comment string) (ChunkEdit, error) {
+	res := ChunkEdit{ChunkID: chunkID, NewText: strings.TrimSpace(newText), User: user, Comment: comment}
+	if res.NewText == "" {
+		return res, fmt.Errorf("empty text for chunk %d", chunkID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, fmt.Errorf("CorrectChunkText failed to start transaction : %v", err)
+	}
+
+	err = tx.QueryRow(`SELECT text FROM chunk WHERE id = ?`, chunkID).Scan(&res.OldText)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return res, fmt.Errorf("no chunk with id %d", chunkID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to read chunk %d : %v", chunkID, err)
+	}
+	if res.OldText == res.NewText {
+		tx.Rollback()
+		return res, fmt.Errorf("text of chunk %d is unchanged", chunkID)
+	}
+
+	var existingID int64
+	err = tx.QueryRow(`SELECT id FROM chunk WHERE text = ?`, res.NewText).Scan(&existingID)
+	if err == nil {
+		tx.Rollback()
+		return res, fmt.Errorf("the corrected text already exists as chunk %d", existingID)
+	}
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to look up chunk : %v", err)
+	}
+
+	var nWordFreqs int64
+	err = tx.QueryRow(`SELECT COUNT(*) FROM wordfreq`).Scan(&nWordFreqs)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to read wordfreq table : %v", err)
+	}
+	updateWordFreqs := nWordFreqs > 0
+
+	if updateWordFreqs {
+		_, err = tx.Exec(`UPDATE wordfreq SET freq = freq - 1 WHERE chunkfeat_id IN (`+chunkWordFeatsQ+`)`, chunkID)
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to update wordfreq table : %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE chunk SET text = ? WHERE id = ?`, res.NewText, chunkID)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to update chunk %d : %v", chunkID, err)
+	}
+	_, err = tx.Exec(`DELETE FROM chunk_chunkfeat WHERE chunk_id = ?`, chunkID)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to delete chunkfeats of chunk %d : %v", chunkID, err)
+	}
+
+	s := text.ComputeSentence(res.NewText)
+	err = db.InsertChunkFeatsTx(tx, chunkID, s.Feats)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to insert chunkfeats : %v", err)
+	}
+	err = insertFeatBlobTx(tx, chunkID, s.Feats)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+
+	count := ComputeChunkCount(s)
+	if updateWordFreqs {
+		_, err = tx.Exec(`UPDATE wordfreq SET freq = freq + 1 WHERE chunkfeat_id IN (`+chunkWordFeatsQ+`)`, chunkID)
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to update wordfreq table : %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO wordfreq (chunkfeat_id, freq) SELECT chunkfeat_id, 1 FROM (`+chunkWordFeatsQ+`) WHERE chunkfeat_id NOT IN (SELECT chunkfeat_id FROM wordfreq)`, chunkID)
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to insert into wordfreq table : %v", err)
+		}
+
+		var lowest sql.NullInt64
+		err = tx.QueryRow(`SELECT MIN(wordfreq.freq) FROM wordfreq WHERE chunkfeat_id IN (`+chunkWordFeatsQ+`)`, chunkID).Scan(&lowest)
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to compute lowest word freq : %v", err)
+		}
+		if lowest.Valid {
+			count.LowestWordFreq = int(lowest.Int64)
+			err = db.InsertChunkFeatsTx(tx, chunkID, map[string]map[string]int{text.FeatCount: {text.FeatValLowestWordFreq: count.LowestWordFreq}})
+			if err != nil {
+				tx.Rollback()
+				return res, fmt.Errorf("failed to insert lowest word freq : %v", err)
+			}
+		}
+	}
+	err = insertChunkCountTx(tx, chunkID, count)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+
+	_, err = tx.Exec(`UPDATE script SET modified = 1 WHERE chunk_id = ?`, chunkID)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to flag scripts as modified : %v", err)
+	}
+
+	execRes, err := tx.Exec(`INSERT INTO chunk_edit (chunk_id, old_text, new_text, edited_by, comment) VALUES (?, ?, ?, ?, ?)`, chunkID, res.OldText, res.NewText, user, comment)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to insert into chunk_edit : %v", err)
+	}
+	res.ID, err = execRes.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed LastInsertId() : %v", err)
+	}
+	err = tx.QueryRow(`SELECT timestamp FROM chunk_edit WHERE id = ?`, res.ID).Scan(&res.Timestamp)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to read chunk_edit : %v", err)
+	}
+	err = db.LogOpTx(tx, OpCorrectSent, []string{}, 1, res)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+
+	err = clearStatsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return res, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return res, nil
+}
+
+// ChunkHistory returns the text corrections of a chunk, oldest first
+func (db *DB) ChunkHistory(chunkID int64) ([]ChunkEdit, error) {
+	res := []ChunkEdit{}
+	rows, err := db.conn.Query(`SELECT id, chunk_id, old_text, new_text, edited_by, comment, timestamp FROM chunk_edit WHERE chunk_id = ? ORDER BY id`, chunkID)
+	if err != nil {
+		return res, fmt.Errorf("failed to query chunk_edit : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ChunkEdit
+		err := rows.Scan(&e.ID, &e.ChunkID, &e.OldText, &e.NewText, &e.User, &e.Comment, &e.Timestamp)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res = append(res, e)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
+
+// ModifiedScripts returns the number of corrected chunks in each script containing corrected chunks
+func (db *DB) ModifiedScripts() (map[string]int64, error) {
+	res, err := db.queryNameCounts(`SELECT name, COUNT(*) FROM script WHERE modified = 1 GROUP BY name`)
+	if err != nil {
+		return res, fmt.Errorf("failed to list modified scripts : %v", err)
+	}
+	return res, nil
+}
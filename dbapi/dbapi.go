@@ -2,9 +2,9 @@ package dbapi
 
 import (
 	"database/sql"
+	_ "embed"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
@@ -18,7 +18,17 @@ import (
 	"github.com/stts-se/wikispeech-manuscriptor/text"
 )
 
-var db *sql.DB
+// DB is a handle to a manuscript database
+type DB struct {
+	conn *sql.DB
+
+	// chunkFeatCache maps chunkfeat name and value to chunkfeat id, guarded by chunkFeatMutex
+	chunkFeatCache map[string]map[string]int64
+	chunkFeatMutex sync.RWMutex
+
+	// user is recorded in the oplog
+	user string
+}
 
 var remem = struct {
 	sync.Mutex
@@ -43,86 +53,152 @@ var regexMem = func(re, s string) (bool, error) {
 	return r.MatchString(s), nil
 }
 
-// Sqlite3WithRegex registers an Sqlite3 driver with regexp support. (Unfortunately quite slow regexp matching)
+// seededRandom is a deterministic pseudo-random number for id, given the seed (a splitmix64 step).
+// It is registered as the sql function seeded_random, and used for reproducible random sampling.
+func seededRandom(seed, id int64) int64 {
+	z := uint64(seed) + uint64(id)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
+
+var registerSqlite3WithRegex sync.Once
+
+// Sqlite3WithRegex registers an Sqlite3 driver with regexp support (unfortunately quite slow regexp matching), and the seeded_random function.
+// The driver is only registered once, so it is safe to call Sqlite3WithRegex for each db opened.
 func Sqlite3WithRegex() {
 	// regex := func(re, s string) (bool, error) {
 	// 	//return regexp.MatchString(re, s)
 	// 	return regexp.MatchString(re, s)
 	// }
+	registerSqlite3WithRegex.Do(func() { sqlite3WithRegex() })
+}
+
+func sqlite3WithRegex() {
 	sql.Register("sqlite3_with_regexp",
 		&sqlite3.SQLiteDriver{
 			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-				return conn.RegisterFunc("regexp", regexMem, true)
+				err := conn.RegisterFunc("regexp", regexMem, true)
+				if err != nil {
+					return err
+				}
+				return conn.RegisterFunc("seeded_random", seededRandom, true)
 			},
 		})
 }
 
-func openDB(dbPath string, createIfNotExists bool, pragmas ...string) error {
+func openDB(dbPath string, createIfNotExists bool, pragmas ...string) (*DB, error) {
 	Sqlite3WithRegex()
 
 	if !createIfNotExists {
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-			return fmt.Errorf("file doesn't exist: '%s'", dbPath)
+			return nil, fmt.Errorf("file doesn't exist: '%s'", dbPath)
 		}
 	}
 
 	db0, err := sql.Open("sqlite3_with_regexp", dbPath)
 
 	if err != nil {
-		return fmt.Errorf("failed to open db file '%s' : %v", dbPath, err)
+		return nil, fmt.Errorf("failed to open db file '%s' : %v", dbPath, err)
 	}
 
 	_, err = db0.Exec("PRAGMA foreign_keys = ON;")
 	if err != nil {
-		return fmt.Errorf("failed to run PRAGMA foreign_keys = ON : %v", err)
+		db0.Close()
+		return nil, fmt.Errorf("failed to run PRAGMA foreign_keys = ON : %v", err)
 	}
 
 	for _, p := range pragmas {
 		_, err = db0.Exec(p + ";")
 		if err != nil {
-			return fmt.Errorf("failed to run '%s' : %v", p, err)
+			db0.Close()
+			return nil, fmt.Errorf("failed to run '%s' : %v", p, err)
 		}
 	}
 
-	db = db0
-	return nil
+	db := &DB{conn: db0, chunkFeatCache: map[string]map[string]int64{}}
+	err = db.checkFTS()
+	if err != nil {
+		db0.Close()
+		return nil, fmt.Errorf("cannot open '%s' : %v", dbPath, err)
+	}
+	return db, nil
+}
+
+//go:embed schema_sqlite.sql
+var schema string
+
+// CreateDB creates a new db file using the schema embedded from schema_sqlite.sql, and returns a handle to the new db.
+// The schema is recorded as LatestSchemaVersion. If the sqlite3 driver supports FTS5, the full-text index is created as well.
+func CreateDB(dbPath string) (*DB, error) {
+	db, err := createDB(dbPath, schema)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.conn.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`, LatestSchemaVersion(), "schema_sqlite.sql")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to insert schema version : %v", err)
+	}
+	err = db.createFTSIndex()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func CreateDB(dbPath string, schemaFile string) error {
-	err := openDB(dbPath, true)
+func createDB(dbPath string, schema string) (*DB, error) {
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("db file already exists: '%s'", dbPath)
+	}
+	db, err := openDB(dbPath, true)
 	if err != nil {
-		return fmt.Errorf("failed to open db : %v", err)
+		return nil, fmt.Errorf("failed to open db : %v", err)
 	}
-	bts, err := ioutil.ReadFile(schemaFile)
+
+	err = db.ExecSchema(schema)
 	if err != nil {
-		log.Fatalf("failed to read %s : %v", schemaFile, err)
+		db.Close()
+		return nil, fmt.Errorf("failed to exec schema : %v", err)
 	}
+	return db, nil
+}
 
-	err = ExecSchema(string(bts))
+// Open opens an existing db file, and returns a handle to the db.
+// Returns an error if the db schema version differs from LatestSchemaVersion.
+func Open(dbPath string, pragmas ...string) (*DB, error) {
+	db, err := openDB(dbPath, false, pragmas...)
 	if err != nil {
-		log.Fatalf("failed to exec schema : %v", err)
+		return nil, fmt.Errorf("failed to open db : %v", err)
 	}
-	return nil
+	err = db.checkSchemaVersion()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func Open(dbPath string, pragmas ...string) error {
-	err := openDB(dbPath, false, pragmas...)
+// OpenForMigration opens an existing db file without checking the schema version, so that it can be upgraded using Migrate
+func OpenForMigration(dbPath string, pragmas ...string) (*DB, error) {
+	db, err := openDB(dbPath, false, pragmas...)
 	if err != nil {
-		return fmt.Errorf("failed to open db : %v", err)
+		return nil, fmt.Errorf("failed to open db : %v", err)
 	}
-	return nil
+	return db, nil
 }
 
-func Close() error {
-	return db.Close()
+func (db *DB) Close() error {
+	return db.conn.Close()
 }
 
-func Begin() (*sql.Tx, error) {
-	return db.Begin()
+func (db *DB) Begin() (*sql.Tx, error) {
+	return db.conn.Begin()
 }
 
-func ForeignKeysOn() error {
-	_, err := db.Exec("PRAGMA foreign_keys = OFF")
+func (db *DB) ForeignKeysOn() error {
+	_, err := db.conn.Exec("PRAGMA foreign_keys = OFF")
 	if err != nil {
 		return fmt.Errorf("failed to turn on foreign_keys : %v", err)
 	}
@@ -130,8 +206,8 @@ func ForeignKeysOn() error {
 	return nil
 }
 
-func CacheSize(n int) error {
-	_, err := db.Exec(fmt.Sprintf("PRAGMA cache_size = %d", n))
+func (db *DB) CacheSize(n int) error {
+	_, err := db.conn.Exec(fmt.Sprintf("PRAGMA cache_size = %d", n))
 	if err != nil {
 		return fmt.Errorf("failed to turn on foreign_keys : %v", err)
 	}
@@ -139,16 +215,16 @@ func CacheSize(n int) error {
 	return nil
 }
 
-func ForeignKeysOff() error {
-	_, err := db.Exec("PRAGMA foreign_keys = OFF")
+func (db *DB) ForeignKeysOff() error {
+	_, err := db.conn.Exec("PRAGMA foreign_keys = OFF")
 	if err != nil {
 		return fmt.Errorf("failed to turn off foreign_keys : %v", err)
 	}
 
 	return nil
 }
-func JournalModeOff() error {
-	_, err := db.Exec("PRAGMA journal_mode = OFF")
+func (db *DB) JournalModeOff() error {
+	_, err := db.conn.Exec("PRAGMA journal_mode = OFF")
 	if err != nil {
 		return fmt.Errorf("failed to turn off journal_mode : %v", err)
 	}
@@ -156,8 +232,8 @@ func JournalModeOff() error {
 	return nil
 }
 
-func SynchronousOff() error {
-	_, err := db.Exec("PRAGMA synchronous = OFF")
+func (db *DB) SynchronousOff() error {
+	_, err := db.conn.Exec("PRAGMA synchronous = OFF")
 	if err != nil {
 		return fmt.Errorf("failed to turn off synchronous : %v", err)
 	}
@@ -165,8 +241,8 @@ func SynchronousOff() error {
 	return nil
 }
 
-func SynchronousOn() error {
-	_, err := db.Exec("PRAGMA synchronous = ON")
+func (db *DB) SynchronousOn() error {
+	_, err := db.conn.Exec("PRAGMA synchronous = ON")
 	if err != nil {
 		return fmt.Errorf("failed to turn on synchronous : %v", err)
 	}
@@ -174,8 +250,8 @@ func SynchronousOn() error {
 	return nil
 }
 
-func JournalModeMemory() error {
-	_, err := db.Exec("PRAGMA journal_mode = MEMORY")
+func (db *DB) JournalModeMemory() error {
+	_, err := db.conn.Exec("PRAGMA journal_mode = MEMORY")
 	if err != nil {
 		return fmt.Errorf("failed to turn on journal_mode=MEMORY : %v", err)
 	}
@@ -183,13 +259,13 @@ func JournalModeMemory() error {
 	return nil
 }
 
-func MaxRowID(tableName string) (int64, error) {
+func (db *DB) MaxRowID(tableName string) (int64, error) {
 	var res sql.NullInt64
 
 	// TODO Why doesn't it work with '?' placeholder syntax
-	// db.QueryRow(`SELECT MAX(_ROWID_) FROM ? LIMIT 1`, tableName) ???
+	// db.conn.QueryRow(`SELECT MAX(_ROWID_) FROM ? LIMIT 1`, tableName) ???
 
-	err := db.QueryRow(`SELECT MAX(_ROWID_) FROM ` + tableName + ` LIMIT 1`).Scan(&res)
+	err := db.conn.QueryRow(`SELECT MAX(_ROWID_) FROM ` + tableName + ` LIMIT 1`).Scan(&res)
 	if err != nil {
 		return res.Int64, fmt.Errorf("failed to get MAX _ROWID_ for '%s' : %v", tableName, err)
 	}
@@ -197,131 +273,30 @@ func MaxRowID(tableName string) (int64, error) {
 	return res.Int64, nil
 }
 
-type Stats struct {
-	DBName      string         `json:"db_name,omitempty"`
-	Chunks      int64          `json:"chunks"`
-	Sources     int64          `json:"sources"`
-	ChunkFeats  int64          `json:"chunk_feats"`
-	WordForms   int64          `json:"word_forms"`
-	MaxWordFreq int64          `json:"max_wordfreq"`
-	Batches     map[string]int `json:"batches"`
-	Scripts     map[string]int `json:"scripts"`
-}
-
-func GetStats() (Stats, error) {
-	res := Stats{}
-
-	// TODO: MaxRowID is not secure
-	chnks, err := MaxRowID("chunk")
-	if err != nil {
-		return res, fmt.Errorf("failed MaxRowID for chunk : %v", err)
-	}
-
-	res.Chunks = chnks
-
-	srcs, err := MaxRowID("source")
-	if err != nil {
-		return res, fmt.Errorf("failed MaxRowID for source : %v", err)
-	}
-
-	res.Sources = srcs
-
-	cfeats, err := MaxRowID("chunkfeat")
-	if err != nil {
-		return res, fmt.Errorf("failed MaxRowID for chunkfeat : %v", err)
-	}
-
-	res.ChunkFeats = cfeats
-
-	var wds sql.NullInt64
-
-	err = db.QueryRow("SELECT COUNT(*) FROM chunkfeat WHERE chunkfeat.name = ?", text.FeatWord).Scan(&wds)
-	if err != nil {
-		return res, fmt.Errorf("failed count words from chunkfeat : %v", err)
-	}
-
-	res.WordForms = wds.Int64
-
-	var maxFreq sql.NullInt64
-	err = db.QueryRow("SELECT wordfreq.freq FROM wordfreq WHERE id = 1").Scan(&maxFreq)
-	if err != nil {
-		return res, fmt.Errorf("failed to max word freq : %v", err)
-	}
-
-	res.MaxWordFreq = maxFreq.Int64
-
-	rows, err := db.Query("SELECT name, count(name) FROM batch group by name")
-	if err != nil {
-		return res, fmt.Errorf("failed to read batches : %v", err)
-	}
-	batches := make(map[string]int)
-	for rows.Next() {
-		var b string
-		var c int
-		rows.Scan(&b, &c)
-		batches[b] = c
-	}
-	res.Batches = batches
-
-	rows, err = db.Query("SELECT name, count(name) FROM script group by name")
-	if err != nil {
-		return res, fmt.Errorf("failed to read scripts : %v", err)
-	}
-	scripts := make(map[string]int)
-	for rows.Next() {
-		var s string
-		var c int
-		rows.Scan(&s, &c)
-		scripts[s] = c
-	}
-	res.Scripts = scripts
-
-	return res, nil
-}
-
-func ExecSchema(schema string) error {
-	_, err := db.Exec(schema)
+func (db *DB) ExecSchema(schema string) error {
+	_, err := db.conn.Exec(schema)
 	if err != nil {
 		return fmt.Errorf("failed to exec schema : %v", err)
 	}
 	return nil
 }
 
-func ExecQuery(query string, args []interface{}) (*sql.Rows, error) {
-	rows, err := db.Query(query, args...)
+func (db *DB) ExecQuery(query string, args []interface{}) (*sql.Rows, error) {
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return rows, fmt.Errorf("failed to exec schema : %v", err)
 	}
 	return rows, nil
 }
 
-func BlockSentIDs(ids ...int64) error {
-	tx, err := Begin()
-	if err != nil {
-		log.Fatalf("BlockSentIDs failed to begin db transaction : %v", err)
-	}
-	qs := []string{}
-	args := []interface{}{text.BlockBatch}
-	for _, sent := range ids {
-		qs = append(qs, "?")
-		args = append(args, sent)
-	}
-	query := fmt.Sprintf("INSERT INTO batch (chunk_id, name) SELECT chunk.id, ? FROM chunk WHERE chunk.id IN (%s)", strings.Join(qs, ","))
-
-	_, err = tx.Exec(query, args...)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("BlockSentIDs failed to insert : %v", err)
-	}
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("couldn't commit transaction : %v", err)
-	}
-	return nil
+// BlockSentIDs blocks the sentences with the given ids, without block info (see BlockSentIDsWithInfo)
+func (db *DB) BlockSentIDs(ids ...int64) error {
+	_, err := db.BlockSentIDsWithInfo(BlockInfo{}, ids...)
+	return err
 }
 
-func ListBlockedSents() ([]text.Sentence, error) {
-	tx, err := Begin()
+func (db *DB) ListBlockedSents() ([]text.Sentence, error) {
+	tx, err := db.Begin()
 	if err != nil {
 		log.Fatalf("ListBlockedSents failed to begin db transaction : %v", err)
 	}
@@ -338,7 +313,7 @@ func ListBlockedSents() ([]text.Sentence, error) {
 		rows.Scan(&id)
 		ids = append(ids, id)
 	}
-	sents, err := GetSents(ids...)
+	sents, err := db.GetSents(ids...)
 	if err != nil {
 		tx.Rollback()
 		return []text.Sentence{}, fmt.Errorf("ListBlockedSents failed to get sents from ids : %v", err)
@@ -355,42 +330,23 @@ func ListBlockedSents() ([]text.Sentence, error) {
 	return sents, nil
 }
 
-func BlockSents(sents ...string) error {
-	tx, err := Begin()
-	if err != nil {
-		log.Fatalf("BlockSents failed to begin db transaction : %v", err)
-	}
-	qs := []string{}
-	args := []interface{}{text.BlockBatch}
-	for _, sent := range sents {
-		qs = append(qs, "?")
-		args = append(args, sent)
-	}
-	query := fmt.Sprintf("INSERT INTO batch (chunk_id, name) SELECT chunk.id, ? FROM chunk WHERE chunk.text IN (%s)", strings.Join(qs, ","))
-
-	_, err = tx.Exec(query, args...)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("BlockSents failed to insert : %v", err)
-	}
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("couldn't commit transaction : %v", err)
-	}
-	return nil
+// BlockSents blocks the sentences with the given texts, without block info (see BlockSentsWithInfo)
+func (db *DB) BlockSents(sents ...string) error {
+	_, err := db.BlockSentsWithInfo(BlockInfo{}, sents...)
+	return err
 }
 
 // Add an article, return article id, inserted sents (with ids), and error if any
-func Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error) {
+func (db *DB) Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error) {
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		log.Fatalf("dbapi.Add failed to begin db transaction : %v", err)
 	}
 
 	sents := []text.Sentence{}
 
-	sID, err := InsertSourceTx(tx, a.URL)
+	sID, err := db.InsertSourceTx(tx, a.URL)
 	if err != nil {
 		return sID, sents, fmt.Errorf("dbapi.Add failed InsertSourceTx: %v", err)
 	}
@@ -398,7 +354,7 @@ func Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error)
 	s := SourceFeaturesExtractor{}
 	feats := s.Extract(a)
 
-	err = InsertSourceFeatsTx(tx, sID, feats)
+	err = db.InsertSourceFeatsTx(tx, sID, feats)
 	if err != nil {
 		return sID, sents, fmt.Errorf("dbapi.Add failed InsertSourceFeatsTx: %v", err)
 	}
@@ -406,7 +362,7 @@ func Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error)
 	source := a.URL
 	for _, p := range a.Paragraphs {
 		for _, s := range p.Sentences {
-			_, cID, newChunk, err := InsertChunkTx(tx, source, s.Text)
+			_, cID, newChunk, err := db.InsertChunkTx(tx, source, s.Text)
 			if err != nil {
 				tx.Rollback()
 				return sID, sents, fmt.Errorf("dbapi.Add failed to insert chunk into DB : %v", err)
@@ -415,17 +371,33 @@ func Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error)
 			s.ID = cID
 			if newChunk {
 				sents = append(sents, s)
+				err = insertChunkCountTx(tx, cID, ComputeChunkCount(s))
+				if err != nil {
+					tx.Rollback()
+					return sID, sents, fmt.Errorf("dbapi.Add failed : %v", err)
+				}
 			}
 			if insertChunkFeats && newChunk {
-				err = InsertChunkFeatsTx(tx, cID, s.Feats)
+				err = db.InsertChunkFeatsTx(tx, cID, s.Feats)
 				if err != nil {
 					tx.Rollback()
 					return sID, sents, fmt.Errorf("dbapi.Add failed to insert chunkfeats into DB : %v", err)
 				}
+				err = insertFeatBlobTx(tx, cID, s.Feats)
+				if err != nil {
+					tx.Rollback()
+					return sID, sents, fmt.Errorf("dbapi.Add failed : %v", err)
+				}
 			}
 		}
 	}
 
+	err = clearStatsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return sID, sents, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
@@ -436,7 +408,7 @@ func Add(a text.Article, insertChunkFeats bool) (int64, []text.Sentence, error)
 }
 
 // PopulateWordFreqTable() adds word frequencies (number of chunks a word occurs in) and should be run _after_ the initail corpus data have been added to the db
-func PopulateWordFreqTable() error {
+func (db *DB) PopulateWordFreqTable() error {
 
 	//log.Println("Started generating word frequency table")
 
@@ -457,6 +429,12 @@ func PopulateWordFreqTable() error {
 		return fmt.Errorf("PopulateWordFreqTable failed to generate wordfreq table : %v", err)
 	}
 
+	err = clearStatsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
@@ -468,7 +446,7 @@ func PopulateWordFreqTable() error {
 
 // InsertLeastWordFreqForChunk adds the frequency of the least frequent word of a chunk into the chunk_chunkfeat table, by the relation chunkfeat.name = 'count' and chunfeat.value = 'lowest_word_freq'.
 // MUST be called *after* PopulateWordFreqTable()
-func InsertLowestWordFreqForChunk() error {
+func (db *DB) InsertLowestWordFreqForChunk() error {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("InsertLowestWordFreqForChunk failed to start db transaction : %v", err)
@@ -517,6 +495,12 @@ func InsertLowestWordFreqForChunk() error {
 		return fmt.Errorf("failed to execute insert statement for lowest word freq calculation : %v", err)
 	}
 
+	_, err = tx.Exec(`UPDATE chunk_count SET lowest_word_freq = COALESCE((SELECT chunk_chunkfeat.freq FROM chunk_chunkfeat WHERE chunk_chunkfeat.chunk_id = chunk_count.chunk_id AND chunk_chunkfeat.chunkfeat_id = ?), 0)`, featID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to update lowest word freq in chunk_count : %v", err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
@@ -528,7 +512,7 @@ func InsertLowestWordFreqForChunk() error {
 // TODO make batch versions of insert funcs --- better performance if more stuff is added in single transaction?
 
 // InsertSource adds a new source string s to the db and returns its db id. If s already exists, returns its existing id.
-func InsertSource(s string) (int64, error) {
+func (db *DB) InsertSource(s string) (int64, error) {
 	var res int64
 
 	s = strings.TrimSpace(s)
@@ -571,7 +555,7 @@ func InsertSource(s string) (int64, error) {
 
 }
 
-func InsertSourceTx(tx *sql.Tx, s string) (int64, error) {
+func (db *DB) InsertSourceTx(tx *sql.Tx, s string) (int64, error) {
 	var res int64
 
 	s = strings.TrimSpace(s)
@@ -611,7 +595,7 @@ func InsertSourceTx(tx *sql.Tx, s string) (int64, error) {
 
 }
 
-func InsertSourceFeatsTx(tx *sql.Tx, sourceID int64, feats []Feat) error {
+func (db *DB) InsertSourceFeatsTx(tx *sql.Tx, sourceID int64, feats []Feat) error {
 
 	var err error
 
@@ -659,10 +643,10 @@ func InsertSourceFeatsTx(tx *sql.Tx, sourceID int64, feats []Feat) error {
 	return nil
 }
 
-func InsertChunk(source string, chunk string) (int64, int64, error) {
+func (db *DB) InsertChunk(source string, chunk string) (int64, int64, error) {
 	var res int64
 
-	sourceID, err := InsertSource(source)
+	sourceID, err := db.InsertSource(source)
 	if err != nil {
 		return sourceID, res, fmt.Errorf("failed InsertSource : %v", err)
 	}
@@ -720,12 +704,12 @@ func InsertChunk(source string, chunk string) (int64, int64, error) {
 }
 
 // InsertChunkTx returns sourceID, chunkID, newChunk (bool), error
-func InsertChunkTx(tx *sql.Tx, source string, chunk string) (int64, int64, bool, error) {
+func (db *DB) InsertChunkTx(tx *sql.Tx, source string, chunk string) (int64, int64, bool, error) {
 	var res int64
 	var res0 sql.NullInt64
 	var newChunk = false
 
-	sourceID, err := InsertSourceTx(tx, source)
+	sourceID, err := db.InsertSourceTx(tx, source)
 	if err != nil {
 		return sourceID, res, newChunk, fmt.Errorf("failed InsertSource : %v", err)
 	}
@@ -763,6 +747,13 @@ func InsertChunkTx(tx *sql.Tx, source string, chunk string) (int64, int64, bool,
 			//tx.Rollback()
 			return sourceID, res, newChunk, fmt.Errorf("failed to insert source-chunk relation : %v", err)
 		}
+		// chunk_count.source_freq is counted on insert for new chunks, see insertChunkCountTx
+		if !newChunk {
+			_, err = tx.Exec("UPDATE chunk_count SET source_freq = source_freq + 1 WHERE chunk_id = ?", res)
+			if err != nil {
+				return sourceID, res, newChunk, fmt.Errorf("failed to update chunk source frequency : %v", err)
+			}
+		}
 	} else if relationRow != nil {
 		//tx.Rollback()
 		return sourceID, res, newChunk, fmt.Errorf("QueryRow error : %v", err)
@@ -784,11 +775,11 @@ type Feat struct {
 	Freq  int
 }
 
-func MostFrequentWords(limit int) ([]string, error) {
+func (db *DB) MostFrequentWords(limit int) ([]string, error) {
 
 	var res []string
 
-	rows, err := db.Query(`SELECT chunkfeat.value FROM wordfreq, chunkfeat WHERE wordfreq.chunkfeat_id = chunkfeat.id AND chunkfeat.name = ? ORDER BY wordfreq.freq DESC LIMIT ?`, text.FeatWord, limit)
+	rows, err := db.conn.Query(`SELECT chunkfeat.value FROM wordfreq, chunkfeat WHERE wordfreq.chunkfeat_id = chunkfeat.id AND chunkfeat.name = ? ORDER BY wordfreq.freq DESC LIMIT ?`, text.FeatWord, limit)
 	if err != nil {
 		return res, fmt.Errorf("failed to query db : %v", err)
 	}
@@ -806,7 +797,7 @@ func MostFrequentWords(limit int) ([]string, error) {
 	return res, nil
 }
 
-func ListChunkfeatCats() ([]string, error) {
+func (db *DB) ListChunkfeatCats() ([]string, error) {
 	var res = []string{}
 
 	tx, err := db.Begin()
@@ -815,7 +806,8 @@ func ListChunkfeatCats() ([]string, error) {
 		return res, fmt.Errorf("failed to begin transaction : %v", err)
 	}
 
-	rows, err := tx.Query(`SELECT DISTINCT name FROM chunkfeatcat`)
+	// parent categories are listed as well, since they can be used wherever a category is expected
+	rows, err := tx.Query(`SELECT DISTINCT name FROM chunkfeatcat UNION SELECT parent FROM chunkfeatcat_parent`)
 	if err != nil {
 		tx.Rollback()
 		return res, fmt.Errorf("failed to query db : %v", err)
@@ -835,7 +827,7 @@ func ListChunkfeatCats() ([]string, error) {
 	return res, nil
 }
 
-func ListBatches() ([]protocol.BatchMetadata, error) {
+func (db *DB) ListBatches() ([]protocol.BatchMetadata, error) {
 	var res []protocol.BatchMetadata
 
 	tx, err := db.Begin()
@@ -853,7 +845,7 @@ func ListBatches() ([]protocol.BatchMetadata, error) {
 	for rows.Next() {
 		var name string
 		rows.Scan(&name)
-		props, err := GetBatchPropertiesTx(tx, name)
+		props, err := db.GetBatchPropertiesTx(tx, name)
 		if err != nil {
 			tx.Rollback()
 			return res, err
@@ -869,7 +861,7 @@ func ListBatches() ([]protocol.BatchMetadata, error) {
 	return res, nil
 }
 
-func ListBatchNames() ([]string, error) {
+func (db *DB) ListBatchNames() ([]string, error) {
 	var res []string
 
 	tx, err := db.Begin()
@@ -898,7 +890,7 @@ func ListBatchNames() ([]string, error) {
 	return res, nil
 }
 
-func ListScripts() ([]protocol.ScriptMetadata, error) {
+func (db *DB) ListScripts() ([]protocol.ScriptMetadata, error) {
 	var res []protocol.ScriptMetadata
 
 	tx, err := db.Begin()
@@ -916,7 +908,7 @@ func ListScripts() ([]protocol.ScriptMetadata, error) {
 	for rows.Next() {
 		var name string
 		rows.Scan(&name)
-		props, err := GetScriptPropertiesTx(tx, name)
+		props, err := db.GetScriptPropertiesTx(tx, name)
 		if err != nil {
 			tx.Rollback()
 			return res, err
@@ -932,7 +924,7 @@ func ListScripts() ([]protocol.ScriptMetadata, error) {
 	return res, nil
 }
 
-func ListScriptNames() ([]string, error) {
+func (db *DB) ListScriptNames() ([]string, error) {
 	var res []string
 
 	tx, err := db.Begin()
@@ -961,52 +953,110 @@ func ListScriptNames() ([]string, error) {
 	return res, nil
 }
 
-func DeleteBatches(batches ...interface{}) error {
+func (db *DB) DeleteBatches(batches ...interface{}) error {
+	return db.deleteBatches(nil, batches)
+}
+
+// DeleteBatchesWithConfig deletes batches like DeleteBatches, saving config in the oplog (e.g. the config of the scriptgen run that cleared them)
+func (db *DB) DeleteBatchesWithConfig(config interface{}, batches ...interface{}) error {
+	return db.deleteBatches(config, batches)
+}
+
+func (db *DB) deleteBatches(config interface{}, batches []interface{}) error {
 	var qs []string
 	for i := 0; i < len(batches); i++ {
 		qs = append(qs, "?")
 	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin db transaction : %v", err)
+	}
 	query := fmt.Sprintf("DELETE FROM batch WHERE name IN ( %s )", strings.Join(qs, ", "))
-	_, err := db.Exec(query, batches...)
+	res, err := tx.Exec(query, batches...)
 	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to delete batches '%v' : %v", batches, err)
 	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
 	query = fmt.Sprintf("DELETE FROM batch_properties WHERE name IN (%s)", strings.Join(qs, ", "))
-	_, err = db.Exec(query, batches...)
+	_, err = tx.Exec(query, batches...)
 	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to delete batch_properties '%v' : %v", batches, err)
 	}
+	err = db.LogOpTx(tx, OpDeleteBatches, interfaces2strings(batches), n, config)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("couldn't commit transaction : %v", err)
+	}
 
 	return nil
 }
 
-func DeleteScripts(scripts ...interface{}) error {
+func (db *DB) DeleteScripts(scripts ...interface{}) error {
+	return db.deleteScripts(nil, scripts)
+}
+
+// DeleteScriptsWithConfig deletes scripts like DeleteScripts, saving config in the oplog (e.g. the config of the scriptgen run that cleared them)
+func (db *DB) DeleteScriptsWithConfig(config interface{}, scripts ...interface{}) error {
+	return db.deleteScripts(config, scripts)
+}
+
+func (db *DB) deleteScripts(config interface{}, scripts []interface{}) error {
 	var qs []string
 	for i := 0; i < len(scripts); i++ {
 		qs = append(qs, "?")
 	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin db transaction : %v", err)
+	}
 	query := fmt.Sprintf("DELETE FROM script WHERE name IN (%s)", strings.Join(qs, ", "))
-	_, err := db.Exec(query, scripts...)
+	res, err := tx.Exec(query, scripts...)
 	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to delete scripts '%v' : %v", scripts, err)
 	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
 
 	query = fmt.Sprintf("DELETE FROM script_properties WHERE name IN (%s)", strings.Join(qs, ", "))
-	_, err = db.Exec(query, scripts...)
+	_, err = tx.Exec(query, scripts...)
 	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("failed to delete script_properties '%v' : %v", scripts, err)
 	}
+	err = db.LogOpTx(tx, OpDeleteScripts, interfaces2strings(scripts), n, config)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("couldn't commit transaction : %v", err)
+	}
 
 	return nil
 }
 
-func BatchSize(batches ...interface{}) (int, error) {
+func (db *DB) BatchSize(batches ...interface{}) (int, error) {
 	var qs []string
 	for i := 0; i < len(batches); i++ {
 		qs = append(qs, "?")
 	}
 	query := fmt.Sprintf("SELECT COUNT(*) FROM batch WHERE name IN ( %s )", strings.Join(qs, ", "))
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("couldn't create db connection : %v", err)
 	}
@@ -1026,14 +1076,14 @@ func BatchSize(batches ...interface{}) (int, error) {
 	return 0, fmt.Errorf("failed to compute batch size '%v'", batches)
 }
 
-func GetSentsInBatches(batchSize int, ids ...int64) ([]text.Sentence, error) {
+func (db *DB) GetSentsInBatches(batchSize int, ids ...int64) ([]text.Sentence, error) {
 	var res []text.Sentence
 
 	var batch []int64
 	for _, id := range ids {
 		batch = append(batch, id)
 		if len(batch) >= batchSize {
-			snts, err := GetSents(batch...)
+			snts, err := db.GetSents(batch...)
 			if err != nil {
 				return res, err
 			}
@@ -1044,7 +1094,7 @@ func GetSentsInBatches(batchSize int, ids ...int64) ([]text.Sentence, error) {
 	}
 
 	if len(batch) > 0 {
-		snts, err := GetSents(batch...)
+		snts, err := db.GetSents(batch...)
 		if err != nil {
 			return res, err
 		}
@@ -1054,16 +1104,16 @@ func GetSentsInBatches(batchSize int, ids ...int64) ([]text.Sentence, error) {
 	return res, nil
 }
 
-func GetSents(ids ...int64) ([]text.Sentence, error) {
+func (db *DB) GetSents(ids ...int64) ([]text.Sentence, error) {
 	//fmt.Fprintf(os.Stderr, "GetSents called with %d ids\n", len(ids))
 	var res []text.Sentence
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	res, err = GetSentsTx(tx, ids...)
+	res, err = db.GetSentsTx(tx, ids...)
 	if err != nil {
 		return res, fmt.Errorf("failed GetSentsTx: %v", err)
 	}
@@ -1075,7 +1125,13 @@ func GetSents(ids ...int64) ([]text.Sentence, error) {
 	return res, nil
 }
 
-func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
+// GetSentsTx returns the sentences with the given ids, in the same order. Feats are read from the feat blobs where available, otherwise from the chunkfeat tables.
+func (db *DB) GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
+	return db.getSentsTx(tx, true, true, ids...)
+}
+
+// getSentsTx reads sentences using feat blobs if useBlobs is true. If withCats is false, chunkfeat categories are not added to the feats (only used for the chunkfeat tables).
+func (db *DB) getSentsTx(tx *sql.Tx, useBlobs bool, withCats bool, ids ...int64) ([]text.Sentence, error) {
 	var res []text.Sentence
 	var err error
 
@@ -1102,8 +1158,36 @@ func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
 	}
 	//fmt.Fprintf(os.Stderr, "dbapi debug Inserted %v ids into %s\n", len(ids), tmpTableName)
 
-	// select all chunks from tmp and turn into text.Sentence
-	q := "SELECT chunk.id, chunk.text, chunkfeat.name, chunkfeat.value, chunk_chunkfeat.freq, chunkfeatcat.name, source.name FROM chunk, chunk_chunkfeat, chunkfeat, source, source_chunk LEFT JOIN chunkfeatcat ON chunkfeatcat.chunkfeat_id = chunkfeat.id WHERE chunk.id = chunk_chunkfeat.chunk_id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND source_chunk.chunk_id = chunk.id AND source_chunk.source_id = source.id AND chunk.id IN (SELECT id FROM " + tmpTableName + ")"
+	ancestors, err := chunkFeatCatAncestorsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to read chunkfeat cat parents : %v", err)
+	}
+
+	tmpRes := make(map[int64]text.Sentence)
+
+	// fast path: chunks with a feat blob
+	if useBlobs {
+		tmpRes, err = getSentsFromBlobsTx(tx, tmpTableName, ancestors)
+		if err != nil {
+			tx.Rollback()
+			return res, err
+		}
+		if len(tmpRes) > 0 {
+			_, err = tx.Exec("DELETE FROM " + tmpTableName + " WHERE id IN (SELECT chunk_id FROM chunk_feat_blob)")
+			if err != nil {
+				tx.Rollback()
+				return res, fmt.Errorf("failed to delete from tmp table '%s': %v", tmpTableName, err)
+			}
+		}
+	}
+
+	// select all remaining chunks from tmp and turn into text.Sentence
+	catJoin := "LEFT JOIN chunkfeatcat ON chunkfeatcat.chunkfeat_id = chunkfeat.id"
+	if !withCats {
+		catJoin = "LEFT JOIN chunkfeatcat ON 0"
+	}
+	q := "SELECT chunk.id, chunk.text, chunkfeat.name, chunkfeat.value, chunk_chunkfeat.freq, chunkfeatcat.name, source.name FROM chunk, chunk_chunkfeat, chunkfeat, source, source_chunk " + catJoin + " WHERE chunk.id = chunk_chunkfeat.chunk_id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND source_chunk.chunk_id = chunk.id AND source_chunk.source_id = source.id AND chunk.id IN (SELECT id FROM " + tmpTableName + ")"
 	rows, err := tx.Query(q)
 	if err != nil {
 		tx.Rollback()
@@ -1112,8 +1196,6 @@ func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
 
 	//fmt.Fprintf(os.Stderr, "dbapi debug Fetched lines from db\n")
 
-	tmpRes := make(map[int64]text.Sentence)
-
 	var currSent text.Sentence
 	i := 0
 	for rows.Next() {
@@ -1145,10 +1227,14 @@ func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
 		currSent.AddFeatWithFreq(fName, fVal, int(freq))
 		if fCat.Valid {
 			currSent.AddFeatWithFreq(fCat.String, fVal, int(freq))
+			for _, a := range ancestors[fCat.String] {
+				currSent.AddFeatWithFreq(a, fVal, int(freq))
+			}
 		}
 	}
 
 	if err = rows.Err(); err != nil {
+		tx.Rollback()
 		return res, fmt.Errorf("error when reading result row : %v", err)
 	}
 
@@ -1162,6 +1248,7 @@ func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
 	for _, id := range ids {
 		s, ok := tmpRes[id]
 		if !ok {
+			tx.Rollback()
 			return res, fmt.Errorf("failed to find chunk id '%d' in query resul", id)
 		}
 		res = append(res, s)
@@ -1169,16 +1256,17 @@ func GetSentsTx(tx *sql.Tx, ids ...int64) ([]text.Sentence, error) {
 
 	err = rows.Close()
 	if err != nil {
+		tx.Rollback()
 		return res, fmt.Errorf("couldn't close rows : %v", err)
 	}
 	return res, nil
 }
 
-func GetScriptPropertiesTx(tx *sql.Tx, scriptName string) (protocol.ScriptMetadata, error) {
+func (db *DB) GetScriptPropertiesTx(tx *sql.Tx, scriptName string) (protocol.ScriptMetadata, error) {
 	var res protocol.ScriptMetadata
 
 	var bytes []byte
-	err := db.QueryRow(`SELECT properties FROM script_properties WHERE name = ?`, scriptName).Scan(&bytes)
+	err := db.conn.QueryRow(`SELECT properties FROM script_properties WHERE name = ?`, scriptName).Scan(&bytes)
 	if err != nil {
 		return res, fmt.Errorf("failed to exec query : %v", err)
 	}
@@ -1190,15 +1278,15 @@ func GetScriptPropertiesTx(tx *sql.Tx, scriptName string) (protocol.ScriptMetada
 	return res, nil
 }
 
-func GetScriptProperties(scriptName string) (protocol.ScriptMetadata, error) {
+func (db *DB) GetScriptProperties(scriptName string) (protocol.ScriptMetadata, error) {
 	var res protocol.ScriptMetadata
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	res, err = GetScriptPropertiesTx(tx, scriptName)
+	res, err = db.GetScriptPropertiesTx(tx, scriptName)
 	if err != nil {
 		tx.Rollback()
 		return res, fmt.Errorf("no script properties for %s: %v", scriptName, err)
@@ -1212,7 +1300,7 @@ func GetScriptProperties(scriptName string) (protocol.ScriptMetadata, error) {
 	return res, nil
 }
 
-func SetScriptPropertiesTx(tx *sql.Tx, scriptName string, properties []byte) error {
+func (db *DB) SetScriptPropertiesTx(tx *sql.Tx, scriptName string, properties []byte) error {
 	_, err := tx.Exec("INSERT INTO script_properties (name, properties) VALUES (?, ?)", scriptName, properties)
 	if err != nil {
 		return fmt.Errorf("failed to exec query : %v", err)
@@ -1220,13 +1308,13 @@ func SetScriptPropertiesTx(tx *sql.Tx, scriptName string, properties []byte) err
 	return nil
 }
 
-func SetScriptProperties(scriptName string, properties []byte) error {
-	tx, err := Begin()
+func (db *DB) SetScriptProperties(scriptName string, properties []byte) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	err = SetScriptPropertiesTx(tx, scriptName, properties)
+	err = db.SetScriptPropertiesTx(tx, scriptName, properties)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("couldn't set script properties: %v", err)
@@ -1240,11 +1328,11 @@ func SetScriptProperties(scriptName string, properties []byte) error {
 	return nil
 }
 
-func GetBatchPropertiesTx(tx *sql.Tx, batchName string) (protocol.BatchMetadata, error) {
+func (db *DB) GetBatchPropertiesTx(tx *sql.Tx, batchName string) (protocol.BatchMetadata, error) {
 	var res protocol.BatchMetadata
 
 	var bytes []byte
-	err := db.QueryRow(`SELECT properties FROM batch_properties WHERE name = ?`, batchName).Scan(&bytes)
+	err := db.conn.QueryRow(`SELECT properties FROM batch_properties WHERE name = ?`, batchName).Scan(&bytes)
 	if err != nil {
 		return res, fmt.Errorf("failed to exec query : %v", err)
 	}
@@ -1256,15 +1344,15 @@ func GetBatchPropertiesTx(tx *sql.Tx, batchName string) (protocol.BatchMetadata,
 	return res, nil
 }
 
-func GetBatchProperties(batchName string) (protocol.BatchMetadata, error) {
+func (db *DB) GetBatchProperties(batchName string) (protocol.BatchMetadata, error) {
 	var res protocol.BatchMetadata
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	res, err = GetBatchPropertiesTx(tx, batchName)
+	res, err = db.GetBatchPropertiesTx(tx, batchName)
 	if err != nil {
 		tx.Rollback()
 		return res, fmt.Errorf("no batch properties for %s: %v", batchName, err)
@@ -1278,7 +1366,7 @@ func GetBatchProperties(batchName string) (protocol.BatchMetadata, error) {
 	return res, nil
 }
 
-func SetBatchPropertiesTx(tx *sql.Tx, batchName string, properties []byte) error {
+func (db *DB) SetBatchPropertiesTx(tx *sql.Tx, batchName string, properties []byte) error {
 	_, err := tx.Exec("INSERT INTO batch_properties (name, properties) VALUES (?, ?)", batchName, properties)
 	if err != nil {
 		return fmt.Errorf("failed to exec query : %v", err)
@@ -1286,13 +1374,13 @@ func SetBatchPropertiesTx(tx *sql.Tx, batchName string, properties []byte) error
 	return nil
 }
 
-func SetBatchProperties(batchName string, properties []byte) error {
-	tx, err := Begin()
+func (db *DB) SetBatchProperties(batchName string, properties []byte) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	err = SetBatchPropertiesTx(tx, batchName, properties)
+	err = db.SetBatchPropertiesTx(tx, batchName, properties)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("couldn't set batch properties: %v", err)
@@ -1323,23 +1411,26 @@ func PopulateQueryString(query string, args []interface{}) string {
 	return pop
 }
 
-// GetScriptTx retrieves all sentences in the specified script, using pageNumber and pageSize if provided.
+// scriptOrder orders script sentences in selection order. Scripts saved before positions were introduced keep the db order.
+const scriptOrder = "ORDER BY script.position, script.rowid"
+
+// GetScriptTx retrieves all sentences in the specified script in selection order, using pageNumber and pageSize if provided.
 // If pageNumber is zero and pageSize is zero, no limit settings are used.
 // If pageNumber is set to zero, and pageSize is non-zero, the pageSize will be used as LIMIT in the query.
-func GetScriptTx(tx *sql.Tx, scriptName string, pageNumber, pageSize int) ([]text.Sentence, error) {
+func (db *DB) GetScriptTx(tx *sql.Tx, scriptName string, pageNumber, pageSize int) ([]text.Sentence, error) {
 	var res []text.Sentence
 	var rows *sql.Rows
 	var err error
 
 	if pageNumber == 0 {
 		if pageSize == 0 {
-			rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ?", scriptName)
+			rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ? "+scriptOrder, scriptName)
 		} else {
-			rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ? LIMIT ?", scriptName, pageSize)
+			rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ? "+scriptOrder+" LIMIT ?", scriptName, pageSize)
 		}
 	} else {
 		offset := (pageNumber - 1) * pageSize
-		rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ? LIMIT ? OFFSET ?", scriptName, pageSize, offset)
+		rows, err = tx.Query("SELECT chunk_id FROM script WHERE script.name = ? "+scriptOrder+" LIMIT ? OFFSET ?", scriptName, pageSize, offset)
 	}
 
 	if err != nil {
@@ -1351,24 +1442,24 @@ func GetScriptTx(tx *sql.Tx, scriptName string, pageNumber, pageSize int) ([]tex
 		rows.Scan(&id)
 		ids = append(ids, id)
 	}
-	res, err = GetSentsTx(tx, ids...)
+	res, err = db.GetSentsTx(tx, ids...)
 	if err != nil {
 		return res, fmt.Errorf("failed to get sents from ids : %v", err)
 	}
 	return res, nil
 }
 
-// GetScript retrieves all sentences in the specified script, using pageNumber and pageSize if provided.
+// GetScript retrieves all sentences in the specified script in selection order, using pageNumber and pageSize if provided.
 // If pageNumber is zero and pageSize is zero, no limit settings are used.
 // If pageNumber is set to zero, and pageSize is non-zero, the pageSize will be used as LIMIT in the query.
-func GetScript(scriptName string, pageNo, pageSize int) ([]text.Sentence, error) {
+func (db *DB) GetScript(scriptName string, pageNo, pageSize int) ([]text.Sentence, error) {
 	var res []text.Sentence
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	res, err = GetScriptTx(tx, scriptName, pageNo, pageSize)
+	res, err = db.GetScriptTx(tx, scriptName, pageNo, pageSize)
 	if err != nil {
 		tx.Rollback()
 		return res, fmt.Errorf("couldn't get script: %v", err)
@@ -1385,7 +1476,7 @@ func GetScript(scriptName string, pageNo, pageSize int) ([]text.Sentence, error)
 // GetBatchTx retrieves all sentences in the specified batch, using pageNumber and pageSize if provided.
 // If pageNumber is zero and pageSize is zero, no limit settings are used.
 // If pageNumber is set to zero, and pageSize is non-zero, the pageSize will be used as LIMIT in the query.
-func GetBatchTx(tx *sql.Tx, batchName string, pageNumber, pageSize int) ([]text.Sentence, error) {
+func (db *DB) GetBatchTx(tx *sql.Tx, batchName string, pageNumber, pageSize int) ([]text.Sentence, error) {
 	var res []text.Sentence
 	var rows *sql.Rows
 	var err error
@@ -1410,7 +1501,7 @@ func GetBatchTx(tx *sql.Tx, batchName string, pageNumber, pageSize int) ([]text.
 		rows.Scan(&id)
 		ids = append(ids, id)
 	}
-	res, err = GetSentsTx(tx, ids...)
+	res, err = db.GetSentsTx(tx, ids...)
 	if err != nil {
 		return res, fmt.Errorf("failed to get sents from ids : %v", err)
 	}
@@ -1420,14 +1511,14 @@ func GetBatchTx(tx *sql.Tx, batchName string, pageNumber, pageSize int) ([]text.
 // GetBatch retrieves all sentences in the specified batch, using pageNumber and pageSize if provided.
 // If pageNumber is zero and pageSize is zero, no limit settings are used.
 // If pageNumber is set to zero, and pageSize is non-zero, the pageSize will be used as LIMIT in the query.
-func GetBatch(batchName string, pageNo, pageSize int) ([]text.Sentence, error) {
+func (db *DB) GetBatch(batchName string, pageNo, pageSize int) ([]text.Sentence, error) {
 	var res []text.Sentence
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to start transaction : %v", err)
 	}
 
-	res, err = GetBatchTx(tx, batchName, pageNo, pageSize)
+	res, err = db.GetBatchTx(tx, batchName, pageNo, pageSize)
 	if err != nil {
 		tx.Rollback()
 		return res, fmt.Errorf("couldn't get batch: %v", err)
@@ -1441,16 +1532,35 @@ func GetBatch(batchName string, pageNo, pageSize int) ([]text.Sentence, error) {
 	return res, nil
 }
 
-func SaveScript(metadata protocol.ScriptMetadata, sentIDs ...int64) (int, error) {
-	tx, err := Begin()
+// SaveScript saves a script with the sentences in sentIDs, in selection order, along with its metadata
+func (db *DB) SaveScript(metadata protocol.ScriptMetadata, sentIDs ...int64) (int, error) {
+	return db.SaveScriptWithProvenance(metadata, sentIDs, nil)
+}
+
+// SaveScriptWithProvenance saves a script with the sentences in sentIDs, in selection order, along with its metadata.
+// provenance holds the selection provenance of each sentence in sentIDs, or is nil.
+func (db *DB) SaveScriptWithProvenance(metadata protocol.ScriptMetadata, sentIDs []int64, provenance []Provenance) (int, error) {
+	if provenance != nil && len(provenance) != len(sentIDs) {
+		return 0, fmt.Errorf("SaveScriptWithProvenance got %d sents, but provenance for %d", len(sentIDs), len(provenance))
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("failed to begin db transaction : %v", err)
 	}
 
 	n := 0
-	insertIntoScript := "INSERT INTO script (chunk_id, name) VALUES (?, ?)"
-	for _, id := range sentIDs {
-		_, err := tx.Exec(insertIntoScript, id, metadata.Options.ScriptName)
+	insertIntoScript := "INSERT INTO script (chunk_id, name, position, provenance) VALUES (?, ?, ?, ?)"
+	for i, id := range sentIDs {
+		prov := ""
+		if provenance != nil {
+			bts, err := json.Marshal(provenance[i])
+			if err != nil {
+				tx.Rollback()
+				return n, fmt.Errorf("failed to marshal provenance : %v", err)
+			}
+			prov = string(bts)
+		}
+		_, err := tx.Exec(insertIntoScript, id, metadata.Options.ScriptName, i+1, prov)
 		if err != nil {
 			tx.Rollback()
 			return n, fmt.Errorf("failed to insert into script table : %v", err)
@@ -1475,11 +1585,16 @@ func SaveScript(metadata protocol.ScriptMetadata, sentIDs ...int64) (int, error)
 		tx.Rollback()
 		return n, fmt.Errorf("failed to marshal selection settings : %v", err)
 	}
-	err = SetScriptPropertiesTx(tx, metadata.Options.ScriptName, pBytes)
+	err = db.SetScriptPropertiesTx(tx, metadata.Options.ScriptName, pBytes)
 	if err != nil {
 		tx.Rollback()
 		return n, fmt.Errorf("failed to save script properties : %v", err)
 	}
+	err = db.LogOpTx(tx, OpSaveScript, []string{metadata.Options.ScriptName}, int64(n), metadata)
+	if err != nil {
+		tx.Rollback()
+		return n, err
+	}
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
@@ -1488,3 +1603,74 @@ func SaveScript(metadata protocol.ScriptMetadata, sentIDs ...int64) (int, error)
 
 	return n, nil
 }
+
+// TruncateScript keeps the first n sentences of a script (in selection order), and deletes the rest.
+// The output size in the script metadata is updated. Returns the number of deleted sentences.
+func (db *DB) TruncateScript(scriptName string, n int) (int64, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("invalid script size %d", n)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("TruncateScript failed to begin db transaction : %v", err)
+	}
+
+	var size int
+	err = tx.QueryRow("SELECT COUNT(*) FROM script WHERE name = ?", scriptName).Scan(&size)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to count script table : %v", err)
+	}
+	if size == 0 {
+		tx.Rollback()
+		return 0, fmt.Errorf("no script named %s", scriptName)
+	}
+
+	res, err := tx.Exec("DELETE FROM script WHERE name = ? AND rowid NOT IN (SELECT rowid FROM script WHERE name = ? "+scriptOrder+" LIMIT ?)", scriptName, scriptName, n)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete from script table : %v", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
+
+	var pBytes []byte
+	err = tx.QueryRow(`SELECT properties FROM script_properties WHERE name = ?`, scriptName).Scan(&pBytes)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to read script properties : %v", err)
+	}
+	if err == nil {
+		var metadata protocol.ScriptMetadata
+		err = json.Unmarshal(pBytes, &metadata)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("couldn't unmarshal script properties : %v", err)
+		}
+		metadata.OutputSize = size - int(deleted)
+		pBytes, err = json.Marshal(metadata)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to marshal script properties : %v", err)
+		}
+		_, err = tx.Exec(`UPDATE script_properties SET properties = ? WHERE name = ?`, pBytes, scriptName)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to update script properties : %v", err)
+		}
+	}
+
+	err = db.LogOpTx(tx, OpTruncateScript, []string{scriptName}, deleted, map[string]int{"size": n})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return deleted, nil
+}
@@ -2,9 +2,11 @@ package dbapi
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	//"database/sql"
@@ -18,6 +20,8 @@ import (
 
 var testDbPath = "tst_manuscript_dbapi.db"
 
+var db *DB
+
 func init() {
 
 	log.Println("INITIALISING dbapi TESTS")
@@ -26,7 +30,7 @@ func init() {
 		log.Printf("failed to remove test file '%s' : %v", testDbPath, err)
 	}
 
-	err = CreateDB(testDbPath, "schema_sqlite.sql")
+	db, err = CreateDB(testDbPath)
 	if err != nil {
 		log.Fatalf("failed to create db '%s' : %v", testDbPath, err)
 	}
@@ -36,7 +40,7 @@ func init() {
 	// 	log.Fatalf("failed to open test db file '%s' : %v", testDbPath, err)
 	// }
 
-	// err = ExecSchema("schema_sqlite.sql")
+	// err = db.ExecSchema("schema_sqlite.sql")
 	// if err != nil {
 	// 	log.Fatalf("failed to ExecSchema : %v", err)
 	// }
@@ -47,7 +51,7 @@ func init() {
 // TODO Look up inserted values
 func TestInsertSource(t *testing.T) {
 
-	id1, err := InsertSource("s1")
+	id1, err := db.InsertSource("s1")
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -55,7 +59,7 @@ func TestInsertSource(t *testing.T) {
 		t.Errorf("wanted %d got %d", w, g)
 	}
 
-	id1, err = InsertSource("s1")
+	id1, err = db.InsertSource("s1")
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -63,7 +67,7 @@ func TestInsertSource(t *testing.T) {
 		t.Errorf("wanted %d got %d", w, g)
 	}
 
-	id2, err := InsertSource("s2")
+	id2, err := db.InsertSource("s2")
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -75,7 +79,7 @@ func TestInsertSource(t *testing.T) {
 
 // TODO Look up inserted values
 func TestInsertChunk(t *testing.T) {
-	id1, id2, err := InsertChunk("s1", "I am a tea pot.")
+	id1, id2, err := db.InsertChunk("s1", "I am a tea pot.")
 	if err != nil {
 		t.Errorf("failure : %v", err)
 	}
@@ -88,7 +92,7 @@ func TestInsertChunk(t *testing.T) {
 		t.Errorf("wanted %d got %d", w, g)
 	}
 
-	id3, id4, err := InsertChunk("s1", "I am a coffe pot.")
+	id3, id4, err := db.InsertChunk("s1", "I am a coffe pot.")
 	if err != nil {
 		t.Errorf("failure : %v", err)
 	}
@@ -111,7 +115,7 @@ func TestInsertChunkFeats1(t *testing.T) {
 		t.Errorf("InsertChunkFeats failed to begin transaction : %v", err)
 	}
 
-	sourceID, chunkID, _, err := InsertChunkTx(tx, "sourcex", "I am a happy-sad cow")
+	sourceID, chunkID, _, err := db.InsertChunkTx(tx, "sourcex", "I am a happy-sad cow")
 	if err != nil {
 		t.Errorf("failed InsertChunk : %v", err)
 		return
@@ -131,7 +135,7 @@ func TestInsertChunkFeats1(t *testing.T) {
 		"token_num": {"11": 1},
 	}
 
-	err = InsertChunkFeatsTx(tx, chunkID, feats)
+	err = db.InsertChunkFeatsTx(tx, chunkID, feats)
 	if err != nil {
 		tx.Rollback()
 		t.Errorf("%v", err)
@@ -142,14 +146,14 @@ func TestInsertChunkFeats1(t *testing.T) {
 		"SPECIAL_FEAT": {"special_value": 11},
 	}
 
-	err = InsertChunkFeatsTx(tx, chunkID, feats)
+	err = db.InsertChunkFeatsTx(tx, chunkID, feats)
 	if err != nil {
 		tx.Rollback()
 		t.Errorf("%v", err)
 		return
 	}
 
-	sents, err := GetSentsTx(tx, chunkID)
+	sents, err := db.GetSentsTx(tx, chunkID)
 	if err != nil {
 		tx.Rollback()
 		t.Errorf("%v", err)
@@ -185,7 +189,7 @@ func TestInsertChunkFeats2(t *testing.T) {
 		"f5": {"v1": 17},
 	}
 
-	_, cID, err := InsertChunk("sourceX", c)
+	_, cID, err := db.InsertChunk("sourceX", c)
 
 	if err != nil {
 		t.Errorf("Bomb! : %v", err)
@@ -197,14 +201,14 @@ func TestInsertChunkFeats2(t *testing.T) {
 		t.Errorf("InsertChunkFeats failed to begin transaction : %v", err)
 	}
 
-	err = InsertChunkFeatsTx(tx, cID, feats)
+	err = db.InsertChunkFeatsTx(tx, cID, feats)
 	if err != nil {
 		tx.Rollback()
 		t.Errorf("Really...? : %v", err)
 		return
 	}
 
-	sents, err := GetSentsTx(tx, cID)
+	sents, err := db.GetSentsTx(tx, cID)
 	if err != nil {
 		tx.Rollback()
 		t.Errorf("%v", err)
@@ -226,11 +230,61 @@ func TestInsertChunkFeats2(t *testing.T) {
 
 }
 
+func TestBulkInsertChunkFeats(t *testing.T) {
+	feats1 := map[string]map[string]int{
+		"bulk_f1": {"v1": 1, "v2": 2},
+		"bulk_f2": {"v1": 3},
+	}
+	feats2 := map[string]map[string]int{
+		"bulk_f1": {"v1": 4},
+		"bulk_f3": {"v3": 5},
+	}
+
+	_, cID1, err := db.InsertChunk("sourceBulk", "A bulk inserted brick.")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, cID2, err := db.InsertChunk("sourceBulk", "Another bulk inserted brick.")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	sents := []text.Sentence{
+		{ID: cID1, Feats: feats1},
+		{ID: cID2, Feats: feats2},
+	}
+	n, err := db.BulkInsertChunkFeats(sents...)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 5, n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	res, err := db.GetSents(cID1, cID2)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(res) != 2 {
+		t.Errorf("Expected %d sents, found %d", 2, len(res))
+		return
+	}
+	for i, feats := range []map[string]map[string]int{feats1, feats2} {
+		if !reflect.DeepEqual(res[i].Feats, feats) {
+			t.Errorf("Expected %#v, got %#v\n", feats, res[i].Feats)
+		}
+	}
+}
+
 // TODO Look up inserted values
 func TestInsertSourceFeats(t *testing.T) {
 
 	s := "article 1a"
-	sID, err := InsertSource(s)
+	sID, err := db.InsertSource(s)
 	if err != nil {
 		t.Errorf("InsertSource : %v", err)
 	}
@@ -242,12 +296,12 @@ func TestInsertSourceFeats(t *testing.T) {
 		{Name: "sf4", Value: "sv2"},
 	}
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		t.Errorf("failed to begin transaction : %v", err)
 	}
 
-	err = InsertSourceFeatsTx(tx, sID, fs)
+	err = db.InsertSourceFeatsTx(tx, sID, fs)
 	if err != nil {
 		t.Errorf("failed InsertSourceFeatsTx : %v", err)
 	}
@@ -280,7 +334,7 @@ func TestBlockSent(t *testing.T) {
 		},
 	}
 
-	aID, _, err := Add(a, true)
+	aID, _, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -290,13 +344,13 @@ func TestBlockSent(t *testing.T) {
 		return
 	}
 
-	err = BlockSents(blockableSents...)
+	err = db.BlockSents(blockableSents...)
 	if err != nil {
 		t.Errorf("BlockSent failed : %v", err)
 		return
 	}
 
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		log.Fatalf("Begin failed : %v", err)
 		return
@@ -354,7 +408,7 @@ func TestAdd(t *testing.T) {
 		},
 	}
 
-	aID, _, err := Add(a, true)
+	aID, _, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("This didn't go well : %v", err)
 	}
@@ -383,7 +437,7 @@ func TestAddDupes(t *testing.T) {
 		},
 	}
 
-	aID, inserted, err := Add(a, true)
+	aID, inserted, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("This didn't go well : %v", err)
 	}
@@ -421,7 +475,7 @@ func TestAddChunkFeatCats(t *testing.T) {
 	}
 
 	// add sents
-	aID, _, err := Add(a, true)
+	aID, _, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -440,7 +494,7 @@ func TestAddChunkFeatCats(t *testing.T) {
 		{TargetFeatName: "place_on_earth", FeatValue: "amsterdam"},
 		{TargetFeatName: "place_on_earth", FeatValue: "usa"},
 	}
-	n, err := AddChunkFeatCats("word", places)
+	n, err := db.AddChunkFeatCats("word", places)
 	if err != nil {
 		t.Errorf("%v", err)
 		return
@@ -451,7 +505,7 @@ func TestAddChunkFeatCats(t *testing.T) {
 	}
 
 	// the tests
-	tx, err := Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		log.Fatalf("Begin failed : %v", err)
 		return
@@ -489,7 +543,7 @@ func TestAddChunkFeatCats(t *testing.T) {
 		return
 	}
 
-	res, err := GetSents(ids...)
+	res, err := db.GetSents(ids...)
 	if err != nil {
 		t.Errorf("Failed : %v", err)
 		return
@@ -536,7 +590,7 @@ func TestBatchMetadata(t *testing.T) {
 	}
 
 	// add sents
-	aID, sentsWithID, err := Add(a, true)
+	aID, sentsWithID, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -569,7 +623,7 @@ func TestBatchMetadata(t *testing.T) {
 	n := 0
 	for _, s := range sentsWithID {
 		if _, doAdd := addToBatch[s.Text]; doAdd {
-			_, err = db.Exec(insert, s.ID, batchName)
+			_, err = db.conn.Exec(insert, s.ID, batchName)
 			if err != nil {
 				t.Errorf("add to batch failed : %v", err)
 				return
@@ -589,13 +643,13 @@ func TestBatchMetadata(t *testing.T) {
 		t.Errorf("failed to marshal filter metadata : %v", err)
 		return
 	}
-	err = SetBatchProperties(filterConfig.BatchName, pBytes)
+	err = db.SetBatchProperties(filterConfig.BatchName, pBytes)
 	if err != nil {
 		t.Errorf("failed to save batch properties : %v", err)
 		return
 	}
 
-	outputMetadata, err := GetBatchProperties(batchName)
+	outputMetadata, err := db.GetBatchProperties(batchName)
 	if err != nil {
 		t.Errorf("Failed : %v", err)
 		return
@@ -613,12 +667,12 @@ func TestGetSetScriptProperties(t *testing.T) {
 	selectorPayload := protocol.SelectorPayload{
 		Options: protocol.SelectorOptions{
 			FeatureOpts: []protocol.SelectorFeatOpt{
-				{text.FeatBigramTransition, 0},
-				{text.FeatBigram + "_top800", 3},
-				{text.FeatFinalTrigram, 0},
-				{text.FeatInitialBigram, 0},
-				{text.FeatWord, 0},
-				{text.FeatBigram, 0},
+				{Name: text.FeatBigramTransition, TargetAmount: 0},
+				{Name: text.FeatBigram + "_top800", TargetAmount: 3},
+				{Name: text.FeatFinalTrigram, TargetAmount: 0},
+				{Name: text.FeatInitialBigram, TargetAmount: 0},
+				{Name: text.FeatWord, TargetAmount: 0},
+				{Name: text.FeatBigram, TargetAmount: 0},
 			},
 			AdjustScoreForSentenceLength: false,
 			AccumulatedScripts:           []string{},
@@ -648,13 +702,13 @@ func TestGetSetScriptProperties(t *testing.T) {
 		t.Errorf("failed to marshal filter metadata : %v", err)
 		return
 	}
-	err = SetScriptProperties(selectorPayload.Options.ScriptName, pBytes)
+	err = db.SetScriptProperties(selectorPayload.Options.ScriptName, pBytes)
 	if err != nil {
 		t.Errorf("failed to save batch properties : %v", err)
 		return
 	}
 
-	outputMetadata, err := GetScriptProperties(scriptName)
+	outputMetadata, err := db.GetScriptProperties(scriptName)
 	if err != nil {
 		t.Errorf("Failed : %v", err)
 		return
@@ -690,7 +744,7 @@ func TestGetScriptWithMetadata(t *testing.T) {
 	}
 
 	// add sents
-	aID, sentsWithID, err := Add(a, true)
+	aID, sentsWithID, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -703,12 +757,12 @@ func TestGetScriptWithMetadata(t *testing.T) {
 	selectorPayload := protocol.SelectorPayload{
 		Options: protocol.SelectorOptions{
 			FeatureOpts: []protocol.SelectorFeatOpt{
-				{text.FeatBigramTransition, 0},
-				{text.FeatBigram + "_top800", 3},
-				{text.FeatFinalTrigram, 0},
-				{text.FeatInitialBigram, 0},
-				{text.FeatWord, 0},
-				{text.FeatBigram, 0},
+				{Name: text.FeatBigramTransition, TargetAmount: 0},
+				{Name: text.FeatBigram + "_top800", TargetAmount: 3},
+				{Name: text.FeatFinalTrigram, TargetAmount: 0},
+				{Name: text.FeatInitialBigram, TargetAmount: 0},
+				{Name: text.FeatWord, TargetAmount: 0},
+				{Name: text.FeatBigram, TargetAmount: 0},
 			},
 			AdjustScoreForSentenceLength: false,
 			AccumulatedScripts:           []string{},
@@ -740,7 +794,7 @@ func TestGetScriptWithMetadata(t *testing.T) {
 	n := 0
 	for _, s := range sentsWithID {
 		if _, doAdd := addToScript[s.Text]; doAdd {
-			_, err = db.Exec(insert, s.ID, scriptName)
+			_, err = db.conn.Exec(insert, s.ID, scriptName)
 			if err != nil {
 				t.Errorf("add to script failed : %v", err)
 				return
@@ -760,13 +814,13 @@ func TestGetScriptWithMetadata(t *testing.T) {
 		t.Errorf("failed to marshal filter metadata : %v", err)
 		return
 	}
-	err = SetScriptProperties(selectorPayload.Options.ScriptName, pBytes)
+	err = db.SetScriptProperties(selectorPayload.Options.ScriptName, pBytes)
 	if err != nil {
 		t.Errorf("failed to save script properties : %v", err)
 		return
 	}
 
-	outputMetadata, err := GetScriptProperties(scriptName)
+	outputMetadata, err := db.GetScriptProperties(scriptName)
 	if err != nil {
 		t.Errorf("Failed : %v", err)
 		return
@@ -776,7 +830,7 @@ func TestGetScriptWithMetadata(t *testing.T) {
 		return
 	}
 
-	script, err := GetScript(scriptName, 0, 0)
+	script, err := db.GetScript(scriptName, 0, 0)
 	if err != nil {
 		t.Errorf("Failed : %v", err)
 		return
@@ -839,7 +893,7 @@ func TestGetScriptWithPages(t *testing.T) {
 	}
 
 	// add sents
-	aID, sentsWithID, err := Add(a, true)
+	aID, sentsWithID, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -853,7 +907,7 @@ func TestGetScriptWithPages(t *testing.T) {
 	n := 0
 	for _, s := range sentsWithID {
 		if contains(addToScript, s.Text) {
-			_, err = db.Exec(insert, s.ID, scriptName)
+			_, err = db.conn.Exec(insert, s.ID, scriptName)
 			if err != nil {
 				t.Errorf("add to script failed : %v", err)
 				return
@@ -880,7 +934,7 @@ func TestGetScriptWithPages(t *testing.T) {
 
 	//
 	expect = addToScript
-	script, err = GetScript(scriptName, 0, 0)
+	script, err = db.GetScript(scriptName, 0, 0)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -895,7 +949,7 @@ func TestGetScriptWithPages(t *testing.T) {
 
 	//
 	expect = addToScript[0:5]
-	script, err = GetScript(scriptName, 1, 5)
+	script, err = db.GetScript(scriptName, 1, 5)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -910,7 +964,7 @@ func TestGetScriptWithPages(t *testing.T) {
 
 	//
 	expect = []string{addToScript[5]}
-	script, err = GetScript(scriptName, 2, 5)
+	script, err = db.GetScript(scriptName, 2, 5)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -958,7 +1012,7 @@ func TestGetBatchWithPages(t *testing.T) {
 	}
 
 	// add sents
-	aID, sentsWithID, err := Add(a, true)
+	aID, sentsWithID, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -972,7 +1026,7 @@ func TestGetBatchWithPages(t *testing.T) {
 	n := 0
 	for _, s := range sentsWithID {
 		if contains(addToBatch, s.Text) {
-			_, err = db.Exec(insert, s.ID, batchName)
+			_, err = db.conn.Exec(insert, s.ID, batchName)
 			if err != nil {
 				t.Errorf("add to batch failed : %v", err)
 				return
@@ -999,7 +1053,7 @@ func TestGetBatchWithPages(t *testing.T) {
 
 	//
 	expect = addToBatch
-	script, err = GetBatch(batchName, 0, 0)
+	script, err = db.GetBatch(batchName, 0, 0)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -1014,7 +1068,7 @@ func TestGetBatchWithPages(t *testing.T) {
 
 	//
 	expect = addToBatch[0:5]
-	script, err = GetBatch(batchName, 1, 5)
+	script, err = db.GetBatch(batchName, 1, 5)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -1029,7 +1083,7 @@ func TestGetBatchWithPages(t *testing.T) {
 
 	//
 	expect = []string{addToBatch[5]}
-	script, err = GetBatch(batchName, 2, 5)
+	script, err = db.GetBatch(batchName, 2, 5)
 	if err != nil {
 		t.Errorf("Couldn't get sents : %v", err)
 		return
@@ -1042,3 +1096,1582 @@ func TestGetBatchWithPages(t *testing.T) {
 		t.Errorf("Expected %v, got %v", expect, got)
 	}
 }
+
+func TestChunkFeatCatParents(t *testing.T) {
+	sents := []string{
+		"E Kalle bor i Stockholm",
+		"E Lisa reste till Amsterdam",
+		"E Det regnar idag",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testchunkfeatcatparents:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, sentsWithID, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	cats := []ChunkFeatCat{
+		{TargetFeatName: "test_se_place", FeatValue: "stockholm"},
+		{TargetFeatName: "test_int_place", FeatValue: "amsterdam"},
+		{TargetFeatName: "test_first_name", FeatValue: "kalle"},
+	}
+	_, err = db.AddChunkFeatCats("word", cats)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	parents := []ChunkFeatCatParent{
+		{Name: "test_se_place", Parent: "test_place"},
+		{Name: "test_int_place", Parent: "test_place"},
+		{Name: "test_place", Parent: "test_entity"},
+	}
+	n, err := db.AddChunkFeatCatParents(parents)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if n != len(parents) {
+		t.Errorf("Expected %d, got %d", len(parents), n)
+	}
+
+	_, err = db.AddChunkFeatCatParents([]ChunkFeatCatParent{{Name: "test_entity", Parent: "test_se_place"}})
+	if err == nil {
+		t.Errorf("Expected error for cyclic parent declaration")
+	}
+
+	allCats, err := db.ListChunkfeatCats()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, c := range []string{"test_se_place", "test_place", "test_entity"} {
+		if !contains(allCats, c) {
+			t.Errorf("Expected %s in %v", c, allCats)
+		}
+	}
+
+	ids := []int64{}
+	for _, s := range sentsWithID {
+		ids = append(ids, s.ID)
+	}
+	res, err := db.GetSents(ids...)
+	if err != nil {
+		t.Errorf("Failed : %v", err)
+		return
+	}
+	expect := []map[string]int{
+		{"stockholm": 1},
+		{"amsterdam": 1},
+		nil,
+	}
+	for i, s := range res {
+		for _, cat := range []string{"test_place", "test_entity"} {
+			if len(expect[i]) == 0 {
+				if len(s.Feats[cat]) != 0 {
+					t.Errorf("Expected no %s feats, found %v", cat, s.Feats[cat])
+				}
+			} else if !reflect.DeepEqual(expect[i], s.Feats[cat]) {
+				t.Errorf("Expected %v, found %v", expect[i], s.Feats[cat])
+			}
+		}
+	}
+}
+
+func TestParseChunkFeatCatFile(t *testing.T) {
+	fn := "tst_parse_chunkfeatcat_file.txt"
+	content := "# comment\n@parent\tse_place\tplace\nword\tse_place\tStockholm\nword\tse_place\tvisby\n"
+	err := os.WriteFile(fn, []byte(content), 0644)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer os.Remove(fn)
+
+	sourceFeatName, cats, parents, err := ParseChunkFeatCatFile(fn)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := "word", sourceFeatName; w != g {
+		t.Errorf("wanted %s got %s", w, g)
+	}
+	expectCats := []ChunkFeatCat{
+		{TargetFeatName: "se_place", FeatValue: "stockholm"},
+		{TargetFeatName: "se_place", FeatValue: "visby"},
+	}
+	if !reflect.DeepEqual(expectCats, cats) {
+		t.Errorf("Expected %v, got %v", expectCats, cats)
+	}
+	expectParents := []ChunkFeatCatParent{{Name: "se_place", Parent: "place"}}
+	if !reflect.DeepEqual(expectParents, parents) {
+		t.Errorf("Expected %v, got %v", expectParents, parents)
+	}
+}
+
+func TestAddFreqBandChunkFeatCat(t *testing.T) {
+	sents := []string{
+		"E Band ett",
+		"E Band två",
+		"E Band tre",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testaddfreqbandchunkfeatcat:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, sentsWithID, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	// a test feature with values occurring in 3, 2 and 1 chunks
+	featName := "test_band_feat"
+	valueChunks := map[string][]text.Sentence{
+		"a": sentsWithID[0:3],
+		"b": sentsWithID[0:2],
+		"c": sentsWithID[0:1],
+	}
+	for v, ss := range valueChunks {
+		xRes, err := db.conn.Exec(`INSERT INTO chunkfeat (name, value) VALUES (?, ?)`, featName, v)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		id, _ := xRes.LastInsertId()
+		for _, s := range ss {
+			_, err = db.conn.Exec(`INSERT INTO chunk_chunkfeat (chunk_id, chunkfeat_id, freq) VALUES (?, ?, 1)`, s.ID, id)
+			if err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+	}
+
+	var catValues = func(cat string) []string {
+		res := []string{}
+		rows, err := db.conn.Query(`SELECT chunkfeat.value FROM chunkfeat, chunkfeatcat WHERE chunkfeat.id = chunkfeatcat.chunkfeat_id AND chunkfeatcat.name = ? ORDER BY chunkfeat.value`, cat)
+		if err != nil {
+			t.Errorf("%v", err)
+			return res
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var v string
+			rows.Scan(&v)
+			res = append(res, v)
+		}
+		return res
+	}
+
+	n, err := db.AddFreqBandChunkFeatCat("test_band", FreqBand{FeatName: featName, From: 1, To: 2})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 2, n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	if w, g := []string{"a", "b"}, catValues("test_band"); !reflect.DeepEqual(w, g) {
+		t.Errorf("wanted %v got %v", w, g)
+	}
+
+	// an existing category is replaced
+	_, err = db.AddFreqBandChunkFeatCat("test_band", FreqBand{FeatName: featName, From: 2, To: 3})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := []string{"b", "c"}, catValues("test_band"); !reflect.DeepEqual(w, g) {
+		t.Errorf("wanted %v got %v", w, g)
+	}
+
+	_, err = db.AddFreqBandChunkFeatCat("test_band_pct", FreqBand{FeatName: featName, From: 0, To: 67, Percentile: true})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := []string{"a", "b"}, catValues("test_band_pct"); !reflect.DeepEqual(w, g) {
+		t.Errorf("wanted %v got %v", w, g)
+	}
+
+	// consecutive percentile bands partition the ranked values
+	var next int64
+	for pct := 0; pct < 100; pct += 10 {
+		offset, limit, err := FreqBand{FeatName: featName, From: float64(pct), To: float64(pct + 10), Percentile: true}.offsetLimit(15)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if offset != next {
+			t.Errorf("band %d%%: wanted offset %d got %d", pct, next, offset)
+		}
+		next = offset + limit
+	}
+	if w, g := int64(15), next; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	_, err = db.AddFreqBandChunkFeatCat("test_band", FreqBand{FeatName: featName, From: 3, To: 2})
+	if err == nil {
+		t.Errorf("expected error for invalid band")
+	}
+	_, err = db.AddFreqBandChunkFeatCat("test_band", FreqBand{FeatName: "no_such_feat", From: 1, To: 5})
+	if err == nil {
+		t.Errorf("expected error for unknown feature")
+	}
+}
+
+func TestTwoOpenDBs(t *testing.T) {
+	fn := "tst_manuscript_dbapi_second.db"
+	os.RemoveAll(fn)
+	defer os.RemoveAll(fn)
+
+	db2, err := CreateDB(fn)
+	if err != nil {
+		t.Errorf("failed to create db '%s' : %v", fn, err)
+		return
+	}
+	defer db2.Close()
+
+	a := text.Article{
+		URL: "testtwoopendbs:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{text.ComputeSentence("E Bara i den andra databasen")}},
+		},
+	}
+	_, _, err = db2.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	err = db2.BlockSents("E Bara i den andra databasen")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	blocked2, err := db2.ListBlockedSents()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 1, len(blocked2); w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	blocked1, err := db.ListBlockedSents()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, s := range blocked1 {
+		if s.Text == "E Bara i den andra databasen" {
+			t.Errorf("sentence blocked in second db found in first db")
+		}
+	}
+}
+
+// schemaObjects lists the tables (with columns), indices and views of a db
+func schemaObjects(t *testing.T, db *DB) []string {
+	res := []string{}
+	rows, err := db.conn.Query(`SELECT type, name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name`)
+	if err != nil {
+		t.Errorf("%v", err)
+		return res
+	}
+	objs := [][2]string{}
+	for rows.Next() {
+		var typ, name string
+		rows.Scan(&typ, &name)
+		objs = append(objs, [2]string{typ, name})
+	}
+	rows.Close()
+
+	for _, o := range objs {
+		res = append(res, o[0]+" "+o[1])
+		if o[0] != "table" {
+			continue
+		}
+		cols, err := db.conn.Query(`SELECT name, type FROM pragma_table_info(?) ORDER BY cid`, o[1])
+		if err != nil {
+			t.Errorf("%v", err)
+			return res
+		}
+		for cols.Next() {
+			var name, typ string
+			cols.Scan(&name, &typ)
+			res = append(res, o[1]+"."+name+" "+typ)
+		}
+		cols.Close()
+	}
+	return res
+}
+
+func TestMigrate(t *testing.T) {
+	v1Path := "tst_manuscript_dbapi_v1.db"
+	latestPath := "tst_manuscript_dbapi_latest.db"
+	os.RemoveAll(v1Path)
+	os.RemoveAll(latestPath)
+	defer os.RemoveAll(v1Path)
+	defer os.RemoveAll(latestPath)
+
+	v1Schema, err := os.ReadFile("testdata/schema_v1.sql")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	v1DB, err := createDB(v1Path, string(v1Schema))
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	v1DB.Close()
+
+	_, err = Open(v1Path)
+	if err == nil {
+		t.Errorf("expected error when opening db with old schema version")
+	}
+
+	v1DB, err = OpenForMigration(v1Path)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer v1DB.Close()
+
+	// a chunk added before migration
+	migrateSent := "E Före, migreringen 2021 och 17"
+	_, cID, err := v1DB.InsertChunk("sourceMigrate", migrateSent)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	tx, err := v1DB.Begin()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = v1DB.InsertChunkFeatsTx(tx, cID, text.ComputeSentence(migrateSent).Feats)
+	if err != nil {
+		tx.Rollback()
+		t.Errorf("%v", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	from, to, err := v1DB.Migrate()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 1, from; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	if w, g := LatestSchemaVersion(), to; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	chunkCount, err := v1DB.GetChunkCount(cID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := (ChunkCount{WordCount: 4, CommaCount: 1, DigitCount: 2, CharCount: 31, SourceFreq: 1}), chunkCount; w != g {
+		t.Errorf("wanted %#v got %#v", w, g)
+	}
+
+	// migrating an up-to-date db is a no-op
+	from, to, err = v1DB.Migrate()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if from != to {
+		t.Errorf("expected no migration, got %d to %d", from, to)
+	}
+
+	latestDB, err := CreateDB(latestPath)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer latestDB.Close()
+	version, err := latestDB.SchemaVersion()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := LatestSchemaVersion(), version; w != g {
+		t.Errorf("CreateDB schema version: wanted %d got %d", w, g)
+	}
+
+	if w, g := schemaObjects(t, latestDB), schemaObjects(t, v1DB); !reflect.DeepEqual(w, g) {
+		t.Errorf("migrated schema differs from schema_sqlite.sql\nwanted %v\ngot    %v", w, g)
+	}
+
+	// the backfilled chunk_count row matches the one of a chunk added to a fresh db
+	a := text.Article{
+		URL:        "sourceMigrate",
+		Paragraphs: []text.Paragraph{{Sentences: []text.Sentence{text.ComputeSentence(migrateSent)}}},
+	}
+	_, sents, err := latestDB.Add(a, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	freshCount, err := latestDB.GetChunkCount(sents[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := freshCount, chunkCount; w != g {
+		t.Errorf("migrated chunk_count differs from fresh db\nwanted %#v\ngot    %#v", w, g)
+	}
+
+	migrated, err := Open(v1Path)
+	if err != nil {
+		t.Errorf("failed to open migrated db : %v", err)
+		return
+	}
+	migrated.Close()
+}
+
+func TestStats(t *testing.T) {
+	_, err := db.RefreshStats()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	stats, err := db.GetStats()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if stats.ComputedAt == "" {
+		t.Errorf("expected computed_at to be set")
+	}
+
+	var nChunks, nBlocked int64
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM chunk`).Scan(&nChunks)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM batch WHERE name = ?`, text.BlockBatch).Scan(&nBlocked)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := nChunks, stats.Chunks; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	if w, g := nBlocked, stats.Blocked; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	var sumSourcesPerChunk int64
+	for _, n := range stats.SourcesPerChunk {
+		sumSourcesPerChunk += n
+	}
+	if w, g := nChunks, sumSourcesPerChunk; w != g {
+		t.Errorf("sources per chunk: wanted %d got %d", w, g)
+	}
+	if stats.FeatValues[text.FeatWord] != stats.WordForms {
+		t.Errorf("word feat values: wanted %d got %d", stats.WordForms, stats.FeatValues[text.FeatWord])
+	}
+
+	a := text.Article{
+		URL: "teststats:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("E Statistik är roligt"),
+				text.ComputeSentence("E Statistik är inte alls roligt"),
+			}},
+		},
+	}
+	_, _, err = db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []ChunkFeatCat{{TargetFeatName: "test_stats_cat", FeatValue: "statistik"}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	_, err = db.BlockSentsWithInfo(BlockInfo{Reason: "test_stats"}, "E Statistik är inte alls roligt")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the cached stats are cleared when chunks and categories are added, and the blocked count is always current
+	refreshed, err := db.GetStats()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := nBlocked+1, refreshed.Blocked; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	if w, g := stats.Chunks+2, refreshed.Chunks; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	if w, g := stats.SentLengths[4]+1, refreshed.SentLengths[4]; w != g {
+		t.Errorf("sent lengths: wanted %d got %d", w, g)
+	}
+	if w, g := (CategoryStats{Values: 1, Chunks: 2}), refreshed.Categories["test_stats_cat"]; w != g {
+		t.Errorf("wanted %v got %v", w, g)
+	}
+}
+
+func TestChunkCount(t *testing.T) {
+	s := "E Fyra, fem och 6 sexor"
+	a := text.Article{
+		URL: "testchunkcount:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{text.ComputeSentence(s)}},
+		},
+	}
+	_, sents, err := db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	if len(sents) != 1 {
+		t.Errorf("Expected %d sents, found %d", 1, len(sents))
+		return
+	}
+
+	got, err := db.GetChunkCount(sents[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := (ChunkCount{WordCount: 5, CommaCount: 1, DigitCount: 1, CharCount: 23, SourceFreq: 1}), got; w != g {
+		t.Errorf("wanted %#v got %#v", w, g)
+	}
+
+	// the same sentence in a second source
+	a.URL = "testchunkcount:testsource2"
+	_, _, err = db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	got, err = db.GetChunkCount(sents[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 2, got.SourceFreq; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+}
+
+func TestFeatBlobs(t *testing.T) {
+	a := text.Article{
+		URL: "testfeatblobs:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("Blobbhusen ligger nära Blobbstad, 12 mil bort."),
+				text.ComputeSentence("Det finns inga blobbar i Blobbstad."),
+			}},
+		},
+	}
+	_, sents, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	if len(sents) != 2 {
+		t.Errorf("Expected %d sents, found %d", 2, len(sents))
+		return
+	}
+	ids := []int64{sents[1].ID, sents[0].ID}
+
+	_, err = db.AddChunkFeatCats(text.FeatWord, []ChunkFeatCat{{FeatValue: "blobbstad", TargetFeatName: "test_blob_places"}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCatParents([]ChunkFeatCatParent{{Name: "test_blob_places", Parent: "test_blob_geo"}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	getSents := func(useBlobs bool) []text.Sentence {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("failed to begin transaction : %v", err)
+		}
+		res, err := db.getSentsTx(tx, useBlobs, true, ids...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatalf("failed to commit transaction : %v", err)
+		}
+		return res
+	}
+
+	join := getSents(false)
+	blob := getSents(true)
+	if !reflect.DeepEqual(join, blob) {
+		t.Errorf("Expected %#v, got %#v\n", join, blob)
+	}
+	if w, g := 1, blob[0].Feats["test_blob_geo"]["blobbstad"]; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	// recreate blobs from the chunkfeat tables
+	_, err = db.conn.Exec("DELETE FROM chunk_feat_blob")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	n, err := db.BuildFeatBlobs(1)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if n < 2 {
+		t.Errorf("Expected at least %d blobs, got %d", 2, n)
+	}
+	blob = getSents(true)
+	if !reflect.DeepEqual(join, blob) {
+		t.Errorf("Expected %#v, got %#v\n", join, blob)
+	}
+
+	var nBlobs int
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM chunk_feat_blob WHERE chunk_id IN (?, ?)", ids[0], ids[1]).Scan(&nBlobs)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := 2, nBlobs; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+}
+
+func TestEncodeFeats(t *testing.T) {
+	feats := map[string]map[string]int{
+		"word":  {"ö": 2, "": 1},
+		"count": {"word_count": 300},
+		"empty": {},
+	}
+	s := text.Sentence{Feats: make(map[string]map[string]int)}
+	err := decodeFeats(encodeFeats(feats), &s)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	delete(feats, "empty")
+	if !reflect.DeepEqual(feats, s.Feats) {
+		t.Errorf("Expected %#v, got %#v\n", feats, s.Feats)
+	}
+
+	blob := encodeFeats(feats)
+	err = decodeFeats(blob[:len(blob)-1], &s)
+	if err == nil {
+		t.Errorf("Expected error for truncated blob")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ok, err := db.FTSAvailable()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !ok {
+		t.Skip("FTS5 not available, run tests with -tags sqlite_fts5")
+	}
+
+	a := text.Article{
+		URL: "testsearch:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("Sökmotorn hittar i dag alla ord."),
+				text.ComputeSentence("Sökordet far är inte samma som får."),
+			}},
+		},
+	}
+	_, sents, err := db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	err = db.BuildFTSIndex()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// added after the index was built
+	_, added, err := db.InsertChunk("testsearch:testsource2", "Sökmotorn är i dag snabb.")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		query  string
+		expect []int64
+	}{
+		{query: `"i dag" sökmotorn`, expect: []int64{sents[0].ID, added}},
+		{query: `sökmotorn NOT snabb`, expect: []int64{sents[0].ID}},
+		{query: `sökord*`, expect: []int64{sents[1].ID}},
+		{query: `får`, expect: []int64{sents[1].ID}},
+		{query: `"dag alla"`, expect: []int64{sents[0].ID}},
+		{query: `"alla dag"`, expect: nil},
+	} {
+		hits, err := db.Search(test.query, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		var got []int64
+		for _, h := range hits {
+			got = append(got, h.ID)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(test.expect, got) {
+			t.Errorf("%s : expected %v, got %v", test.query, test.expect, got)
+		}
+	}
+
+	// the index follows deletes
+	_, err = db.conn.Exec("DELETE FROM chunk WHERE id = ?", added)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	hits, err := db.Search("snabb", 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(hits) != 0 {
+		t.Errorf("Expected no hits, got %v", hits)
+	}
+}
+
+// TestOpenWithFTSIndex runs without FTS5 as well: a db with a full-text index must then be refused.
+func TestOpenWithFTSIndex(t *testing.T) {
+	ftsAvailable, err := db.FTSAvailable()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	dbPath := t.TempDir() + "/tst_open_fts.db"
+	ftsDB, err := CreateDB(dbPath)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// CreateDB creates the index if FTS5 is available
+	hasIndex, err := ftsDB.HasFTSIndex()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := ftsAvailable, hasIndex; w != g {
+		t.Errorf("full-text index after CreateDB: wanted %v got %v", w, g)
+	}
+	if !ftsAvailable {
+		// a stand-in for an index built by a binary with FTS5
+		_, err = ftsDB.conn.Exec("CREATE TABLE chunk_fts (text TEXT)")
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	ftsDB.Close()
+
+	ftsDB, err = Open(dbPath)
+	if ftsAvailable {
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		ftsDB.Close()
+	} else if err == nil {
+		ftsDB.Close()
+		t.Errorf("Expected error when opening a db with a full-text index without FTS5")
+	} else if !strings.Contains(err.Error(), "sqlite_fts5") {
+		t.Errorf("Expected error mentioning sqlite_fts5, got %v", err)
+	}
+}
+
+func TestBlockWithInfo(t *testing.T) {
+	a := text.Article{
+		URL: "testblockwithinfo:spamsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("Köp billiga klockor nu!"),
+				text.ComputeSentence("Köp fler klockor nu!"),
+			}},
+		},
+	}
+	_, spam, err := db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	a = text.Article{
+		URL: "testblockwithinfo:source",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("Blockeringen gäller xyzzy."),
+				text.ComputeSentence("En vanlig mening om block."),
+			}},
+		},
+	}
+	_, sents, err := db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	n, err := db.BlockSentsFromSourceRE(BlockInfo{Reason: "test_spam", User: "tester"}, "^testblockwithinfo:spam")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(2), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	n, err = db.BlockSentsMatchingRE(BlockInfo{Reason: "test_xyzzy", User: "tester"}, "xyzzy")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(1), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	// already blocked, keeps the original reason
+	n, err = db.BlockSentIDsWithInfo(BlockInfo{Reason: "test_other"}, spam[0].ID, sents[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(0), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	blocked, err := db.ListBlocked("test_spam")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(blocked) != 2 {
+		t.Errorf("Expected %d blocked sents, found %d", 2, len(blocked))
+		return
+	}
+	for i, b := range blocked {
+		if b.ID != spam[i].ID || b.Text != spam[i].Text || b.User != "tester" || b.Timestamp == "" {
+			t.Errorf("Unexpected blocked sent %#v", b)
+		}
+	}
+
+	n, err = db.UnblockSentIDs(spam[0].ID, sents[1].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(1), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	blocked, err = db.ListBlocked("test_spam")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(blocked) != 1 || blocked[0].ID != spam[1].ID {
+		t.Errorf("Expected only %d to be blocked, found %#v", spam[1].ID, blocked)
+	}
+
+	// blocking again after unblocking sets a new reason
+	_, err = db.BlockSentIDsWithInfo(BlockInfo{Reason: "test_other"}, spam[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	blocked, err = db.ListBlocked("test_other")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(blocked) != 1 || blocked[0].ID != spam[0].ID {
+		t.Errorf("Expected only %d to be blocked, found %#v", spam[0].ID, blocked)
+	}
+}
+
+// TestBlockManyIDs blocks more ids than fit in a single statement
+func TestBlockManyIDs(t *testing.T) {
+	nSents := maxInArgs + 20
+	sents := []text.Sentence{}
+	for i := 0; i < nSents; i++ {
+		sents = append(sents, text.ComputeSentence(fmt.Sprintf("Spärrmening nummer %d.", i)))
+	}
+	a := text.Article{
+		URL:        "testblockmanyids:testsource",
+		Paragraphs: []text.Paragraph{{Sentences: sents}},
+	}
+	_, added, err := db.Add(a, false)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	ids := []int64{}
+	for _, s := range added {
+		ids = append(ids, s.ID)
+	}
+
+	n, err := db.BlockSentIDsWithInfo(BlockInfo{Reason: "test_many", User: "tester"}, ids...)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(nSents), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	blocked, err := db.ListBlocked("test_many")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := nSents, len(blocked); w != g {
+		t.Errorf("wanted %d blocked sents, found %d", w, g)
+	}
+
+	n, err = db.UnblockSentIDs(ids...)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(nSents), n; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	blocked, err = db.ListBlocked("test_many")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(blocked) != 0 {
+		t.Errorf("Expected no blocked sents, found %d", len(blocked))
+	}
+}
+
+func TestCorrectChunkText(t *testing.T) {
+	a := text.Article{
+		URL: "testcorrect:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: []text.Sentence{
+				text.ComputeSentence("Rättstavningen av Korrektorp är fel."),
+				text.ComputeSentence("Korrektorpa är en annan ort."),
+			}},
+		},
+	}
+	_, sents, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	id := sents[0].ID
+
+	_, err = db.AddChunkFeatCats(text.FeatWord, []ChunkFeatCat{{FeatValue: "korrektorpa", TargetFeatName: "test_correct_place"}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.conn.Exec("INSERT INTO script (chunk_id, name) VALUES (?, ?)", id, "test_correct_script")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.PopulateWordFreqTable()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	newText := "Rättstavningen av Korrektorpa är fel."
+	edit, err := db.CorrectChunkText(id, newText, "tester", "stavfel")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if edit.OldText != sents[0].Text || edit.NewText != newText || edit.Timestamp == "" {
+		t.Errorf("Unexpected edit %#v", edit)
+	}
+
+	// an existing text is not allowed
+	_, err = db.CorrectChunkText(id, sents[1].Text, "tester", "")
+	if err == nil {
+		t.Errorf("Expected error for existing text")
+	}
+
+	res, err := db.GetSents(id)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := newText, res[0].Text; w != g {
+		t.Errorf("wanted %s got %s", w, g)
+	}
+	if _, ok := res[0].Feats[text.FeatWord]["korrektorp"]; ok {
+		t.Errorf("Expected old word to be removed, found %#v", res[0].Feats[text.FeatWord])
+	}
+	if w, g := 1, res[0].Feats["test_correct_place"]["korrektorpa"]; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+	// korrektorpa is now in two chunks, and korrektorp in none
+	for word, freq := range map[string]int{"korrektorpa": 2, "korrektorp": 0} {
+		var got int
+		err = db.conn.QueryRow("SELECT wordfreq.freq FROM wordfreq, chunkfeat WHERE wordfreq.chunkfeat_id = chunkfeat.id AND chunkfeat.name = ? AND chunkfeat.value = ?", text.FeatWord, word).Scan(&got)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if freq != got {
+			t.Errorf("%s : wanted %d got %d", word, freq, got)
+		}
+	}
+	count, err := db.GetChunkCount(id)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := res[0].Feats[text.FeatCount][text.FeatValLowestWordFreq], count.LowestWordFreq; w != g || g < 1 {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+
+	hist, err := db.ChunkHistory(id)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(hist) != 1 || hist[0] != edit {
+		t.Errorf("Expected %#v, got %#v", []ChunkEdit{edit}, hist)
+	}
+
+	modified, err := db.ModifiedScripts()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := int64(1), modified["test_correct_script"]; w != g {
+		t.Errorf("wanted %d got %d", w, g)
+	}
+}
+
+func TestOpLog(t *testing.T) {
+	db.SetUser("test_oplog_user")
+	defer db.SetUser("")
+
+	_, cID, err := db.InsertChunk("testoplog:testsource", "Loggen ser allt.")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.conn.Exec("INSERT INTO batch (chunk_id, name) VALUES (?, ?)", cID, "test_oplog_batch")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.DeleteBatches("test_oplog_batch", "test_oplog_batch2")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.BlockSentIDsWithInfo(BlockInfo{Reason: "test_oplog"}, cID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	entries, err := db.ListOpLog(OpLogQuery{Name: "test_oplog_batch2"})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected %d entries, found %#v", 1, entries)
+		return
+	}
+	e := entries[0]
+	if e.Operation != OpDeleteBatches || e.Rows != 1 || e.User != "test_oplog_user" || e.Timestamp == "" || !reflect.DeepEqual(e.Names, []string{"test_oplog_batch", "test_oplog_batch2"}) {
+		t.Errorf("Unexpected entry %#v", e)
+	}
+
+	entries, err = db.ListOpLog(OpLogQuery{Operation: OpBlock, Limit: 1})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected %d entries, found %#v", 1, entries)
+		return
+	}
+	var config blockOpConfig
+	err = json.Unmarshal(entries[0].Config, &config)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := (blockOpConfig{BlockInfo: BlockInfo{Reason: "test_oplog"}, IDs: []int64{cID}}), config; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+
+	// deletions with the config that cleared the script
+	clearConfig := protocol.SelectorOptions{ScriptName: "test_oplog_script"}
+	err = db.DeleteScriptsWithConfig(clearConfig, "test_oplog_script")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	entries, err = db.ListOpLog(OpLogQuery{Name: "test_oplog_script"})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(entries) != 1 || entries[0].Operation != OpDeleteScripts {
+		t.Errorf("Unexpected oplog entries %#v", entries)
+		return
+	}
+	var gotConfig protocol.SelectorOptions
+	err = json.Unmarshal(entries[0].Config, &gotConfig)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := clearConfig, gotConfig; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+
+	// oldest first
+	all, err := db.ListOpLog(OpLogQuery{})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].ID > all[i].ID {
+			t.Errorf("Expected oplog in chronological order, found %d before %d", all[i-1].ID, all[i].ID)
+		}
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	ids := []int64{}
+	for _, s := range []string{"Mängd ett.", "Mängd två.", "Mängd tre.", "Mängd fyra."} {
+		_, cID, err := db.InsertChunk("testsetops:testsource", s)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		ids = append(ids, cID)
+	}
+	for _, x := range []struct {
+		table, name string
+		ids         []int64
+	}{
+		{"batch", "test_setops_b1", ids[0:3]},
+		{"batch", "test_setops_b2", ids[1:4]},
+		{"script", "test_setops_s1", ids[2:3]},
+	} {
+		for _, id := range x.ids {
+			_, err := db.conn.Exec("INSERT INTO "+x.table+" (chunk_id, name) VALUES (?, ?)", id, x.name)
+			if err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+	}
+	_, err := db.BlockSentIDsWithInfo(BlockInfo{Reason: "test_setops"}, ids[3])
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	b1 := protocol.SetOperand{Kind: KindBatch, Name: "test_setops_b1"}
+	b2 := protocol.SetOperand{Kind: KindBatch, Name: "test_setops_b2"}
+	s1 := protocol.SetOperand{Kind: KindScript, Name: "test_setops_s1"}
+	for _, x := range []struct {
+		kind, target, op string
+		operands         []protocol.SetOperand
+		want             int
+	}{
+		{KindBatch, "test_setops_union", SetUnion, []protocol.SetOperand{b1, b2}, 3}, // the blocked sent is excluded
+		{KindBatch, "test_setops_intersect", SetIntersect, []protocol.SetOperand{b1, b2}, 2},
+		{KindBatch, "test_setops_diff", SetDiff, []protocol.SetOperand{b1, b2, s1}, 1},
+		{KindScript, "test_setops_copy", SetCopy, []protocol.SetOperand{s1}, 1},
+		{KindScript, "test_setops_from_batch", SetDiff, []protocol.SetOperand{b2, s1}, 1},
+	} {
+		n, err := db.CreateFromSetOp(x.kind, x.target, x.op, x.operands...)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if n != x.want {
+			t.Errorf("%s %s: expected %d sents, got %d", x.op, x.target, x.want, n)
+		}
+	}
+
+	meta, err := db.GetBatchProperties("test_setops_diff")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := (&protocol.SetOperation{Operation: SetDiff, Operands: []protocol.SetOperand{b1, b2, s1}}), meta.SetOp; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+	if meta.BatchName != "test_setops_diff" || meta.OutputSize != 1 {
+		t.Errorf("Unexpected batch metadata %#v", meta)
+	}
+
+	// errors
+	if _, err := db.CreateFromSetOp(KindBatch, "test_setops_union", SetUnion, b1); err == nil {
+		t.Errorf("Expected error for existing target")
+	}
+	if _, err := db.CreateFromSetOp(KindBatch, "test_setops_x", SetUnion, protocol.SetOperand{Kind: KindBatch, Name: "test_setops_missing"}); err == nil {
+		t.Errorf("Expected error for missing operand")
+	}
+	if _, err := db.CreateFromSetOp(KindBatch, "test_setops_x", SetCopy, b1, b2); err == nil {
+		t.Errorf("Expected error for copy with two operands")
+	}
+
+	// rename
+	err = db.Rename(KindScript, "test_setops_copy", "test_setops_renamed")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	sMeta, err := db.GetScriptProperties("test_setops_renamed")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if sMeta.Options.ScriptName != "test_setops_renamed" || sMeta.SetOp == nil || sMeta.SetOp.Operation != SetCopy {
+		t.Errorf("Unexpected script metadata %#v", sMeta)
+	}
+	n, err := db.queryCount(`SELECT COUNT(*) FROM script WHERE name = 'test_setops_copy'`)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if n != 0 {
+		t.Errorf("Expected no sents in renamed script, found %d", n)
+	}
+	if err := db.Rename(KindBatch, "test_setops_union", "test_setops_b1"); err == nil {
+		t.Errorf("Expected error for renaming to existing batch")
+	}
+
+	// renaming a batch updates the references to it
+	_, err = db.SaveScript(protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: "test_setops_selected", FromBatch: "test_setops_b2"}}}, ids[1])
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	pBytes, err := json.Marshal(protocol.BatchMetadata{FilterPayload: protocol.FilterPayload{BatchName: "test_setops_refined"}, Lineage: []protocol.SetOperand{b2}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.SetBatchProperties("test_setops_refined", pBytes)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.Rename(KindBatch, "test_setops_b2", "test_setops_b2_renamed")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	b2Renamed := protocol.SetOperand{Kind: KindBatch, Name: "test_setops_b2_renamed"}
+	meta, err = db.GetBatchProperties("test_setops_diff")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := []protocol.SetOperand{b1, b2Renamed, s1}, meta.SetOp.Operands; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+	meta, err = db.GetBatchProperties("test_setops_refined")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := []protocol.SetOperand{b2Renamed}, meta.Lineage; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+	sMeta, err = db.GetScriptProperties("test_setops_from_batch")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := []protocol.SetOperand{b2Renamed, s1}, sMeta.SetOp.Operands; !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %#v, got %#v", w, g)
+	}
+	sMeta, err = db.GetScriptProperties("test_setops_selected")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := "test_setops_b2_renamed", sMeta.Options.FromBatch; w != g {
+		t.Errorf("wanted %s got %s", w, g)
+	}
+
+	entries, err := db.ListOpLog(OpLogQuery{Name: "test_setops_renamed"})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(entries) != 1 || entries[0].Operation != OpRenameScript {
+		t.Errorf("Unexpected oplog entries %#v", entries)
+	}
+}
+
+func TestScriptOrder(t *testing.T) {
+	scriptName := "test_script_order"
+	textSents := []text.Sentence{}
+	for _, s := range []string{"Ordning ett.", "Ordning två.", "Ordning tre.", "Ordning fyra.", "Ordning fem."} {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{URL: "testscriptorder:testsource", Paragraphs: []text.Paragraph{{Sentences: textSents}}}
+	_, sentsWithID, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	ids := []int64{}
+	for _, s := range sentsWithID {
+		ids = append(ids, s.ID)
+	}
+	// selection order differs from insertion order
+	selected := []int64{ids[3], ids[0], ids[4], ids[1], ids[2]}
+	meta := protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: scriptName}}}
+	_, err = db.SaveScript(meta, selected...)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	sentIDs := func(sents []text.Sentence) []int64 {
+		res := []int64{}
+		for _, s := range sents {
+			res = append(res, s.ID)
+		}
+		return res
+	}
+
+	sents, err := db.GetScript(scriptName, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := selected, sentIDs(sents); !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %v, got %v", w, g)
+	}
+	sents, err = db.GetScript(scriptName, 2, 2)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := selected[2:4], sentIDs(sents); !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %v, got %v", w, g)
+	}
+
+	// copies keep the selection order
+	_, err = db.CreateFromSetOp(KindScript, scriptName+"_copy", SetCopy, protocol.SetOperand{Kind: KindScript, Name: scriptName})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	sents, err = db.GetScript(scriptName+"_copy", 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := selected, sentIDs(sents); !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %v, got %v", w, g)
+	}
+
+	deleted, err := db.TruncateScript(scriptName, 3)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if deleted != 2 {
+		t.Errorf("Expected %d deleted, got %d", 2, deleted)
+	}
+	sents, err = db.GetScript(scriptName, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if w, g := selected[:3], sentIDs(sents); !reflect.DeepEqual(w, g) {
+		t.Errorf("Expected %v, got %v", w, g)
+	}
+	meta, err = db.GetScriptProperties(scriptName)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if meta.OutputSize != 3 {
+		t.Errorf("Expected output size %d, got %d", 3, meta.OutputSize)
+	}
+
+	if _, err := db.TruncateScript("test_script_order_missing", 3); err == nil {
+		t.Errorf("Expected error for missing script")
+	}
+}
+
+func TestScriptProvenance(t *testing.T) {
+	scriptName := "test_script_provenance"
+	textSents := []text.Sentence{}
+	for _, s := range []string{"Ursprung ett.", "Ursprung två."} {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{URL: "testscriptprovenance:testsource", Paragraphs: []text.Paragraph{{Sentences: textSents}}}
+	_, sentsWithID, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	ids := []int64{sentsWithID[1].ID, sentsWithID[0].ID}
+	prov := []Provenance{
+		{ChunkID: ids[0], Step: 1, Feature: "word", Scores: map[string]float64{"word": 2}, NewValues: map[string][]string{"word": {"två", "ursprung"}}},
+		{ChunkID: ids[1], Step: 2, Feature: "word", Scores: map[string]float64{"word": 1}, NewValues: map[string][]string{"word": {"ett"}}},
+	}
+	meta := protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: scriptName}}}
+	if _, err := db.SaveScriptWithProvenance(meta, ids, prov[:1]); err == nil {
+		t.Errorf("Expected error for provenance size mismatch")
+	}
+	_, err = db.SaveScriptWithProvenance(meta, ids, prov)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	for _, name := range []string{scriptName, scriptName + "_copy"} {
+		if name != scriptName {
+			_, err = db.CreateFromSetOp(KindScript, name, SetCopy, protocol.SetOperand{Kind: KindScript, Name: scriptName})
+			if err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+		res, err := db.GetScriptProvenance(name)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if !reflect.DeepEqual(prov, res) {
+			t.Errorf("%s: expected %#v, got %#v", name, prov, res)
+		}
+	}
+}
+
+func TestLineage(t *testing.T) {
+	_, cID, err := db.InsertChunk("testlineage:testsource", "Härstamning ett.")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.conn.Exec("INSERT INTO batch (chunk_id, name) VALUES (?, ?)", cID, "test_lineage_b0")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	meta := protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: "test_lineage_s0", FromBatch: "test_lineage_b0"}}}
+	_, err = db.SaveScript(meta, cID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	s0 := protocol.SetOperand{Kind: KindScript, Name: "test_lineage_s0"}
+	_, err = db.CreateFromSetOp(KindBatch, "test_lineage_b1", SetCopy, s0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	b0 := protocol.SetOperand{Kind: KindBatch, Name: "test_lineage_b0"}
+	b1 := protocol.SetOperand{Kind: KindBatch, Name: "test_lineage_b1"}
+	lineage, err := db.Lineage(b1)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if expect := []protocol.SetOperand{b1, s0, b0}; !reflect.DeepEqual(lineage, expect) {
+		t.Errorf("Expected %#v, got %#v", expect, lineage)
+	}
+
+	pBytes, err := json.Marshal(protocol.BatchMetadata{FilterPayload: protocol.FilterPayload{BatchName: "test_lineage_b2"}, Lineage: lineage})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.SetBatchProperties("test_lineage_b2", pBytes)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	b2 := protocol.SetOperand{Kind: KindBatch, Name: "test_lineage_b2"}
+	lineage, err = db.Lineage(b2, s0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if expect := []protocol.SetOperand{b2, s0, b1, b0}; !reflect.DeepEqual(lineage, expect) {
+		t.Errorf("Expected %#v, got %#v", expect, lineage)
+	}
+
+	_, err = db.Lineage(protocol.SetOperand{Kind: KindBatch, Name: "test_lineage_missing"})
+	if err == nil {
+		t.Errorf("Expected error for missing batch")
+	}
+}
+
+func TestChunkFeatCacheConcurrent(t *testing.T) {
+	cacheDB := &DB{chunkFeatCache: map[string]map[string]int64{}}
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			value := fmt.Sprintf("v%d", id)
+			cacheDB.cacheChunkFeatIDs(map[string]map[string]int64{"test_cache_feat": {value: id}})
+			if w, g := id, cacheDB.cachedChunkFeatID("test_cache_feat", value); w != g {
+				t.Errorf("wanted %d got %d", w, g)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,277 @@
+package dbapi
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// The feats of a chunk are also stored as one compact blob in the chunk_feat_blob table, so that sentences can be loaded without joining the chunkfeat tables.
+// The blob holds the chunkfeats of the chunk, but not chunkfeat categories or count/lowest_word_freq, since these are added after ingestion.
+//
+// Encoding (all integers are varints):
+//
+//	version
+//	number of feat names
+//	  feat name length, feat name
+//	  number of values
+//	    value length, value, freq
+
+const featBlobVersion = 1
+
+func putString(buf *bytes.Buffer, s string) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], int64(len(s)))
+	buf.Write(tmp[:n])
+	buf.WriteString(s)
+}
+
+func putInt(buf *bytes.Buffer, i int) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], int64(i))
+	buf.Write(tmp[:n])
+}
+
+// encodeFeats encodes feats into a blob. Names and values are sorted, so that equal feats give equal blobs.
+func encodeFeats(feats map[string]map[string]int) []byte {
+	var buf bytes.Buffer
+	putInt(&buf, featBlobVersion)
+
+	names := make([]string, 0, len(feats))
+	for name := range feats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	putInt(&buf, len(names))
+	for _, name := range names {
+		vals := feats[name]
+		putString(&buf, name)
+
+		values := make([]string, 0, len(vals))
+		for v := range vals {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+
+		putInt(&buf, len(values))
+		for _, v := range values {
+			putString(&buf, v)
+			putInt(&buf, vals[v])
+		}
+	}
+	return buf.Bytes()
+}
+
+type featBlobReader struct {
+	r *bytes.Reader
+}
+
+func (fr featBlobReader) int() (int, error) {
+	i, err := binary.ReadVarint(fr.r)
+	return int(i), err
+}
+
+func (fr featBlobReader) string() (string, error) {
+	n, err := fr.int()
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n > fr.r.Len() {
+		return "", fmt.Errorf("invalid string length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = fr.r.Read(b)
+	return string(b), err
+}
+
+// decodeFeats decodes a blob created by encodeFeats, adding the feats to s
+func decodeFeats(blob []byte, s *text.Sentence) error {
+	fr := featBlobReader{r: bytes.NewReader(blob)}
+	version, err := fr.int()
+	if err != nil {
+		return fmt.Errorf("failed to read feat blob version : %v", err)
+	}
+	if version != featBlobVersion {
+		return fmt.Errorf("unknown feat blob version %d", version)
+	}
+
+	nNames, err := fr.int()
+	if err != nil {
+		return fmt.Errorf("failed to read feat blob : %v", err)
+	}
+	for i := 0; i < nNames; i++ {
+		name, err := fr.string()
+		if err != nil {
+			return fmt.Errorf("failed to read feat blob : %v", err)
+		}
+		nValues, err := fr.int()
+		if err != nil {
+			return fmt.Errorf("failed to read feat blob : %v", err)
+		}
+		for j := 0; j < nValues; j++ {
+			value, err := fr.string()
+			if err != nil {
+				return fmt.Errorf("failed to read feat blob : %v", err)
+			}
+			freq, err := fr.int()
+			if err != nil {
+				return fmt.Errorf("failed to read feat blob : %v", err)
+			}
+			s.AddFeatWithFreq(name, value, freq)
+		}
+	}
+	if fr.r.Len() != 0 {
+		return fmt.Errorf("failed to read feat blob : %d trailing bytes", fr.r.Len())
+	}
+	return nil
+}
+
+func insertFeatBlobTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]int) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO chunk_feat_blob (chunk_id, feats) VALUES (?, ?)`, chunkID, encodeFeats(feats))
+	if err != nil {
+		return fmt.Errorf("failed to insert chunk_feat_blob : %v", err)
+	}
+	return nil
+}
+
+// chunkFeatCatsTx returns a map from chunkfeat name and value to the chunkfeat categories of the value,
+// for the chunkfeats of the chunks in tmpTableName
+func chunkFeatCatsTx(tx *sql.Tx, tmpTableName string) (map[string]map[string][]string, error) {
+	res := make(map[string]map[string][]string)
+	rows, err := tx.Query(`SELECT chunkfeat.name, chunkfeat.value, chunkfeatcat.name FROM chunkfeat JOIN chunkfeatcat ON chunkfeat.id = chunkfeatcat.chunkfeat_id WHERE chunkfeat.id IN (SELECT chunk_chunkfeat.chunkfeat_id FROM chunk_chunkfeat WHERE chunk_chunkfeat.chunk_id IN (SELECT id FROM ` + tmpTableName + `))`)
+	if err != nil {
+		return res, fmt.Errorf("failed to query chunkfeatcat : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value, cat string
+		err := rows.Scan(&name, &value, &cat)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		if _, ok := res[name]; !ok {
+			res[name] = make(map[string][]string)
+		}
+		res[name][value] = append(res[name][value], cat)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
+
+// getSentsFromBlobsTx reads the sentences in tmpTableName that have a feat blob
+func getSentsFromBlobsTx(tx *sql.Tx, tmpTableName string, ancestors map[string][]string) (map[int64]text.Sentence, error) {
+	res := make(map[int64]text.Sentence)
+
+	cats, err := chunkFeatCatsTx(tx, tmpTableName)
+	if err != nil {
+		return res, err
+	}
+
+	q := "SELECT chunk.id, chunk.text, chunk_feat_blob.feats, COALESCE(chunk_count.lowest_word_freq, 0), (SELECT source.name FROM source, source_chunk WHERE source_chunk.chunk_id = chunk.id AND source.id = source_chunk.source_id LIMIT 1) FROM chunk JOIN chunk_feat_blob ON chunk_feat_blob.chunk_id = chunk.id LEFT JOIN chunk_count ON chunk_count.chunk_id = chunk.id WHERE chunk.id IN (SELECT id FROM " + tmpTableName + ")"
+	rows, err := tx.Query(q)
+	if err != nil {
+		return res, fmt.Errorf("failed to select from chunk_feat_blob table : %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var lowestWordFreq int
+		var chunk string
+		var source sql.NullString
+		var blob []byte
+		err := rows.Scan(&id, &chunk, &blob, &lowestWordFreq, &source)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan rows : %v", err)
+		}
+
+		s := text.Sentence{ID: id, Text: chunk, Feats: make(map[string]map[string]int), Source: source.String}
+		err = decodeFeats(blob, &s)
+		if err != nil {
+			return res, fmt.Errorf("chunk %d : %v", id, err)
+		}
+		if lowestWordFreq > 0 {
+			s.AddFeatWithFreq(text.FeatCount, text.FeatValLowestWordFreq, lowestWordFreq)
+		}
+
+		for fName, fVals := range s.Feats {
+			valCats, ok := cats[fName]
+			if !ok {
+				continue
+			}
+			for fVal, freq := range fVals {
+				for _, cat := range valCats[fVal] {
+					s.AddFeatWithFreq(cat, fVal, freq)
+					for _, a := range ancestors[cat] {
+						s.AddFeatWithFreq(a, fVal, freq)
+					}
+				}
+			}
+		}
+
+		res[id] = s
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading result row : %v", err)
+	}
+	return res, nil
+}
+
+// BuildFeatBlobs creates feat blobs from the chunkfeat tables for all chunks that don't have one (e.g. chunks in a db created before feat blobs were introduced).
+// Returns the number of blobs created.
+func (db *DB) BuildFeatBlobs(batchSize int) (int, error) {
+	n := 0
+	for {
+		rows, err := db.conn.Query(`SELECT chunk.id FROM chunk WHERE chunk.id NOT IN (SELECT chunk_id FROM chunk_feat_blob) AND chunk.id IN (SELECT chunk_id FROM chunk_chunkfeat) ORDER BY chunk.id LIMIT ?`, batchSize)
+		if err != nil {
+			return n, fmt.Errorf("failed to select chunks without feat blob : %v", err)
+		}
+		ids := []int64{}
+		for rows.Next() {
+			var id int64
+			err := rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return n, fmt.Errorf("failed to scan rows : %v", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return n, nil
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return n, fmt.Errorf("BuildFeatBlobs failed to start transaction : %v", err)
+		}
+		sents, err := db.getSentsTx(tx, false, false, ids...)
+		if err != nil {
+			tx.Rollback()
+			return n, fmt.Errorf("failed to read chunkfeats : %v", err)
+		}
+		for _, s := range sents {
+			delete(s.Feats[text.FeatCount], text.FeatValLowestWordFreq)
+			if len(s.Feats[text.FeatCount]) == 0 {
+				delete(s.Feats, text.FeatCount)
+			}
+			err = insertFeatBlobTx(tx, s.ID, s.Feats)
+			if err != nil {
+				tx.Rollback()
+				return n, err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return n, fmt.Errorf("couldn't commit transaction : %v", err)
+		}
+		n += len(sents)
+	}
+}
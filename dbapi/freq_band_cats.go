@@ -0,0 +1,107 @@
+package dbapi
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// FreqBand specifies a band of feature values, ranked by the number of chunks they occur in.
+// If Percentile is false, From and To are 1-based ranks (inclusive), e.g. From 1, To 500 for the 500 most frequent values.
+// If Percentile is true, From and To are percentiles of the ranked values (0-100), e.g. From 0, To 10 for the top 10 percent. Bands sharing a percentile, e.g. 0-10 and 10-20, don't overlap.
+type FreqBand struct {
+	FeatName   string
+	From       float64
+	To         float64
+	Percentile bool
+}
+
+func (b FreqBand) String() string {
+	if b.Percentile {
+		return fmt.Sprintf("%s %v%%-%v%%", b.FeatName, b.From, b.To)
+	}
+	return fmt.Sprintf("%s %v-%v", b.FeatName, b.From, b.To)
+}
+
+// offsetLimit returns the SQL offset and limit for the band, given the number of distinct values of the feature
+func (b FreqBand) offsetLimit(nValues int64) (int64, int64, error) {
+	if b.From < 0 || b.To < b.From {
+		return 0, 0, fmt.Errorf("invalid frequency band %s", b)
+	}
+	if b.Percentile {
+		if b.To > 100 {
+			return 0, 0, fmt.Errorf("invalid frequency band %s", b)
+		}
+		// both ends are rounded the same way, so that consecutive bands don't overlap
+		from := int64(math.Round(float64(nValues) * b.From / 100))
+		to := int64(math.Round(float64(nValues) * b.To / 100))
+		return from, to - from, nil
+	}
+	if b.From < 1 || b.From != math.Trunc(b.From) || b.To != math.Trunc(b.To) {
+		return 0, 0, fmt.Errorf("invalid frequency band %s", b)
+	}
+	return int64(b.From) - 1, int64(b.To) - int64(b.From) + 1, nil
+}
+
+// AddFreqBandChunkFeatCat ranks the values of band.FeatName according to the number of chunks they occur in,
+// and registers the values within the band as the chunkfeat category catName.
+// Any existing values of the category catName are replaced. Returns the number of values in the category.
+func (db *DB) AddFreqBandChunkFeatCat(catName string, band FreqBand) (int, error) {
+	catName = strings.ToLower(strings.TrimSpace(catName))
+	if catName == "" {
+		return 0, fmt.Errorf("AddFreqBandChunkFeatCat: empty category name")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("AddFreqBandChunkFeatCat failed to start transaction : %v", err)
+	}
+
+	var nValues int64
+	err = tx.QueryRow(`SELECT COUNT(*) FROM chunkfeat WHERE name = ?`, band.FeatName).Scan(&nValues)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to count values for feature %s : %v", band.FeatName, err)
+	}
+	if nValues == 0 {
+		tx.Rollback()
+		return 0, fmt.Errorf("no values for feature %s", band.FeatName)
+	}
+
+	offset, limit, err := band.offsetLimit(nValues)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM chunkfeatcat WHERE name = ?`, catName)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete existing category %s : %v", catName, err)
+	}
+
+	q := `INSERT INTO chunkfeatcat (name, chunkfeat_id) SELECT ?, chunk_chunkfeat.chunkfeat_id FROM chunk_chunkfeat JOIN chunkfeat ON chunkfeat.id = chunk_chunkfeat.chunkfeat_id WHERE chunkfeat.name = ? GROUP BY chunk_chunkfeat.chunkfeat_id ORDER BY COUNT(chunk_chunkfeat.chunk_id) DESC, chunk_chunkfeat.chunkfeat_id LIMIT ? OFFSET ?`
+	xRes, err := tx.Exec(q, catName, band.FeatName, limit, offset)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to insert into chunkfeatcat table : %v", err)
+	}
+	n, err := xRes.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed call to RowsAffected : %v", err)
+	}
+
+	err = clearStatsTx(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+
+	return int(n), nil
+}
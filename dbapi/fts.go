@@ -0,0 +1,156 @@
+package dbapi
+
+import (
+	"fmt"
+)
+
+// The full-text index is an FTS5 table (chunk_fts) using chunk as external content, kept in sync with the chunk table by triggers.
+// FTS5 is only available if the sqlite3 driver is built with the sqlite_fts5 tag (go build -tags sqlite_fts5), and the index is therefore not part of the db schema,
+// but created by CreateDB and Migrate when FTS5 is available (see createFTSIndex), or by BuildFTSIndex.
+// A db with a full-text index cannot be opened without FTS5, see checkFTS.
+
+// ftsSchema creates the full-text index and the triggers that keep it in sync with the chunk table.
+// Diacritics are kept, so that e.g. 'får' and 'far' are different words.
+const ftsSchema = `CREATE VIRTUAL TABLE IF NOT EXISTS chunk_fts USING fts5(text, content='chunk', content_rowid='id', tokenize='unicode61 remove_diacritics 0');
+CREATE TRIGGER IF NOT EXISTS chunk_fts_insert AFTER INSERT ON chunk BEGIN
+  INSERT INTO chunk_fts(rowid, text) VALUES (new.id, new.text);
+END;
+CREATE TRIGGER IF NOT EXISTS chunk_fts_delete AFTER DELETE ON chunk BEGIN
+  INSERT INTO chunk_fts(chunk_fts, rowid, text) VALUES ('delete', old.id, old.text);
+END;
+CREATE TRIGGER IF NOT EXISTS chunk_fts_update AFTER UPDATE OF text ON chunk BEGIN
+  INSERT INTO chunk_fts(chunk_fts, rowid, text) VALUES ('delete', old.id, old.text);
+  INSERT INTO chunk_fts(rowid, text) VALUES (new.id, new.text);
+END`
+
+// FTSAvailable returns true if the sqlite3 driver supports FTS5
+func (db *DB) FTSAvailable() (bool, error) {
+	var res bool
+	err := db.conn.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&res)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up sqlite compile options : %v", err)
+	}
+	return res, nil
+}
+
+// HasFTSIndex returns true if the full-text index has been created
+func (db *DB) HasFTSIndex() (bool, error) {
+	n, err := db.queryCount(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'chunk_fts'`)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// checkFTS returns an error if the db has a full-text index, but the sqlite3 driver doesn't support FTS5.
+// The index triggers would then make every insert, update or delete on the chunk table fail, so the db must not be used.
+func (db *DB) checkFTS() error {
+	ok, err := db.HasFTSIndex()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	ok, err = db.FTSAvailable()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("the db has a full-text index, which requires FTS5 : build with -tags sqlite_fts5")
+	}
+	return nil
+}
+
+// createFTSIndex creates and builds the full-text index if FTS5 is available and the db doesn't have one already
+func (db *DB) createFTSIndex() error {
+	ok, err := db.FTSAvailable()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	ok, err = db.HasFTSIndex()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return db.BuildFTSIndex()
+}
+
+// BuildFTSIndex creates the full-text index if it doesn't exist, and (re)builds it from the chunk table.
+// Once created, the index is updated when chunks are added, so this only has to be run once per db.
+func (db *DB) BuildFTSIndex() error {
+	ok, err := db.FTSAvailable()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("FTS5 is not available, build with -tags sqlite_fts5")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("BuildFTSIndex failed to start transaction : %v", err)
+	}
+	_, err = tx.Exec(ftsSchema)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to create full-text index : %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO chunk_fts(chunk_fts) VALUES ('rebuild')`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to build full-text index : %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return nil
+}
+
+// SearchHit is a chunk matching a full-text query
+type SearchHit struct {
+	ID   int64
+	Text string
+}
+
+// Search returns the chunks matching query, using the full-text index, with the best matches first.
+// The query uses the FTS5 syntax: words, "phrases", prefixes (foo*), and the boolean operators AND, OR and NOT.
+// A limit < 1 means no limit.
+func (db *DB) Search(query string, limit int) ([]SearchHit, error) {
+	var res []SearchHit
+
+	ok, err := db.HasFTSIndex()
+	if err != nil {
+		return res, err
+	}
+	if !ok {
+		return res, fmt.Errorf("no full-text index found, run scripttool build_fts_index")
+	}
+
+	if limit < 1 {
+		limit = -1
+	}
+	rows, err := db.conn.Query(`SELECT chunk.id, chunk.text FROM chunk_fts JOIN chunk ON chunk.id = chunk_fts.rowid WHERE chunk_fts MATCH ? ORDER BY rank LIMIT ?`, query, limit)
+	if err != nil {
+		return res, fmt.Errorf("failed to search for '%s' : %v", query, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h SearchHit
+		err := rows.Scan(&h.ID, &h.Text)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res = append(res, h)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
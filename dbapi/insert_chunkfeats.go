@@ -1,24 +1,36 @@
 package dbapi
 
 import (
-	"bufio"
-	"bytes"
 	"database/sql"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
 
 	"github.com/stts-se/wikispeech-manuscriptor/text"
 )
 
-// TODO mutex this map?
-var chunkFeatCache = map[string]map[string]int64{}
+// cachedChunkFeatID returns the cached id of the chunkfeat, or 0 if it isn't cached
+func (db *DB) cachedChunkFeatID(name, value string) int64 {
+	db.chunkFeatMutex.RLock()
+	defer db.chunkFeatMutex.RUnlock()
+	return db.chunkFeatCache[name][value]
+}
+
+// cacheChunkFeatIDs adds chunkfeat ids (chunkfeat name -> value -> id) to the cache
+func (db *DB) cacheChunkFeatIDs(ids map[string]map[string]int64) {
+	db.chunkFeatMutex.Lock()
+	defer db.chunkFeatMutex.Unlock()
+	for name, values := range ids {
+		if _, ok := db.chunkFeatCache[name]; !ok {
+			db.chunkFeatCache[name] = map[string]int64{}
+		}
+		for value, id := range values {
+			db.chunkFeatCache[name][value] = id
+		}
+	}
+}
 
-func InsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]int) error {
+// InsertChunkFeatsTx adds chunkfeats to a chunk. The feat blob of the chunk is not updated (see Add).
+func (db *DB) InsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]int) error {
 
 	var err error
 
@@ -27,7 +39,7 @@ func InsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]i
 		for fVal, freq := range fVals {
 
 			// Check if feat+val is cached
-			chunkFeatID := chunkFeatCache[fName][fVal]
+			chunkFeatID := db.cachedChunkFeatID(fName, fVal)
 			if chunkFeatID == 0 {
 				var id sql.NullInt64
 				err = tx.QueryRow("SELECT id FROM chunkfeat WHERE name = ? AND value = ?", fName, fVal).Scan(&id)
@@ -52,10 +64,7 @@ func InsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]i
 
 				}
 				// Add new chunkfeat to cache
-				if _, ok := chunkFeatCache[fName]; !ok {
-					chunkFeatCache[fName] = map[string]int64{}
-				}
-				chunkFeatCache[fName][fVal] = chunkFeatID
+				db.cacheChunkFeatIDs(map[string]map[string]int64{fName: {fVal: chunkFeatID}})
 			}
 			// Now the chunkfeat is in the db, lets add the chunk - chunkfeat relation
 
@@ -70,75 +79,74 @@ func InsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]i
 	return nil
 }
 
-const sqlite3Cmd = "sqlite3"
-
-func sqlite3CmdExists() error {
-	_, pErr := exec.LookPath(sqlite3Cmd)
-	if pErr != nil {
-		return fmt.Errorf("external '%s' command does not exist", sqlite3Cmd)
-	}
-	return nil
-}
-
-const debugBulkInsertChunkFeats = false
-
-func BulkInsertChunkFeats(dbFile string, sents ...text.Sentence) (int, error) {
+// BulkInsertChunkFeats inserts the chunkfeats of the sents (that must already be in the db, with IDs set) using a single transaction and prepared statements.
+// The feats of each sent are also saved as the chunk's feat blob, so they should be the complete chunkfeats of the chunk.
+func (db *DB) BulkInsertChunkFeats(sents ...text.Sentence) (int, error) {
 	n := 0
 
-	tx, err := Begin()
-	if err != nil {
-		return n, fmt.Errorf("failed to begin db transaction : %v", err)
-	}
-
-	err = ForeignKeysOff()
+	err := db.ForeignKeysOff()
 	if err != nil {
 		return n, fmt.Errorf("failed ForeignKeysOff : %v", err)
 	}
 
-	err = SynchronousOff()
+	err = db.SynchronousOff()
 	if err != nil {
 		return n, fmt.Errorf("failed SynchronousOff : %v", err)
 	}
 
-	err = CacheSize(10000)
+	err = db.CacheSize(10000)
 	if err != nil {
 		return n, fmt.Errorf("failed CacheSize : %v", err)
 	}
 
 	defer func() {
-		err = ForeignKeysOn()
+		err = db.ForeignKeysOn()
 		if err != nil {
 			log.Printf("Failed ForeignKeysOn : %v", err)
 		}
 
-		err = SynchronousOn()
+		err = db.SynchronousOn()
 		if err != nil {
 			log.Printf("Failed SynchronousOff : %v", err)
 		}
 	}()
 
-	// CREATE TMP BUFFER
-	tmpFN := filepath.Join(fmt.Sprintf("dbapi-bulkinsertchunkfeats-%s.tsv", text.RandomString(10)))
-	tmpFile, err := os.Create(tmpFN)
+	tx, err := db.Begin()
 	if err != nil {
-		return n, fmt.Errorf("failed to create temp file : %v", err)
+		return n, fmt.Errorf("failed to begin db transaction : %v", err)
 	}
-	if debugBulkInsertChunkFeats {
-		log.Printf("[debug] Writing tab sep to %s", tmpFile.Name())
+
+	selectFeatStmt, err := tx.Prepare("SELECT id FROM chunkfeat WHERE name = ? AND value = ?")
+	if err != nil {
+		tx.Rollback()
+		return n, fmt.Errorf("failed to prepare statement : %v", err)
 	}
-	tmpFW := bufio.NewWriter(tmpFile)
+	defer selectFeatStmt.Close()
+
+	insertFeatStmt, err := tx.Prepare("INSERT INTO chunkfeat(name, value) VALUES(?, ?)")
 	if err != nil {
-		return n, fmt.Errorf("failed to open file writer %s : %v", tmpFile.Name(), err)
+		tx.Rollback()
+		return n, fmt.Errorf("failed to prepare statement : %v", err)
 	}
-	defer func() {
-		tmpFW.Flush()
-		tmpFile.Close()
-		if !debugBulkInsertChunkFeats {
-			os.Remove(tmpFile.Name())
-		}
-	}()
+	defer insertFeatStmt.Close()
+
+	insertRelStmt, err := tx.Prepare("INSERT OR IGNORE INTO chunk_chunkfeat(chunk_id, chunkfeat_id, freq) VALUES(?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return n, fmt.Errorf("failed to prepare statement : %v", err)
+	}
+	defer insertRelStmt.Close()
+
+	insertBlobStmt, err := tx.Prepare("INSERT OR REPLACE INTO chunk_feat_blob(chunk_id, feats) VALUES(?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return n, fmt.Errorf("failed to prepare statement : %v", err)
+	}
+	defer insertBlobStmt.Close()
+
+	// chunkfeats added in this transaction are only added to the cache after commit
+	newFeats := map[string]map[string]int64{}
 
-	// LOOP
 	for _, sent := range sents {
 		for fName, fVals := range sent.Feats {
 
@@ -146,140 +154,68 @@ func BulkInsertChunkFeats(dbFile string, sents ...text.Sentence) (int, error) {
 				n++
 
 				// Check if feat+val is cached
-				chunkFeatID := chunkFeatCache[fName][fVal]
+				chunkFeatID := db.cachedChunkFeatID(fName, fVal)
+				if chunkFeatID == 0 {
+					chunkFeatID = newFeats[fName][fVal]
+				}
 				if chunkFeatID == 0 {
 					var id sql.NullInt64
-					err = tx.QueryRow("SELECT id FROM chunkfeat WHERE name = ? AND value = ?", fName, fVal).Scan(&id)
+					err = selectFeatStmt.QueryRow(fName, fVal).Scan(&id)
 					chunkFeatID = id.Int64
 
 					switch {
 					case err == sql.ErrNoRows:
-						execRes, err := tx.Exec("INSERT INTO chunkfeat(name, value) VALUES(?, ?)", fName, fVal)
+						execRes, err := insertFeatStmt.Exec(fName, fVal)
 						if err != nil {
-							//tx.Rollback()
-							return n, fmt.Errorf("failed to insert chunkfeat %s %s", fName, fVal)
+							tx.Rollback()
+							return n, fmt.Errorf("failed to insert chunkfeat %s %s : %v", fName, fVal, err)
 						}
 						chunkFeatID, err = execRes.LastInsertId()
 						if err != nil {
-							//tx.Rollback()
-							return n, fmt.Errorf("failed LastInseryId() : %v", err)
+							tx.Rollback()
+							return n, fmt.Errorf("failed LastInsertId() : %v", err)
 						}
 
 					case err != nil:
-						//tx.Rollback()
+						tx.Rollback()
 						return n, fmt.Errorf("failed QueryRow : %v", err)
 
 					}
-					// Add new chunkfeat to cache
-					if _, ok := chunkFeatCache[fName]; !ok {
-						chunkFeatCache[fName] = map[string]int64{}
+					if _, ok := newFeats[fName]; !ok {
+						newFeats[fName] = map[string]int64{}
 					}
-					chunkFeatCache[fName][fVal] = chunkFeatID
+					newFeats[fName][fVal] = chunkFeatID
 				}
 
 				// Now the chunkfeat is in the db, lets add the chunk - chunkfeat relation
-
-				// https://stackoverflow.com/questions/364017/faster-bulk-inserts-in-sqlite3
-				tmpFW.Write([]byte(fmt.Sprintf("%v\t%v\t%v\n", sent.ID, chunkFeatID, freq)))
+				_, err = insertRelStmt.Exec(sent.ID, chunkFeatID, freq)
+				if err != nil {
+					tx.Rollback()
+					return n, fmt.Errorf("failed to insert chunk_chunkfeat relation : %v", err)
+				}
 			}
 		}
-	}
-
-	// IMPORT FROM TMP BUFFER
 
-	err = tx.Commit()
-	if err != nil {
-		return n, fmt.Errorf("couldn't commit transaction : %v", err)
-	}
-
-	tmpFW.Flush()
-	tmpFile.Close()
-
-	cmdLines := []string{
-		`PRAGMA foreign_keys =OFF;`,
-		`PRAGMA synchronous = OFF;`,
-		`PRAGMA cache_size=10000;`,
-		`.mode csv`,
-		`.separator '	'`,
-		`.headers off`,
-		fmt.Sprintf(`.import %s chunk_chunkfeat`, tmpFile.Name()),
-	}
-	if sqlite3CmdExists(); err != nil {
-		return 0, err
+		_, err = insertBlobStmt.Exec(sent.ID, encodeFeats(sent.Feats))
+		if err != nil {
+			tx.Rollback()
+			return n, fmt.Errorf("failed to insert chunk_feat_blob : %v", err)
+		}
 	}
-	subProcess := exec.Command(sqlite3Cmd, dbFile)
 
-	stdin, err := subProcess.StdinPipe()
+	err = clearStatsTx(tx)
 	if err != nil {
-		return n, fmt.Errorf("failed open sqlite3 subprocess: %v", err)
+		tx.Rollback()
+		return n, err
 	}
-	defer stdin.Close()
-
-	var stderr bytes.Buffer
-	subProcess.Stdout = &stderr
-	subProcess.Stderr = &stderr
 
-	//fmt.Fprint(os.Stderr, "Importing bulk... ")
-	if err = subProcess.Start(); err != nil {
-		return n, fmt.Errorf("failed to start sqlite3 subprocess : %v", err)
-	}
-	for _, l := range cmdLines {
-		io.WriteString(stdin, fmt.Sprintf("%s\n", l))
-	}
-	stdin.Close()
-	err = subProcess.Wait()
+	err = tx.Commit()
 	if err != nil {
-		return n, fmt.Errorf("failed to run sqlite3 subprocess : %v (%v)", strings.TrimSpace(string(stderr.Bytes())), err)
+		return n, fmt.Errorf("couldn't commit transaction : %v", err)
 	}
-	//fmt.Fprintln(os.Stderr, "done")
-	return n, nil
-}
-
-func bulkInsertChunkFeatsTx(tx *sql.Tx, chunkID int64, feats map[string]map[string]int, tmpFW *bufio.Writer) error {
-
-	var err error
-
-	for fName, fVals := range feats {
-
-		for fVal, freq := range fVals {
-
-			// Check if feat+val is cached
-			chunkFeatID := chunkFeatCache[fName][fVal]
-			if chunkFeatID == 0 {
-				var id sql.NullInt64
-				err = tx.QueryRow("SELECT id FROM chunkfeat WHERE name = ? AND value = ?", fName, fVal).Scan(&id)
-				chunkFeatID = id.Int64
-
-				switch {
-				case err == sql.ErrNoRows:
-					execRes, err := tx.Exec("INSERT INTO chunkfeat(name, value)  VALUES(?, ?)", fName, fVal)
-					if err != nil {
-						//tx.Rollback()
-						return fmt.Errorf("failed to insert chunkfeat %s %s", fName, fVal)
-					}
-					chunkFeatID, err = execRes.LastInsertId()
-					if err != nil {
-						//tx.Rollback()
-						return fmt.Errorf("failed LastInserId() : %v", err)
-					}
 
-				case err != nil:
-					//tx.Rollback()
-					return fmt.Errorf("failed QueryRow : %v", err)
+	// Add new chunkfeats to cache
+	db.cacheChunkFeatIDs(newFeats)
 
-				}
-				// Add new chunkfeat to cache
-				if _, ok := chunkFeatCache[fName]; !ok {
-					chunkFeatCache[fName] = map[string]int64{}
-				}
-				chunkFeatCache[fName][fVal] = chunkFeatID
-			}
-			// Now the chunkfeat is in the db, lets add the chunk - chunkfeat relation
-
-			// https://stackoverflow.com/questions/364017/faster-bulk-inserts-in-sqlite3
-			tmpFW.Write([]byte(fmt.Sprintf("%v\t%v\t%v\n", chunkID, chunkFeatID, freq)))
-		}
-	}
-
-	return nil
+	return n, nil
 }
@@ -0,0 +1,82 @@
+package dbapi
+
+import (
+	"fmt"
+
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+)
+
+// parents returns the batches and scripts that the batch or script (of kind KindBatch or KindScript) was created from,
+// according to its properties. A batch or script without properties has no known parents.
+func (db *DB) parents(o protocol.SetOperand) ([]protocol.SetOperand, error) {
+	var res []protocol.SetOperand
+	_, propsTable, err := kindTables(o.Kind)
+	if err != nil {
+		return res, err
+	}
+	var n int64
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM `+propsTable+` WHERE name = ?`, o.Name).Scan(&n)
+	if err != nil {
+		return res, fmt.Errorf("failed to look up %s properties : %v", o.Kind, err)
+	}
+	if n == 0 {
+		return res, nil
+	}
+
+	if o.Kind == KindBatch {
+		meta, err := db.GetBatchProperties(o.Name)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, meta.Lineage...)
+		if meta.SetOp != nil {
+			res = append(res, meta.SetOp.Operands...)
+		}
+	} else {
+		meta, err := db.GetScriptProperties(o.Name)
+		if err != nil {
+			return res, err
+		}
+		if meta.Options.FromBatch != "" {
+			res = append(res, protocol.SetOperand{Kind: KindBatch, Name: meta.Options.FromBatch})
+		}
+		if meta.SetOp != nil {
+			res = append(res, meta.SetOp.Operands...)
+		}
+	}
+	return res, nil
+}
+
+// Lineage returns the batches and scripts in from, followed by all the batches and scripts they were created from, nearest first.
+// Returns an error if any batch or script in from doesn't exist.
+func (db *DB) Lineage(from ...protocol.SetOperand) ([]protocol.SetOperand, error) {
+	res := []protocol.SetOperand{}
+
+	for _, o := range from {
+		exists, err := db.Exists(o.Kind, o.Name)
+		if err != nil {
+			return res, err
+		}
+		if !exists {
+			return res, fmt.Errorf("no %s named %s", o.Kind, o.Name)
+		}
+	}
+
+	seen := map[protocol.SetOperand]bool{}
+	queue := append([]protocol.SetOperand{}, from...)
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+		if seen[o] {
+			continue
+		}
+		seen[o] = true
+		res = append(res, o)
+		parents, err := db.parents(o)
+		if err != nil {
+			return res, fmt.Errorf("failed to read lineage of %s %s : %v", o.Kind, o.Name, err)
+		}
+		queue = append(queue, parents...)
+	}
+	return res, nil
+}
@@ -0,0 +1,144 @@
+package dbapi
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades a db from version-1 to version
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+func execMigration(schema string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(schema)
+		return err
+	}
+}
+
+const schemaVersionSchema = `CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL PRIMARY KEY, description TEXT NOT NULL, timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP)`
+
+// migrations is the ordered list of schema migrations. Version 1 is the schema before versioning was introduced.
+// New migrations are appended at the end, and schema_sqlite.sql should be updated accordingly (TestMigrate checks that the schemas are equal).
+var migrations = []migration{
+	{version: 1, description: "initial schema"},
+	{version: 2, description: "chunkfeatcat_parent table", up: execMigration(`CREATE TABLE IF NOT EXISTS chunkfeatcat_parent(name TEXT NOT NULL, parent TEXT NOT NULL, UNIQUE(name, parent));
+CREATE INDEX IF NOT EXISTS chunkfeatcat_parent_parent ON chunkfeatcat_parent(parent);`)},
+	{version: 3, description: "stats table", up: execMigration(`CREATE TABLE IF NOT EXISTS stats(id INTEGER NOT NULL PRIMARY KEY, stats TEXT NOT NULL, timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP)`)},
+	{version: 4, description: "chunk_count table", up: execMigration(chunkCountSchema + ";\n" + chunkCountBackfill)},
+	{version: 5, description: "chunk_feat_blob table", up: execMigration(`CREATE TABLE IF NOT EXISTS chunk_feat_blob(chunk_id INTEGER NOT NULL PRIMARY KEY, feats BLOB NOT NULL, foreign key (chunk_id) references chunk(id) ON DELETE CASCADE)`)},
+	{version: 6, description: "block_info table", up: execMigration(`CREATE TABLE IF NOT EXISTS block_info(chunk_id INTEGER NOT NULL PRIMARY KEY, reason TEXT NOT NULL DEFAULT '', blocked_by TEXT NOT NULL DEFAULT '', timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, foreign key (chunk_id) references chunk(id) ON DELETE CASCADE);
+CREATE INDEX IF NOT EXISTS block_info_reason ON block_info(reason);`)},
+	{version: 7, description: "chunk_edit table and script.modified column", up: execMigration(`CREATE TABLE IF NOT EXISTS chunk_edit(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, chunk_id INTEGER NOT NULL, old_text TEXT NOT NULL, new_text TEXT NOT NULL, edited_by TEXT NOT NULL DEFAULT '', comment TEXT NOT NULL DEFAULT '', timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, foreign key (chunk_id) references chunk(id) ON DELETE CASCADE);
+CREATE INDEX IF NOT EXISTS chunk_edit_chunk_id ON chunk_edit(chunk_id);
+ALTER TABLE script ADD COLUMN modified INTEGER NOT NULL DEFAULT 0;`)},
+	{version: 8, description: "oplog table", up: execMigration(`CREATE TABLE IF NOT EXISTS oplog(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, operation TEXT NOT NULL, names TEXT NOT NULL DEFAULT '[]', rows INTEGER NOT NULL DEFAULT 0, user TEXT NOT NULL DEFAULT '', config TEXT NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS oplog_operation ON oplog(operation);`)},
+	{version: 9, description: "script.position column", up: execMigration(`ALTER TABLE script ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS script_name_position ON script(name, position);`)},
+	{version: 10, description: "script.provenance column", up: execMigration(`ALTER TABLE script ADD COLUMN provenance TEXT NOT NULL DEFAULT '';`)},
+	{version: 11, description: "chunk_count.source_freq column", up: execMigration(sourceFreqMigration)},
+}
+
+// LatestSchemaVersion returns the schema version expected by this version of dbapi
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the schema version of the db. A db created before schema versioning has version 1.
+func (db *DB) SchemaVersion() (int, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up schema_version table : %v", err)
+	}
+	if n == 0 {
+		return 1, nil
+	}
+
+	var version sql.NullInt64
+	err = db.conn.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version : %v", err)
+	}
+	if !version.Valid {
+		return 1, nil
+	}
+	return int(version.Int64), nil
+}
+
+// checkSchemaVersion returns an error if the db schema version differs from LatestSchemaVersion
+func (db *DB) checkSchemaVersion() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := LatestSchemaVersion()
+	if version < latest {
+		return fmt.Errorf("db schema version %d is older than the current version %d, run scripttool migrate to upgrade the db", version, latest)
+	}
+	if version > latest {
+		return fmt.Errorf("db schema version %d is newer than the latest known version %d", version, latest)
+	}
+	return nil
+}
+
+// Migrate upgrades the db schema to LatestSchemaVersion, running each migration in a separate transaction.
+// The full-text index is created if the sqlite3 driver supports FTS5 and the db has none.
+// Returns the schema version before and after migration.
+func (db *DB) Migrate() (int, int, error) {
+	from, err := db.SchemaVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > LatestSchemaVersion() {
+		return from, from, fmt.Errorf("db schema version %d is newer than the latest known version %d", from, LatestSchemaVersion())
+	}
+
+	current := from
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return from, current, fmt.Errorf("Migrate failed to start transaction : %v", err)
+		}
+
+		_, err = tx.Exec(schemaVersionSchema)
+		if err != nil {
+			tx.Rollback()
+			return from, current, fmt.Errorf("failed to create schema_version table : %v", err)
+		}
+
+		if m.up != nil {
+			err = m.up(tx)
+			if err != nil {
+				tx.Rollback()
+				return from, current, fmt.Errorf("migration to version %d (%s) failed : %v", m.version, m.description, err)
+			}
+		}
+
+		_, err = tx.Exec(`INSERT INTO schema_version (version, description) VALUES (?, ?)`, m.version, m.description)
+		if err != nil {
+			tx.Rollback()
+			return from, current, fmt.Errorf("failed to insert into schema_version table : %v", err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return from, current, fmt.Errorf("couldn't commit transaction : %v", err)
+		}
+		current = m.version
+	}
+
+	err = db.createFTSIndex()
+	if err != nil {
+		return from, current, err
+	}
+	return from, current, nil
+}
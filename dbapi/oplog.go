@@ -0,0 +1,132 @@
+package dbapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Operations changing batches, scripts, blocked sentences or sentence texts are recorded in the oplog table,
+// so that it is possible to see how the db got into its current state.
+
+// Operation names used in the oplog
+const (
+	OpFilter         = "filter"
+	OpDeleteBatches  = "delete_batches"
+	OpDeleteScripts  = "delete_scripts"
+	OpSaveScript     = "save_script"
+	OpBlock          = "block"
+	OpUnblock        = "unblock"
+	OpCorrectSent    = "correct_sent"
+	OpCreateBatch    = "create_batch"
+	OpCreateScript   = "create_script"
+	OpRenameBatch    = "rename_batch"
+	OpRenameScript   = "rename_script"
+	OpTruncateScript = "truncate_script"
+)
+
+// OpLogEntry is an operation recorded in the oplog
+type OpLogEntry struct {
+	ID        int64           `json:"id"`
+	Timestamp string          `json:"timestamp"`
+	Operation string          `json:"operation"`
+	Names     []string        `json:"names"` // names of the affected batches or scripts
+	Rows      int64           `json:"rows"`  // number of affected rows (typically sentences)
+	User      string          `json:"user,omitempty"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// SetUser sets the user recorded in the oplog for subsequent operations
+func (db *DB) SetUser(user string) {
+	db.user = user
+}
+
+// LogOpTx records an operation in the oplog. config is saved as JSON, and can be nil.
+func (db *DB) LogOpTx(tx *sql.Tx, operation string, names []string, rows int64, config interface{}) error {
+	if names == nil {
+		names = []string{}
+	}
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return fmt.Errorf("failed to marshal oplog names : %v", err)
+	}
+	var configJSON []byte
+	if config != nil {
+		configJSON, err = json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("failed to marshal oplog config : %v", err)
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO oplog (operation, names, rows, user, config) VALUES (?, ?, ?, ?, ?)`, operation, string(namesJSON), rows, db.user, string(configJSON))
+	if err != nil {
+		return fmt.Errorf("failed to insert into oplog : %v", err)
+	}
+	return nil
+}
+
+// OpLogQuery selects oplog entries. Empty fields match all entries.
+type OpLogQuery struct {
+	Operation string
+	Name      string // batch or script name
+	Limit     int    // return the Limit latest entries
+}
+
+// ListOpLog returns the oplog entries matching q, oldest first
+func (db *DB) ListOpLog(q OpLogQuery) ([]OpLogEntry, error) {
+	res := []OpLogEntry{}
+
+	query := `SELECT id, timestamp, operation, names, rows, user, config FROM oplog WHERE 1`
+	args := []interface{}{}
+	if q.Operation != "" {
+		query += ` AND operation = ?`
+		args = append(args, q.Operation)
+	}
+	if q.Name != "" {
+		query += ` AND EXISTS (SELECT 1 FROM json_each(oplog.names) WHERE json_each.value = ?)`
+		args = append(args, q.Name)
+	}
+	query += ` ORDER BY id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return res, fmt.Errorf("failed to query oplog : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e OpLogEntry
+		var names, config string
+		err := rows.Scan(&e.ID, &e.Timestamp, &e.Operation, &names, &e.Rows, &e.User, &config)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		err = json.Unmarshal([]byte(names), &e.Names)
+		if err != nil {
+			return res, fmt.Errorf("failed to unmarshal oplog names : %v", err)
+		}
+		if config != "" {
+			e.Config = json.RawMessage(config)
+		}
+		res = append(res, e)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+
+	// oldest first
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+func interfaces2strings(is []interface{}) []string {
+	res := []string{}
+	for _, i := range is {
+		res = append(res, fmt.Sprint(i))
+	}
+	return res
+}
@@ -0,0 +1,45 @@
+package dbapi
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Provenance describes why a sentence was selected for a script
+type Provenance struct {
+	ChunkID   int64               `json:"chunk_id"`
+	Step      int                 `json:"step"`       // the (1-based) selection step in which the sentence was selected
+	Feature   string              `json:"feature"`    // the feature deciding the selection
+	Scores    map[string]float64  `json:"scores"`     // the score of each feature in the selection step
+	NewValues map[string][]string `json:"new_values"` // the values of each feature that were new to the script
+}
+
+// GetScriptProvenance returns the selection provenance of the sentences of a script, in selection order.
+// Sentences without provenance (e.g. from scripts saved before provenance was introduced) are skipped.
+func (db *DB) GetScriptProvenance(scriptName string) ([]Provenance, error) {
+	res := []Provenance{}
+	rows, err := db.conn.Query("SELECT chunk_id, provenance FROM script WHERE name = ? AND provenance != '' "+scriptOrder, scriptName)
+	if err != nil {
+		return res, fmt.Errorf("failed to query script table : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var prov string
+		err := rows.Scan(&id, &prov)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		var p Provenance
+		err = json.Unmarshal([]byte(prov), &p)
+		if err != nil {
+			return res, fmt.Errorf("failed to unmarshal provenance of chunk %d : %v", id, err)
+		}
+		p.ChunkID = id
+		res = append(res, p)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
@@ -1,4 +1,14 @@
 
+-- schema_version records the migrations applied to the db, see migrations.go.
+-- A db without this table was created before schema versioning (version 1).
+CREATE TABLE IF NOT EXISTS schema_version(
+       version INTEGER NOT NULL PRIMARY KEY,
+       description TEXT NOT NULL,
+       timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+       );
+
+-- This schema corresponds to the latest migration in migrations.go. CreateDB records the version, see LatestSchemaVersion.
+
 -- Source is the text (article, etc) from which a text chunk is from.
 -- INSERT INTO source (name) VALUES('source name...');
 CREATE TABLE IF NOT EXISTS source(
@@ -75,6 +85,17 @@ CREATE INDEX IF NOT EXISTS chunkfeatcat_name ON chunkfeatcat(name);
 CREATE UNIQUE INDEX IF NOT EXISTS chunkfeatcat_name_cfid ON chunkfeatcat(name, chunkfeat_id);
 CREATE INDEX IF NOT EXISTS chunkfeatcat_cfid ON chunkfeatcat(chunkfeat_id);
 
+-- chunkfeatcat_parent declares a parent category for a chunkfeatcat category.
+-- A parent category matches all chunkfeats of its descendant categories.
+-- Example: chunkfeatcat se_place -> parent place
+CREATE TABLE IF NOT EXISTS chunkfeatcat_parent(
+       name TEXT NOT NULL,
+       parent TEXT NOT NULL,
+       UNIQUE(name, parent)
+);
+
+CREATE INDEX IF NOT EXISTS chunkfeatcat_parent_parent ON chunkfeatcat_parent(parent);
+
 CREATE TABLE IF NOT EXISTS source_chunk(
 	     source_id INTEGER NOT NULL,
 	     chunk_id INTEGER NOT NULL,
@@ -127,9 +148,15 @@ CREATE UNIQUE INDEX IF NOT EXISTS batch_id_name ON batch(chunk_id, name);
 CREATE INDEX IF NOT EXISTS batch_name ON batch(name);
 CREATE INDEX IF NOT EXISTS batch_chunkid ON batch(chunk_id);
 
+-- modified is set to 1 when the text of the chunk is corrected after the script was created
+-- position is the (1-based) order in which the chunk was selected, 0 for scripts saved before positions were introduced
+-- provenance is JSON describing why the chunk was selected (see Provenance in dbapi), empty if unknown
 CREATE TABLE IF NOT EXISTS script(
              chunk_id INTEGER NOT NULL,
        	     name TEXT NOT NULL,
+             modified INTEGER NOT NULL DEFAULT 0,
+             position INTEGER NOT NULL DEFAULT 0,
+             provenance TEXT NOT NULL DEFAULT '',
 	     UNIQUE(chunk_id, name),
              FOREIGN KEY (chunk_id) REFERENCES chunk(id) ON DELETE CASCADE
 );
@@ -137,6 +164,7 @@ CREATE TABLE IF NOT EXISTS script(
 CREATE UNIQUE INDEX IF NOT EXISTS script_id_name ON script(chunk_id, name);
 CREATE INDEX IF NOT EXISTS script_name ON script(name);
 CREATE INDEX IF NOT EXISTS script_chunkid ON script(chunk_id);
+CREATE INDEX IF NOT EXISTS script_name_position ON script(name, position);
 
 -- Example query for generating an ordered frequency list (takes some time):
 -- select chunk_chunkfeat.chunkfeat_id, count(*) from chunk_chunkfeat, chunkfeat where chunkfeat.name = "word" and chunkfeat.id = chunk_chunkfeat.chunkfeat_id group by chunk_chunkfeat.chunkfeat_id order by count(chunk_chunkfeat.chunk_id) DESC;
@@ -155,10 +183,85 @@ CREATE INDEX IF NOT EXISTS wordfreq_freq_chunkfeat_id_indx ON wordfreq(freq, chu
 CREATE INDEX IF NOT EXISTS wordfreq_freq_id_indx ON wordfreq(freq);
 CREATE INDEX IF NOT EXISTS wordfreq_id_chunkfeat_id_indx_2 ON wordfreq(chunkfeat_id);
 
+-- chunk_count holds pre-computed counts for each chunk, used by the filter.
+-- Filled in when chunks are added, except lowest_word_freq, which is set after the corpus has been loaded (see InsertLowestWordFreqForChunk).
+-- source_freq is the number of sources containing the chunk, updated when the chunk is added to another source.
+CREATE TABLE IF NOT EXISTS chunk_count(
+       chunk_id INTEGER NOT NULL PRIMARY KEY,
+       word_count INTEGER NOT NULL DEFAULT 0,
+       comma_count INTEGER NOT NULL DEFAULT 0,
+       digit_count INTEGER NOT NULL DEFAULT 0,
+       char_count INTEGER NOT NULL DEFAULT 0,
+       lowest_word_freq INTEGER NOT NULL DEFAULT 0,
+       source_freq INTEGER NOT NULL DEFAULT 0,
+       foreign key (chunk_id) references chunk(id) ON DELETE CASCADE
+       );
+
+CREATE INDEX IF NOT EXISTS chunk_count_word_count ON chunk_count(word_count);
+CREATE INDEX IF NOT EXISTS chunk_count_comma_count ON chunk_count(comma_count);
+CREATE INDEX IF NOT EXISTS chunk_count_digit_count ON chunk_count(digit_count);
+CREATE INDEX IF NOT EXISTS chunk_count_char_count ON chunk_count(char_count);
+CREATE INDEX IF NOT EXISTS chunk_count_lowest_word_freq ON chunk_count(lowest_word_freq);
+CREATE INDEX IF NOT EXISTS chunk_count_source_freq ON chunk_count(source_freq);
+
+-- stats caches db statistics as JSON, see stats.go (a single row, id 1)
+CREATE TABLE IF NOT EXISTS stats(
+       id INTEGER NOT NULL PRIMARY KEY,
+       stats TEXT NOT NULL,
+       timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+       );
+
+-- chunk_feat_blob holds the chunkfeats of each chunk encoded as one blob, see feat_blob.go.
+-- Used for fast loading of sentences, while the chunkfeat tables are used for filtering.
+CREATE TABLE IF NOT EXISTS chunk_feat_blob(
+       chunk_id INTEGER NOT NULL PRIMARY KEY,
+       feats BLOB NOT NULL,
+       foreign key (chunk_id) references chunk(id) ON DELETE CASCADE
+       );
+
+-- block_info holds the reason for blocking a sentence (blocked sentences are in the batch named 'blocked'), see block.go
+CREATE TABLE IF NOT EXISTS block_info(
+       chunk_id INTEGER NOT NULL PRIMARY KEY,
+       reason TEXT NOT NULL DEFAULT '',
+       blocked_by TEXT NOT NULL DEFAULT '',
+       timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+       foreign key (chunk_id) references chunk(id) ON DELETE CASCADE
+       );
+
+CREATE INDEX IF NOT EXISTS block_info_reason ON block_info(reason);
+
+-- chunk_edit holds the text corrections of chunks, see correct.go
+CREATE TABLE IF NOT EXISTS chunk_edit(
+       id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+       chunk_id INTEGER NOT NULL,
+       old_text TEXT NOT NULL,
+       new_text TEXT NOT NULL,
+       edited_by TEXT NOT NULL DEFAULT '',
+       comment TEXT NOT NULL DEFAULT '',
+       timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+       foreign key (chunk_id) references chunk(id) ON DELETE CASCADE
+       );
+
+CREATE INDEX IF NOT EXISTS chunk_edit_chunk_id ON chunk_edit(chunk_id);
+
+-- oplog records operations changing batches, scripts, blocked sentences and sentence texts, see oplog.go
+-- names is a JSON array of the affected batch/script names, config is JSON
+CREATE TABLE IF NOT EXISTS oplog(
+       id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+       timestamp TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+       operation TEXT NOT NULL,
+       names TEXT NOT NULL DEFAULT '[]',
+       rows INTEGER NOT NULL DEFAULT 0,
+       user TEXT NOT NULL DEFAULT '',
+       config TEXT NOT NULL DEFAULT ''
+       );
+
+CREATE INDEX IF NOT EXISTS oplog_operation ON oplog(operation);
+
 ----- VIEWS
+-- The filter uses the pre-computed counts in chunk_count instead of these views
 
 CREATE VIEW IF NOT EXISTS chunk_wordcount_view AS SELECT chunk.*, chunk_chunkfeat.freq freq FROM  chunk, chunkfeat, chunk_chunkfeat WHERE chunk.id = chunk_chunkfeat.chunk_id AND chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = 'count' AND chunkfeat.value = 'word_count';
--- TODO Pre-compute word count to make things snappier?
 --CREATE VIEW IF NOT EXISTS chunk_wordcount_view AS SELECT chunk.*, COALESCE(SUM(NUMWORD.freq), 0) freq FROM chunk LEFT JOIN (SELECT chunk_chunkfeat.freq, c.id FROM chunkfeat, chunk_chunkfeat, chunk AS c WHERE chunkfeat.name = 'word' AND chunkfeat.id = chunk_chunkfeat.chunkfeat_id AND chunk_chunkfeat.chunk_id = c.id) NUMWORD ON chunk.id = NUMWORD.id GROUP BY chunk.id;
 
 
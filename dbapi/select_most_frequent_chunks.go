@@ -10,15 +10,16 @@ type Chunk struct {
 	ID   int64
 }
 
-var chunkFreqQuery = `SELECT chunk.id, chunk.text, COUNT(source.id) sfreq FROM source, chunk, source_chunk WHERE chunk.id = source_chunk.chunk_id AND source.id = source_chunk.source_id GROUP BY chunk.id ORDER BY sfreq DESC LIMIT ?`
+var chunkFreqQuery = `SELECT chunk.id, chunk.text, chunk_count.source_freq FROM chunk JOIN chunk_count ON chunk.id = chunk_count.chunk_id ORDER BY chunk_count.source_freq DESC, chunk.id LIMIT ?`
 
 // SelectMostFrequentChunks lists the chunks in the DB sorted
 // according to in how many sources (articles) they occur in. It is
-// useful mostly for diagnostic purposes.
-func SelectMostFrequentChunks(limit int) ([]Chunk, error) {
+// useful mostly for diagnostic purposes. The frequency is read from
+// the pre-computed chunk_count.source_freq column.
+func (db *DB) SelectMostFrequentChunks(limit int) ([]Chunk, error) {
 	var res []Chunk
 
-	rows, err := db.Query(chunkFreqQuery, limit)
+	rows, err := db.conn.Query(chunkFreqQuery, limit)
 	if err != nil {
 		return res, fmt.Errorf("SelectMostFrequentChunks failed query DB : %v", err)
 	}
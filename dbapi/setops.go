@@ -0,0 +1,389 @@
+package dbapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// Set operations create a batch or script from existing batches and scripts
+
+// Set operation names
+const (
+	SetUnion     = "union"
+	SetIntersect = "intersect"
+	SetDiff      = "diff" // the first operand minus all the other operands
+	SetCopy      = "copy"
+)
+
+// Kinds of set operands
+const (
+	KindBatch  = "batch"
+	KindScript = "script"
+)
+
+var setOperators = map[string]string{
+	SetUnion:     "UNION",
+	SetIntersect: "INTERSECT",
+	SetDiff:      "EXCEPT",
+	SetCopy:      "UNION",
+}
+
+func kindTables(kind string) (string, string, error) {
+	switch kind {
+	case KindBatch:
+		return "batch", "batch_properties", nil
+	case KindScript:
+		return "script", "script_properties", nil
+	default:
+		return "", "", fmt.Errorf("unknown kind '%s', expected %s or %s", kind, KindBatch, KindScript)
+	}
+}
+
+// existsTx returns true if there is a batch or script with the name, with sentences or properties
+func existsTx(tx *sql.Tx, kind, name string) (bool, error) {
+	table, propsTable, err := kindTables(kind)
+	if err != nil {
+		return false, err
+	}
+	var n int64
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM `+table+` WHERE name = ?) + (SELECT COUNT(*) FROM `+propsTable+` WHERE name = ?)`, name, name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s %s : %v", kind, name, err)
+	}
+	return n > 0, nil
+}
+
+// Exists returns true if there is a batch or script (of kind KindBatch or KindScript) with the name, with sentences or properties
+func (db *DB) Exists(kind, name string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("Exists failed to begin db transaction : %v", err)
+	}
+	res, err := existsTx(tx, kind, name)
+	if err != nil {
+		tx.Rollback()
+		return res, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return res, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return res, nil
+}
+
+// CreateFromSetOp creates the batch or script target (of kind KindBatch or KindScript) from the sentences of the operands, using the set operation op.
+// Blocked sentences are not included. Returns the number of sentences in the created batch or script.
+func (db *DB) CreateFromSetOp(kind, target, op string, operands ...protocol.SetOperand) (int, error) {
+	table, _, err := kindTables(kind)
+	if err != nil {
+		return 0, err
+	}
+	operator, ok := setOperators[op]
+	if !ok {
+		return 0, fmt.Errorf("unknown set operation '%s'", op)
+	}
+	if op == SetCopy && len(operands) != 1 {
+		return 0, fmt.Errorf("%s requires exactly one operand, found %d", op, len(operands))
+	}
+	if len(operands) == 0 {
+		return 0, fmt.Errorf("%s requires at least one operand", op)
+	}
+	if target == "" || target == text.BlockBatch {
+		return 0, fmt.Errorf("invalid %s name '%s'", kind, target)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("CreateFromSetOp failed to begin db transaction : %v", err)
+	}
+
+	exists, err := existsTx(tx, kind, target)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if exists {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s %s already exists", kind, target)
+	}
+
+	var selects []string
+	args := []interface{}{target}
+	names := []string{target}
+	for _, o := range operands {
+		oTable, _, err := kindTables(o.Kind)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		exists, err := existsTx(tx, o.Kind, o.Name)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if !exists {
+			tx.Rollback()
+			return 0, fmt.Errorf("no %s named %s", o.Kind, o.Name)
+		}
+		selects = append(selects, `SELECT chunk_id FROM `+oTable+` WHERE name = ?`)
+		args = append(args, o.Name)
+		names = append(names, o.Name)
+	}
+	args = append(args, text.BlockBatch)
+
+	q := `INSERT INTO ` + table + ` (chunk_id, name) SELECT chunk_id, ? FROM (` + strings.Join(selects, " "+operator+" ") + `) WHERE chunk_id NOT IN (SELECT chunk_id FROM batch WHERE name = ?)`
+	if kind == KindScript {
+		// keep the selection order and provenance of the first operand if it is a script, followed by the other sentences in chunk id order
+		firstJoin := `LEFT JOIN script s ON 0`
+		if operands[0].Kind == KindScript {
+			firstJoin = `LEFT JOIN script s ON s.name = ? AND s.chunk_id = ops.chunk_id`
+			args = append(args[:len(args)-1], operands[0].Name, text.BlockBatch)
+		}
+		q = `INSERT INTO script (chunk_id, name, position, provenance) SELECT ops.chunk_id, ?, ROW_NUMBER() OVER (ORDER BY s.position IS NULL, s.position, ops.chunk_id), COALESCE(s.provenance, '') FROM (` + strings.Join(selects, " "+operator+" ") + `) ops ` + firstJoin + ` WHERE ops.chunk_id NOT IN (SELECT chunk_id FROM batch WHERE name = ?)`
+	}
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to create %s %s : %v", kind, target, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
+
+	setOp := &protocol.SetOperation{Operation: op, Operands: operands}
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	var props interface{}
+	var logOp string
+	if kind == KindBatch {
+		props = protocol.BatchMetadata{FilterPayload: protocol.FilterPayload{BatchName: target}, OutputSize: int(n), Timestamp: timestamp, SetOp: setOp}
+		logOp = OpCreateBatch
+	} else {
+		props = protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: target}}, OutputSize: int(n), Timestamp: timestamp, SetOp: setOp}
+		logOp = OpCreateScript
+	}
+	pBytes, err := json.Marshal(props)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to marshal %s properties : %v", kind, err)
+	}
+	if kind == KindBatch {
+		err = db.SetBatchPropertiesTx(tx, target, pBytes)
+	} else {
+		err = db.SetScriptPropertiesTx(tx, target, pBytes)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to save %s properties : %v", kind, err)
+	}
+
+	err = db.LogOpTx(tx, logOp, names, n, setOp)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return int(n), nil
+}
+
+// Rename renames a batch or script (of kind KindBatch or KindScript), updating the name in its properties,
+// and the references to it in the properties of other batches and scripts (see renameReferencesTx).
+func (db *DB) Rename(kind, from, to string) error {
+	table, propsTable, err := kindTables(kind)
+	if err != nil {
+		return err
+	}
+	if from == text.BlockBatch || to == "" || to == text.BlockBatch {
+		return fmt.Errorf("cannot rename %s %s to '%s'", kind, from, to)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Rename failed to begin db transaction : %v", err)
+	}
+
+	exists, err := existsTx(tx, kind, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !exists {
+		tx.Rollback()
+		return fmt.Errorf("no %s named %s", kind, from)
+	}
+	exists, err = existsTx(tx, kind, to)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if exists {
+		tx.Rollback()
+		return fmt.Errorf("%s %s already exists", kind, to)
+	}
+
+	res, err := tx.Exec(`UPDATE `+table+` SET name = ? WHERE name = ?`, to, from)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to rename %s : %v", kind, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
+
+	var pBytes []byte
+	err = tx.QueryRow(`SELECT properties FROM `+propsTable+` WHERE name = ?`, from).Scan(&pBytes)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		tx.Rollback()
+		return fmt.Errorf("failed to read %s properties : %v", kind, err)
+	default:
+		if kind == KindBatch {
+			var meta protocol.BatchMetadata
+			err = json.Unmarshal(pBytes, &meta)
+			meta.BatchName = to
+			if err == nil {
+				pBytes, err = json.Marshal(meta)
+			}
+		} else {
+			var meta protocol.ScriptMetadata
+			err = json.Unmarshal(pBytes, &meta)
+			meta.Options.ScriptName = to
+			if err == nil {
+				pBytes, err = json.Marshal(meta)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update %s properties : %v", kind, err)
+		}
+		_, err = tx.Exec(`UPDATE `+propsTable+` SET name = ?, properties = ? WHERE name = ?`, to, pBytes, from)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to rename %s properties : %v", kind, err)
+		}
+	}
+
+	err = renameReferencesTx(tx, kind, from, to)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	logOp := OpRenameBatch
+	if kind == KindScript {
+		logOp = OpRenameScript
+	}
+	err = db.LogOpTx(tx, logOp, []string{from, to}, n, nil)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	return nil
+}
+
+// renameReferencesTx replaces references to the batch or script from with to in the properties of all batches and scripts:
+// the batch a script was selected from, the operands of set operations, and batch lineage.
+// Saved filter configs are kept as they were run.
+func renameReferencesTx(tx *sql.Tx, kind, from, to string) error {
+	old := protocol.SetOperand{Kind: kind, Name: from}
+	renameOperands := func(operands []protocol.SetOperand) bool {
+		changed := false
+		for i, o := range operands {
+			if o == old {
+				operands[i].Name = to
+				changed = true
+			}
+		}
+		return changed
+	}
+
+	for _, propsKind := range []string{KindBatch, KindScript} {
+		_, propsTable, err := kindTables(propsKind)
+		if err != nil {
+			return err
+		}
+		props := map[string][]byte{}
+		rows, err := tx.Query(`SELECT name, properties FROM ` + propsTable)
+		if err != nil {
+			return fmt.Errorf("failed to read %s properties : %v", propsKind, err)
+		}
+		for rows.Next() {
+			var name string
+			var pBytes []byte
+			err = rows.Scan(&name, &pBytes)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row : %v", err)
+			}
+			props[name] = pBytes
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("error when reading db result row : %v", err)
+		}
+
+		for name, pBytes := range props {
+			changed := false
+			if propsKind == KindBatch {
+				var meta protocol.BatchMetadata
+				err = json.Unmarshal(pBytes, &meta)
+				if err != nil {
+					return fmt.Errorf("failed to unmarshal properties of batch %s : %v", name, err)
+				}
+				changed = renameOperands(meta.Lineage)
+				if meta.SetOp != nil && renameOperands(meta.SetOp.Operands) {
+					changed = true
+				}
+				if changed {
+					pBytes, err = json.Marshal(meta)
+				}
+			} else {
+				var meta protocol.ScriptMetadata
+				err = json.Unmarshal(pBytes, &meta)
+				if err != nil {
+					return fmt.Errorf("failed to unmarshal properties of script %s : %v", name, err)
+				}
+				if kind == KindBatch && meta.Options.FromBatch == from {
+					meta.Options.FromBatch = to
+					changed = true
+				}
+				if meta.SetOp != nil && renameOperands(meta.SetOp.Operands) {
+					changed = true
+				}
+				if changed {
+					pBytes, err = json.Marshal(meta)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("failed to marshal properties of %s %s : %v", propsKind, name, err)
+			}
+			if !changed {
+				continue
+			}
+			_, err = tx.Exec(`UPDATE `+propsTable+` SET properties = ? WHERE name = ?`, pBytes, name)
+			if err != nil {
+				return fmt.Errorf("failed to update properties of %s %s : %v", propsKind, name, err)
+			}
+		}
+	}
+	return nil
+}
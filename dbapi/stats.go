@@ -0,0 +1,230 @@
+package dbapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// Stats holds db statistics. Blocked, Batches and Scripts are computed on each call to GetStats, the other fields are cached in the stats table (see RefreshStats).
+// The cache is cleared when chunks, chunkfeats or chunkfeat categories are added or changed.
+type Stats struct {
+	DBName      string         `json:"db_name,omitempty"`
+	ComputedAt  string         `json:"computed_at,omitempty"` // timestamp of the cached stats
+	Chunks      int64          `json:"chunks"`
+	Sources     int64          `json:"sources"`
+	ChunkFeats  int64          `json:"chunk_feats"`
+	WordForms   int64          `json:"word_forms"`
+	MaxWordFreq int64          `json:"max_wordfreq"`
+	Blocked     int64          `json:"blocked"`
+	Batches     map[string]int `json:"batches"`
+	Scripts     map[string]int `json:"scripts"`
+
+	// SentLengths is a histogram of sentence lengths: number of words -> number of chunks
+	SentLengths map[int]int64 `json:"sent_lengths"`
+	// SourcesPerChunk is a histogram of the number of sources a chunk occurs in -> number of chunks
+	SourcesPerChunk map[int]int64 `json:"sources_per_chunk"`
+	// FeatValues is the number of distinct values per chunkfeat name
+	FeatValues map[string]int64 `json:"feat_values"`
+	// Categories holds the coverage of each chunkfeat category
+	Categories map[string]CategoryStats `json:"categories"`
+}
+
+// CategoryStats holds the number of feature values in a chunkfeat category, and the number of chunks with at least one of these values
+type CategoryStats struct {
+	Values int64 `json:"values"`
+	Chunks int64 `json:"chunks"`
+}
+
+func (db *DB) queryCount(q string, args ...interface{}) (int64, error) {
+	var n sql.NullInt64
+	err := db.conn.QueryRow(q, args...).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed query '%s' : %v", q, err)
+	}
+	return n.Int64, nil
+}
+
+func (db *DB) queryHistogram(q string, args ...interface{}) (map[int]int64, error) {
+	res := make(map[int]int64)
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return res, fmt.Errorf("failed query '%s' : %v", q, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k int
+		var n int64
+		err := rows.Scan(&k, &n)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res[k] = n
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
+
+func (db *DB) queryNameCounts(q string, args ...interface{}) (map[string]int64, error) {
+	res := make(map[string]int64)
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return res, fmt.Errorf("failed query '%s' : %v", q, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var n int64
+		err := rows.Scan(&name, &n)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res[name] = n
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
+
+// ComputeStats computes the cachable statistics of the db. Blocked, Batches and Scripts are not included.
+func (db *DB) ComputeStats() (Stats, error) {
+	res := Stats{ComputedAt: time.Now().Format("2006-01-02 15:04:05")}
+	var err error
+
+	res.Chunks, err = db.queryCount(`SELECT COUNT(*) FROM chunk`)
+	if err != nil {
+		return res, err
+	}
+	res.Sources, err = db.queryCount(`SELECT COUNT(*) FROM source`)
+	if err != nil {
+		return res, err
+	}
+	res.ChunkFeats, err = db.queryCount(`SELECT COUNT(*) FROM chunkfeat`)
+	if err != nil {
+		return res, err
+	}
+	res.WordForms, err = db.queryCount(`SELECT COUNT(*) FROM chunkfeat WHERE chunkfeat.name = ?`, text.FeatWord)
+	if err != nil {
+		return res, err
+	}
+	res.MaxWordFreq, err = db.queryCount(`SELECT MAX(wordfreq.freq) FROM wordfreq`)
+	if err != nil {
+		return res, err
+	}
+	res.SentLengths, err = db.queryHistogram(`SELECT chunk_chunkfeat.freq, COUNT(*) FROM chunk_chunkfeat, chunkfeat WHERE chunk_chunkfeat.chunkfeat_id = chunkfeat.id AND chunkfeat.name = ? AND chunkfeat.value = ? GROUP BY chunk_chunkfeat.freq`, text.FeatCount, text.FeatValWordCount)
+	if err != nil {
+		return res, err
+	}
+	res.SourcesPerChunk, err = db.queryHistogram(`SELECT n, COUNT(*) FROM (SELECT COUNT(*) n FROM source_chunk GROUP BY chunk_id) GROUP BY n`)
+	if err != nil {
+		return res, err
+	}
+	res.FeatValues, err = db.queryNameCounts(`SELECT name, COUNT(*) FROM chunkfeat GROUP BY name`)
+	if err != nil {
+		return res, err
+	}
+
+	catValues, err := db.queryNameCounts(`SELECT name, COUNT(*) FROM chunkfeatcat GROUP BY name`)
+	if err != nil {
+		return res, err
+	}
+	catChunks, err := db.queryNameCounts(`SELECT chunkfeatcat.name, COUNT(DISTINCT chunk_chunkfeat.chunk_id) FROM chunkfeatcat, chunk_chunkfeat WHERE chunkfeatcat.chunkfeat_id = chunk_chunkfeat.chunkfeat_id GROUP BY chunkfeatcat.name`)
+	if err != nil {
+		return res, err
+	}
+	res.Categories = make(map[string]CategoryStats)
+	for name, n := range catValues {
+		res.Categories[name] = CategoryStats{Values: n, Chunks: catChunks[name]}
+	}
+
+	return res, nil
+}
+
+// RefreshStats computes the db statistics and saves them in the stats table
+func (db *DB) RefreshStats() (Stats, error) {
+	res, err := db.ComputeStats()
+	if err != nil {
+		return res, fmt.Errorf("failed to compute stats : %v", err)
+	}
+	bts, err := json.Marshal(res)
+	if err != nil {
+		return res, fmt.Errorf("failed to marshal stats : %v", err)
+	}
+	_, err = db.conn.Exec(`INSERT OR REPLACE INTO stats (id, stats) VALUES (1, ?)`, string(bts))
+	if err != nil {
+		return res, fmt.Errorf("failed to save stats : %v", err)
+	}
+	return res, nil
+}
+
+// clearStatsTx deletes the stats saved by RefreshStats, so that they are recomputed by the next call to GetStats
+func clearStatsTx(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM stats WHERE id = 1`)
+	if err != nil {
+		return fmt.Errorf("failed to clear stats : %v", err)
+	}
+	return nil
+}
+
+// cachedStats returns the stats saved by RefreshStats, and false if there are none
+func (db *DB) cachedStats() (Stats, bool, error) {
+	res := Stats{}
+	var s string
+	err := db.conn.QueryRow(`SELECT stats FROM stats WHERE id = 1`).Scan(&s)
+	if err == sql.ErrNoRows {
+		return res, false, nil
+	}
+	if err != nil {
+		return res, false, fmt.Errorf("failed to read stats : %v", err)
+	}
+	err = json.Unmarshal([]byte(s), &res)
+	if err != nil {
+		return res, false, fmt.Errorf("failed to unmarshal stats : %v", err)
+	}
+	return res, true, nil
+}
+
+// GetStats returns the cached db statistics, refreshing them if there are none, along with the current number of blocked sentences and batch and script sizes
+func (db *DB) GetStats() (Stats, error) {
+	res, ok, err := db.cachedStats()
+	if err != nil {
+		return res, err
+	}
+	if !ok {
+		res, err = db.RefreshStats()
+		if err != nil {
+			return res, err
+		}
+	}
+
+	res.Blocked, err = db.queryCount(`SELECT COUNT(*) FROM batch WHERE name = ?`, text.BlockBatch)
+	if err != nil {
+		return res, err
+	}
+
+	batches, err := db.queryNameCounts("SELECT name, count(name) FROM batch group by name")
+	if err != nil {
+		return res, fmt.Errorf("failed to read batches : %v", err)
+	}
+	res.Batches = make(map[string]int)
+	for b, c := range batches {
+		res.Batches[b] = int(c)
+	}
+
+	scripts, err := db.queryNameCounts("SELECT name, count(name) FROM script group by name")
+	if err != nil {
+		return res, fmt.Errorf("failed to read scripts : %v", err)
+	}
+	res.Scripts = make(map[string]int)
+	for s, c := range scripts {
+		res.Scripts[s] = int(c)
+	}
+
+	return res, nil
+}
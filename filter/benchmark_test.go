@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// Run with: go test ./filter -run XXX -bench .
+
+var benchDbPath = "tst_manuscript_filter_bench.db"
+
+var benchWords = strings.Fields("det bor en del stockholmare i området många städer finns parker kända personer från staden ligger inte långt bort vid havet")
+
+// createBenchDB creates a db with a synthetic corpus of n sentences
+func createBenchDB(b *testing.B, n int) *dbapi.DB {
+	os.RemoveAll(benchDbPath)
+	benchDB, err := dbapi.CreateDB(benchDbPath)
+	if err != nil {
+		b.Fatalf("failed to create db '%s' : %v", benchDbPath, err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	sents := []text.Sentence{}
+	for i := 0; i < n; i++ {
+		ws := []string{}
+		for j := 0; j < 3+r.Intn(20); j++ {
+			w := benchWords[r.Intn(len(benchWords))]
+			if r.Intn(10) == 0 {
+				w += ","
+			}
+			if r.Intn(20) == 0 {
+				w = fmt.Sprintf("%d", r.Intn(2000))
+			}
+			ws = append(ws, w)
+		}
+		sents = append(sents, text.ComputeSentence(fmt.Sprintf("%s %d.", strings.Join(ws, " "), i)))
+		if len(sents) == 1000 || i == n-1 {
+			a := text.Article{
+				URL:        fmt.Sprintf("benchmark:source%d", i),
+				Paragraphs: []text.Paragraph{{Sentences: sents}},
+			}
+			_, _, err := benchDB.Add(a, true)
+			if err != nil {
+				b.Fatalf("Add went wrong : %v", err)
+			}
+			sents = []text.Sentence{}
+		}
+	}
+	return benchDB
+}
+
+const benchViewQuery = `SELECT COUNT(DISTINCT chunk.id) FROM chunk JOIN chunk_wordcount_view ON chunk.id = chunk_wordcount_view.id AND chunk_wordcount_view.freq >= ? AND chunk_wordcount_view.freq <= ? JOIN chunk_commacount_view ON chunk.id = chunk_commacount_view.id AND chunk_commacount_view.freq >= ? AND chunk_commacount_view.freq <= ? JOIN chunk_digitcount_view ON chunk.id = chunk_digitcount_view.id AND chunk_digitcount_view.freq = ?`
+
+func benchCountQuery(b *testing.B, benchDB *dbapi.DB, query string, args []interface{}) int64 {
+	rows, err := benchDB.ExecQuery(query, args)
+	if err != nil {
+		b.Fatalf("query failed : %v", err)
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		rows.Scan(&n)
+	}
+	return n
+}
+
+// BenchmarkCountFilter compares filtering on word, comma and digit counts using the aggregating views and using the pre-computed chunk_count table
+func BenchmarkCountFilter(b *testing.B) {
+	benchDB := createBenchDB(b, 10000)
+	defer os.RemoveAll(benchDbPath)
+	defer benchDB.Close()
+
+	qb, err := newFilterQueryBuilder(
+		func(qb *queryBuilder) { qb.head = `SELECT COUNT(DISTINCT chunk.id) FROM chunk` },
+		wordCount(4, 12),
+		commaCount(0, 1),
+		nDigitCount(0),
+	)
+	if err != nil {
+		b.Fatalf("couldn't create query builder : %v", err)
+	}
+	chunkCountQuery, chunkCountArgs := qb.query()
+	viewArgs := []interface{}{4, 12, 0, 1, 0}
+
+	if w, g := benchCountQuery(b, benchDB, benchViewQuery, viewArgs), benchCountQuery(b, benchDB, chunkCountQuery, chunkCountArgs); w != g {
+		b.Fatalf("expected the same number of chunks for views and chunk_count, got %d and %d", w, g)
+	}
+
+	b.Run("views", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchCountQuery(b, benchDB, benchViewQuery, viewArgs)
+		}
+	})
+	b.Run("chunk_count", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchCountQuery(b, benchDB, chunkCountQuery, chunkCountArgs)
+		}
+	})
+}
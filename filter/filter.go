@@ -1,15 +1,19 @@
 package filter
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
 )
 
 const debug = true
 
-func ExecQuery(qb *queryBuilder) (int64, error) {
+// ExecQuery executes the query built by qb on db
+func ExecQuery(db *dbapi.DB, qb *queryBuilder) (int64, error) {
 	var res int64
 
 	qString, args := qb.query()
@@ -20,21 +24,62 @@ func ExecQuery(qb *queryBuilder) (int64, error) {
 		fmt.Fprintf(os.Stderr, "[filter] Populated query %s\n", qb.populatedQueryString())
 	}
 
-	tx, err := dbapi.Begin()
+	tx, err := db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("failed to begin transaction : %v", err)
 	}
 
-	result, err := tx.Exec(qString, args...)
-	if err != nil {
-		tx.Rollback()
-		return res, fmt.Errorf("failed to execute query %v: %v", qString, err)
+	if len(qb.checks) > 0 {
+		// with Go predicates, the query selects the sentences to check, and the ids passing the checks are inserted while the query runs,
+		// insertBatchSize at a time, until the target size is reached
+		var ids []int64
+		var nPassed int
+		insert := func() error {
+			n, err := insertIntoBatchTx(tx, qb.batchName, ids)
+			res += n
+			ids = ids[:0]
+			return err
+		}
+		err = streamPredicates(db, tx, qString, args, qb.checks, func(s text.Sentence) (bool, error) {
+			ids = append(ids, s.ID)
+			nPassed++
+			if len(ids) >= insertBatchSize {
+				err := insert()
+				if err != nil {
+					return false, err
+				}
+			}
+			return qb.limit <= 0 || nPassed < qb.limit, nil
+		})
+		if err == nil && len(ids) > 0 {
+			err = insert()
+		}
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to run go predicates : %v", err)
+		}
+	} else {
+		result, err := tx.Exec(qString, args...)
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed to execute query %v: %v", qString, err)
+		}
+
+		res, err = result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return res, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+		}
 	}
 
-	res, err = result.RowsAffected()
+	names := []string{}
+	if qb.batchName != "" {
+		names = append(names, qb.batchName)
+	}
+	err = db.LogOpTx(tx, dbapi.OpFilter, names, res, qb.config)
 	if err != nil {
 		tx.Rollback()
-		return res, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+		return res, err
 	}
 
 	err = tx.Commit()
@@ -44,6 +89,28 @@ func ExecQuery(qb *queryBuilder) (int64, error) {
 	return res, nil
 }
 
+// insertBatchSize is the max number of chunk ids inserted into a batch by a single statement
+const insertBatchSize = 500
+
+// insertIntoBatchTx inserts the chunk ids into the batch batchName, in order. Returns the number of inserted rows.
+func insertIntoBatchTx(tx *sql.Tx, batchName string, ids []int64) (int64, error) {
+	values := make([]string, len(ids))
+	args := []interface{}{}
+	for i, id := range ids {
+		values[i] = "(?, ?)"
+		args = append(args, id, batchName)
+	}
+	result, err := tx.Exec(`INSERT OR IGNORE INTO batch (chunk_id, name) VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert into batch : %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed RowsAffected call to query Result : %v", err)
+	}
+	return n, nil
+}
+
 // func FilterFeatCatFromBatchIntoBatch(fromBatch, toBatch, excludeBatch, featName string, n int) (int64, error) {
 // 	opts := []opt{
 // 		filterQHeadInto(toBatch),
@@ -63,10 +130,10 @@ func ExecQuery(qb *queryBuilder) (int64, error) {
 // func BasicFilterIntoBatch(toBatch, excludeBatch string, n int) (int64, error) {
 // 	opts := []opt{
 // 		filterQHeadInto(toBatch),
-// 		wordCountView(4, 25),
-// 		commaCountView(0, 3),
-// 		nDigitCountView(0),
-// 		lowestWordFreqCountView(2),
+// 		wordCount(4, 25),
+// 		commaCount(0, 3),
+// 		nDigitCount(0),
+// 		lowestWordFreqCount(2),
 // 		//excludePuncts(";"),
 // 		excludeChunkRE(`[\p{Greek}]`),
 // 		excludeChunkRE(`[^a-zA-ZåäöÅÄÖéÉüÜ0-9 ,$€£@.!?/()"':—–-]`),
@@ -1,13 +1,15 @@
 package filter
 
 import (
-	//"fmt"
+	"fmt"
 
 	"encoding/json"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
@@ -17,6 +19,8 @@ import (
 
 var testDbPath = "tst_manuscript_filter.db"
 
+var db *dbapi.DB
+
 func init() {
 
 	log.Println("INITIALISING filter TESTS")
@@ -25,7 +29,7 @@ func init() {
 		log.Printf("failed to remove test file '%s' : %v", testDbPath, err)
 	}
 
-	err = dbapi.CreateDB(testDbPath, path.Join("..", "dbapi", "schema_sqlite.sql"))
+	db, err = dbapi.CreateDB(testDbPath)
 	if err != nil {
 		log.Fatalf("failed to create db '%s' : %v", testDbPath, err)
 	}
@@ -61,7 +65,7 @@ func TestFilter1(t *testing.T) {
 	}
 
 	// add sents
-	aID, _, err := dbapi.Add(a, true)
+	aID, _, err := db.Add(a, true)
 	if err != nil {
 		t.Errorf("Add went wrong : %v", err)
 		return
@@ -89,7 +93,7 @@ func TestFilter1(t *testing.T) {
 		return
 	}
 
-	n, err := ExecQuery(filterQueryBuilder)
+	n, err := ExecQuery(db, filterQueryBuilder)
 	if err != nil {
 		t.Errorf("Couldn't exec query : %v", err)
 	}
@@ -101,15 +105,181 @@ func TestFilter1(t *testing.T) {
 		t.Errorf("failed to marshal filter metadata : %v", err)
 		return
 	}
-	err = dbapi.SetBatchProperties(filterConfig.BatchName, pBytes)
+	err = db.SetBatchProperties(filterConfig.BatchName, pBytes)
 	if err != nil {
 		t.Errorf("failed to save batch properties : %v", err)
 		return
 	}
 
-	rows, err := dbapi.ExecQuery("SELECT chunk.text FROM chunk, batch WHERE batch.name = ? AND chunk.id = batch.chunk_id", []interface{}{batchName})
+	rows, err := db.ExecQuery("SELECT chunk.text FROM chunk, batch WHERE batch.name = ? AND chunk.id = batch.chunk_id ORDER BY chunk.id", []interface{}{batchName})
+	if err != nil {
+		t.Errorf("failed to read batches : %v", err)
+	}
+	gotSents := []string{}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		gotSents = append(gotSents, name)
+	}
+	if !reflect.DeepEqual(expectBatch, gotSents) {
+		t.Errorf("Expected %v, got %v", expectBatch, gotSents)
+	}
+
+}
+
+func TestFilterParentChunkFeatCat(t *testing.T) {
+	batchName := "test_batch_parent_cat"
+	sents := []string{
+		"Kalle bor numera i Visbyholm",
+		"Lisa reste till Lvivograd igår",
+		"Det regnar mycket idag",
+	}
+	expectBatch := []string{
+		"Kalle bor numera i Visbyholm",
+		"Lisa reste till Lvivograd igår",
+	}
+
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterparentcat:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_se_place", FeatValue: "visbyholm"},
+		{TargetFeatName: "test_int_place", FeatValue: "lvivograd"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCatParents([]dbapi.ChunkFeatCatParent{
+		{Name: "test_se_place", Parent: "test_place"},
+		{Name: "test_int_place", Parent: "test_place"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	filterConfig := protocol.FilterPayload{
+		BatchName:  batchName,
+		TargetSize: 100,
+		Opts: []protocol.FilterOpt{
+			{Name: ChunkFeatCats, Args: []string{"test_place"}},
+		},
+	}
+	filterQueryBuilder, err := NewQueryBuilder(filterConfig)
+	if err != nil {
+		t.Errorf("Couldn't create query builder : %v", err)
+		return
+	}
+	_, err = ExecQuery(db, filterQueryBuilder)
+	if err != nil {
+		t.Errorf("Couldn't exec query : %v", err)
+		return
+	}
+
+	rows, err := db.ExecQuery("SELECT chunk.text FROM chunk, batch WHERE batch.name = ? AND chunk.id = batch.chunk_id ORDER BY chunk.id", []interface{}{batchName})
+	if err != nil {
+		t.Errorf("failed to read batches : %v", err)
+		return
+	}
+	gotSents := []string{}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		gotSents = append(gotSents, name)
+	}
+	if !reflect.DeepEqual(expectBatch, gotSents) {
+		t.Errorf("Expected %v, got %v", expectBatch, gotSents)
+	}
+
+	ops, err := db.ListOpLog(dbapi.OpLogQuery{Name: batchName})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(ops) != 1 || ops[0].Operation != dbapi.OpFilter || ops[0].Rows != int64(len(expectBatch)) {
+		t.Errorf("Unexpected oplog %#v", ops)
+	}
+}
+
+func TestFilterTextMatch(t *testing.T) {
+	ok, err := db.FTSAvailable()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !ok {
+		t.Skip("FTS5 not available, run tests with -tags sqlite_fts5")
+	}
+	err = db.BuildFTSIndex()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	batchName := "test_batch_text_match"
+	sents := []string{
+		"Tåget till Fyrbyholm går i dag",
+		"Fyrbyholmsborna åker tåg idag",
+		"Fyrbyholm har inget tåg i morgon",
+		"Det går en buss till Fyrbyholm",
+	}
+	expectBatch := []string{
+		"Tåget till Fyrbyholm går i dag",
+		"Fyrbyholmsborna åker tåg idag",
+	}
+
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfiltertextmatch:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	// added after the index was built, to check that it is kept in sync
+	_, _, err = db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	filterConfig := protocol.FilterPayload{
+		BatchName:  batchName,
+		TargetSize: 100,
+		Opts: []protocol.FilterOpt{
+			{Name: TextMatch, Args: []string{`fyrbyholm* AND ("i dag" OR idag)`}},
+		},
+	}
+	filterQueryBuilder, err := NewQueryBuilder(filterConfig)
+	if err != nil {
+		t.Errorf("Couldn't create query builder : %v", err)
+		return
+	}
+	_, err = ExecQuery(db, filterQueryBuilder)
+	if err != nil {
+		t.Errorf("Couldn't exec query : %v", err)
+		return
+	}
+
+	rows, err := db.ExecQuery("SELECT chunk.text FROM chunk, batch WHERE batch.name = ? AND chunk.id = batch.chunk_id ORDER BY chunk.id", []interface{}{batchName})
 	if err != nil {
 		t.Errorf("failed to read batches : %v", err)
+		return
 	}
 	gotSents := []string{}
 	for rows.Next() {
@@ -120,5 +290,944 @@ func TestFilter1(t *testing.T) {
 	if !reflect.DeepEqual(expectBatch, gotSents) {
 		t.Errorf("Expected %v, got %v", expectBatch, gotSents)
 	}
+}
+
+func batchTexts(t *testing.T, batchName string) []string {
+	res := []string{}
+	rows, err := db.ExecQuery("SELECT chunk.text FROM chunk, batch WHERE batch.name = ? AND chunk.id = batch.chunk_id ORDER BY chunk.id", []interface{}{batchName})
+	if err != nil {
+		t.Errorf("failed to read batches : %v", err)
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		res = append(res, s)
+	}
+	return res
+}
+
+func TestFilterExpr(t *testing.T) {
+	sents := []string{
+		"Fotbollsmatchen i Ekeby slutade oavgjort",
+		"Regnovädret drog in över Ekeby",
+		"Fotbollsmatchen hos Ekbergsson blev inställd",
+		"Ekeby har ingen idrottsplats alls, tyvärr",
+		"Ekeby har ingen simhall eller ishall",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterexpr:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_expr_sports", FeatValue: "fotbollsmatchen"},
+		{TargetFeatName: "test_expr_weather", FeatValue: "regnovädret"},
+		{TargetFeatName: "test_expr_surname", FeatValue: "ekbergsson"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	cat := func(name string) protocol.FilterExpr {
+		return protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: ChunkFeatCats, Args: []string{name}}}
+	}
+	wordCount := func(min, max string) protocol.FilterExpr {
+		return protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: WordCount, Args: []string{min, max}}}
+	}
+	commaCount := func(min, max string) protocol.FilterExpr {
+		return protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: CommaCount, Args: []string{min, max}}}
+	}
+
+	for _, test := range []struct {
+		batchName string
+		opts      []protocol.FilterOpt
+		expr      protocol.FilterExpr
+		expect    []string
+	}{
+		// (sports OR weather) AND NOT surname
+		{
+			batchName: "test_batch_expr_1",
+			expr: protocol.FilterExpr{And: []protocol.FilterExpr{
+				{Or: []protocol.FilterExpr{cat("test_expr_sports"), cat("test_expr_weather")}},
+				{Not: &protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: ChunkFeatCats, Args: []string{"test_expr_surname"}}}},
+			}},
+			expect: sents[0:2],
+		},
+		// word_count 5-5 OR (word_count 6-6 AND comma_count 1-1), with exclude_batches before other opts
+		{
+			batchName: "test_batch_expr_2",
+			opts: []protocol.FilterOpt{
+				{Name: ExcludeBatches, Args: []string{"test_batch_expr_1"}},
+				{Name: DigitCount, Args: []string{"0"}},
+			},
+			expr: protocol.FilterExpr{Or: []protocol.FilterExpr{
+				wordCount("5", "5"),
+				{And: []protocol.FilterExpr{wordCount("6", "6"), commaCount("1", "1")}},
+			}},
+			expect: sents[2:4],
+		},
+	} {
+		filterConfig := protocol.FilterPayload{
+			BatchName:  test.batchName,
+			TargetSize: 100,
+			Opts:       append([]protocol.FilterOpt{{Name: SourceRE, Args: []string{"^testfilterexpr:"}}}, test.opts...),
+			Expr:       &test.expr,
+		}
+		filterQueryBuilder, err := NewQueryBuilder(filterConfig)
+		if err != nil {
+			t.Errorf("Couldn't create query builder : %v", err)
+			return
+		}
+		_, err = ExecQuery(db, filterQueryBuilder)
+		if err != nil {
+			t.Errorf("Couldn't exec query : %v", err)
+			return
+		}
+		if got := batchTexts(t, test.batchName); !reflect.DeepEqual(test.expect, got) {
+			t.Errorf("%s: expected %v, got %v", test.batchName, test.expect, got)
+		}
+	}
+
+	// invalid expressions
+	for _, expr := range []protocol.FilterExpr{
+		{},
+		{Opt: &protocol.FilterOpt{Name: WordCount, Args: []string{"1", "2"}}, Not: &protocol.FilterExpr{}},
+		{Or: []protocol.FilterExpr{{Opt: &protocol.FilterOpt{Name: "no_such_opt"}}}},
+	} {
+		_, err := NewQueryBuilder(protocol.FilterPayload{BatchName: "test_batch_expr_invalid", Expr: &expr})
+		if err == nil {
+			t.Errorf("Expected error for filter expression %#v", expr)
+		}
+	}
+}
+
+func TestFilterWordsAndRE(t *testing.T) {
+	sents := []string{
+		"Snöovädret i Norrby fortsätter",
+		"Regnet öser ner över Norrby",
+		"norrby har fått nya Snöplogar",
+		"Familjen Snöbergsson bor i Norrby",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterwordsandre:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_words_surname", FeatValue: "snöbergsson"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		batchName string
+		opt       protocol.FilterOpt
+		expect    []string
+	}{
+		{"test_batch_require_re", protocol.FilterOpt{Name: RequireChunkRE, Args: []string{`^[A-ZÅÄÖ]`}}, []string{sents[0], sents[1], sents[3]}},
+		{"test_batch_require_words", protocol.FilterOpt{Name: RequireWords, Args: []string{"Snöovädret", "snöplogar", "hagel"}}, []string{sents[0], sents[2]}},
+		{"test_batch_exclude_words", protocol.FilterOpt{Name: ExcludeWords, Args: []string{"regnet", "Familjen"}}, []string{sents[0], sents[2]}},
+		{"test_batch_exclude_cats", protocol.FilterOpt{Name: ExcludeChunkFeatCats, Args: []string{"test_words_surname"}}, sents[0:3]},
+	} {
+		filterConfig := protocol.FilterPayload{
+			BatchName:  test.batchName,
+			TargetSize: 100,
+			Opts: []protocol.FilterOpt{
+				{Name: SourceRE, Args: []string{"^testfilterwordsandre:"}},
+				test.opt,
+			},
+		}
+		filterQueryBuilder, err := NewQueryBuilder(filterConfig)
+		if err != nil {
+			t.Errorf("Couldn't create query builder : %v", err)
+			return
+		}
+		_, err = ExecQuery(db, filterQueryBuilder)
+		if err != nil {
+			t.Errorf("Couldn't exec query : %v", err)
+			return
+		}
+		if got := batchTexts(t, test.batchName); !reflect.DeepEqual(test.expect, got) {
+			t.Errorf("%s: expected %v, got %v", test.batchName, test.expect, got)
+		}
+	}
+
+	_, err = NewQueryBuilder(protocol.FilterPayload{BatchName: "test_batch_no_words", Opts: []protocol.FilterOpt{{Name: RequireWords}}})
+	if err == nil {
+		t.Errorf("Expected error for %s without words", RequireWords)
+	}
+}
+
+func TestFilterChunkFeatCatHits(t *testing.T) {
+	sents := []string{
+		"Målvakten räddade straffen i derbyt",
+		"Målvakten bor i Västerby",
+		"Det snöade över Västerby",
+		"Straffen kom i snöovädret",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterchunkfeatcathits:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_hits_sports", FeatValue: "målvakten"},
+		{TargetFeatName: "test_hits_sports", FeatValue: "straffen"},
+		{TargetFeatName: "test_hits_sports", FeatValue: "derbyt"},
+		{TargetFeatName: "test_hits_place", FeatValue: "västerby"},
+		{TargetFeatName: "test_hits_weather", FeatValue: "snöade"},
+		{TargetFeatName: "test_hits_weather", FeatValue: "snöovädret"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	for _, test := range []struct {
+		batchName string
+		args      []string
+		expect    []string
+	}{
+		{"test_batch_hits_min", []string{"test_hits_sports", "min_hits=2"}, sents[0:1]},
+		{"test_batch_hits_max", []string{"test_hits_sports", "max_hits=1"}, []string{sents[1], sents[3]}},
+		{"test_batch_hits_all", []string{"test_hits_place", "test_hits_weather", "match=all"}, sents[2:3]},
+		{"test_batch_hits_all2", []string{"test_hits_sports", "test_hits_weather", "match=all"}, sents[3:4]},
+		{"test_batch_hits_any", []string{"test_hits_place", "test_hits_weather", "min_hits=2", "match=any"}, sents[2:3]},
+	} {
+		filterConfig := protocol.FilterPayload{
+			BatchName:  test.batchName,
+			TargetSize: 100,
+			Opts: []protocol.FilterOpt{
+				{Name: SourceRE, Args: []string{"^testfilterchunkfeatcathits:"}},
+				{Name: ChunkFeatCats, Args: test.args},
+			},
+		}
+		filterQueryBuilder, err := NewQueryBuilder(filterConfig)
+		if err != nil {
+			t.Errorf("Couldn't create query builder : %v", err)
+			return
+		}
+		_, err = ExecQuery(db, filterQueryBuilder)
+		if err != nil {
+			t.Errorf("Couldn't exec query : %v", err)
+			return
+		}
+		if got := batchTexts(t, test.batchName); !reflect.DeepEqual(test.expect, got) {
+			t.Errorf("%s: expected %v, got %v", test.batchName, test.expect, got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"test_hits_sports", "min_hits=0"},
+		{"test_hits_sports", "min_hits=3", "max_hits=2"},
+		{"test_hits_sports", "match=some"},
+		{"min_hits=2"},
+	} {
+		_, err := NewQueryBuilder(protocol.FilterPayload{BatchName: "test_batch_hits_invalid", Opts: []protocol.FilterOpt{{Name: ChunkFeatCats, Args: args}}})
+		if err == nil {
+			t.Errorf("Expected error for %s args %v", ChunkFeatCats, args)
+		}
+	}
+}
+
+func TestFilterPreview(t *testing.T) {
+	sents := []string{
+		"Förhandsvisningen i Österby började sent",
+		"Förhandsvisningen i Österby slutade tidigt",
+		"Österby saknar biograf",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterpreview:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	batchName := "test_batch_preview"
+	filterConfig := protocol.FilterPayload{
+		BatchName:  batchName,
+		TargetSize: 1,
+		Opts: []protocol.FilterOpt{
+			{Name: SourceRE, Args: []string{"^testfilterpreview:"}},
+			{Name: RequireWords, Args: []string{"förhandsvisningen"}},
+		},
+	}
+	res, err := Preview(db, filterConfig, 5)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if res.Count != 2 || res.OutputSize != 1 || len(res.Sample) != 2 {
+		t.Errorf("Unexpected preview %#v", res)
+	}
+	for _, s := range res.Sample {
+		if s.Text != sents[0] && s.Text != sents[1] {
+			t.Errorf("Unexpected sample sentence %#v", s)
+		}
+	}
+
+	res, err = Preview(db, filterConfig, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if res.Count != 2 || len(res.Sample) != 0 {
+		t.Errorf("Unexpected preview %#v", res)
+	}
+
+	// no batch is created
+	if got := batchTexts(t, batchName); len(got) != 0 {
+		t.Errorf("Expected empty batch, got %v", got)
+	}
+
+	// with sampling, the preview shows the sentences of the batch
+	filterConfig.Opts = []protocol.FilterOpt{{Name: SourceRE, Args: []string{"^testfilterpreview:"}}}
+	filterConfig.TargetSize = 2
+	filterConfig.Sampling = &protocol.Sampling{Mode: SampleRandom, Seed: 7}
+	res, err = Preview(db, filterConfig, 5)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	qb, err := NewQueryBuilder(filterConfig)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = ExecQuery(db, qb)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	var got []string
+	for _, s := range res.Sample {
+		got = append(got, s.Text)
+	}
+	sort.Strings(got)
+	expect := batchTexts(t, batchName)
+	sort.Strings(expect)
+	if res.Count != 3 || !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected preview of %v, got %#v", expect, res)
+	}
+}
+
+func TestFilterFunnel(t *testing.T) {
+	sents := []string{
+		"Trattens första mening om Västerby",
+		"Trattens andra mening om Västerby",
+		"Västerby har en tratt",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL: "testfilterfunnel:testsource",
+		Paragraphs: []text.Paragraph{
+			{Sentences: textSents},
+		},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	total, err := countChunks(db, nil, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	filterConfig := protocol.FilterPayload{
+		BatchName:  "test_batch_funnel",
+		TargetSize: 10,
+		Opts: []protocol.FilterOpt{
+			{Name: SourceRE, Args: []string{"^testfilterfunnel:"}},
+			{Name: RequireWords, Args: []string{"trattens"}},
+		},
+		Expr: &protocol.FilterExpr{Not: &protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: RequireWords, Args: []string{"andra"}}}},
+	}
+	funnel, err := Funnel(db, filterConfig)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	expect := []protocol.FunnelStep{
+		{Criterion: SourceRE, Args: []string{"^testfilterfunnel:"}, Remaining: 3, RejectedAlone: total - 3},
+		{Criterion: RequireWords, Args: []string{"trattens"}, Remaining: 2, RejectedAlone: total - 2},
+		{Criterion: FunnelExpr, Remaining: 1, RejectedAlone: 1},
+	}
+	if !reflect.DeepEqual(funnel, expect) {
+		t.Errorf("Expected %#v, got %#v", expect, funnel)
+	}
+}
+
+func TestFilterSampling(t *testing.T) {
+	var articles []text.Article
+	for _, src := range []string{"a", "b", "c"} {
+		textSents := []text.Sentence{}
+		for i := 1; i <= 3; i++ {
+			textSents = append(textSents, text.ComputeSentence(fmt.Sprintf("Urvalsmening nummer %d från källa %s", i, src)))
+		}
+		articles = append(articles, text.Article{
+			URL:        "testfiltersampling:" + src,
+			Paragraphs: []text.Paragraph{{Sentences: textSents}},
+		})
+	}
+	catSents := []string{
+		"Stratumtest med alfakatten här",
+		"Stratumtest med alfakatten där",
+		"Stratumtest med alfakatten överallt",
+		"Stratumtest med betahunden",
+		"Stratumtest utan djur",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range catSents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	articles = append(articles, text.Article{
+		URL:        "testfiltersampling:cats",
+		Paragraphs: []text.Paragraph{{Sentences: textSents}},
+	})
+	for _, a := range articles {
+		_, _, err := db.Add(a, true)
+		if err != nil {
+			t.Errorf("Add went wrong : %v", err)
+			return
+		}
+	}
+	_, err := db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_sampling_animal", FeatValue: "alfakatten"},
+		{TargetFeatName: "test_sampling_animal", FeatValue: "betahunden"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	createBatch := func(batchName string, targetSize int, re string, sampling *protocol.Sampling) []string {
+		filterConfig := protocol.FilterPayload{
+			BatchName:  batchName,
+			TargetSize: targetSize,
+			Opts:       []protocol.FilterOpt{{Name: RequireChunkRE, Args: []string{re}}},
+			Sampling:   sampling,
+		}
+		qb, err := NewQueryBuilder(filterConfig)
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		_, err = ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		return batchTexts(t, batchName)
+	}
+
+	// random sampling is reproducible using the seed
+	random1 := createBatch("test_batch_sampling_random1", 4, "^Urvalsmening", &protocol.Sampling{Mode: SampleRandom, Seed: 17})
+	random2 := createBatch("test_batch_sampling_random2", 4, "^Urvalsmening", &protocol.Sampling{Mode: SampleRandom, Seed: 17})
+	if len(random1) != 4 || !reflect.DeepEqual(random1, random2) {
+		t.Errorf("Expected two equal random samples of size 4, got %v and %v", random1, random2)
+	}
+
+	// at most one sentence per source
+	got := createBatch("test_batch_sampling_source", 10, "^Urvalsmening", &protocol.Sampling{Mode: SampleSource, Seed: 3, MaxPerStratum: 1})
+	sources := map[string]bool{}
+	for _, s := range got {
+		sources[s[len(s)-1:]] = true
+	}
+	if len(got) != 3 || len(sources) != 3 {
+		t.Errorf("Expected one sentence from each source, got %v", got)
+	}
+
+	// sentences shared between sources are counted for the first source only
+	sharedSents := []string{"Delad urvalsmening ett", "Delad urvalsmening två", "Delad urvalsmening tre"}
+	for i, src := range []string{"d", "e"} {
+		textSents := []text.Sentence{}
+		for _, s := range sharedSents[:2+i] {
+			textSents = append(textSents, text.ComputeSentence(s))
+		}
+		_, _, err := db.Add(text.Article{URL: "testfiltersampling:" + src, Paragraphs: []text.Paragraph{{Sentences: textSents}}}, true)
+		if err != nil {
+			t.Errorf("Add went wrong : %v", err)
+			return
+		}
+	}
+	for seed := int64(1); seed <= 5; seed++ {
+		got = createBatch(fmt.Sprintf("test_batch_sampling_shared%d", seed), 10, "^Delad", &protocol.Sampling{Mode: SampleSource, Seed: seed, MaxPerStratum: 1})
+		nFirst := 0
+		for _, g := range got {
+			if g == sharedSents[0] || g == sharedSents[1] {
+				nFirst++
+			}
+		}
+		if len(got) != 2 || nFirst != 1 {
+			t.Errorf("Expected one sentence from each source, got %v", got)
+		}
+	}
+
+	// at most one sentence per category value, and one for sentences without a value in the category
+	got = createBatch("test_batch_sampling_cat", 10, "^Stratumtest", &protocol.Sampling{Mode: SampleChunkFeatCat, ChunkFeatCat: "test_sampling_animal", MaxPerStratum: 1})
+	if len(got) != 3 {
+		t.Errorf("Expected 3 sentences, got %v", got)
+	}
+	for _, s := range []string{catSents[3], catSents[4]} {
+		found := false
+		for _, g := range got {
+			if g == s {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s in %v", s, got)
+		}
+	}
+
+	// the strata take turns when the target size is reached
+	got = createBatch("test_batch_sampling_cat2", 2, "^Stratumtest", &protocol.Sampling{Mode: SampleChunkFeatCat, ChunkFeatCat: "test_sampling_animal"})
+	nAlfa := 0
+	for _, g := range got {
+		if strings.Contains(g, "alfakatten") {
+			nAlfa++
+		}
+	}
+	if len(got) != 2 || nAlfa > 1 {
+		t.Errorf("Expected 2 sentences from different strata, got %v", got)
+	}
+
+	for _, sampling := range []protocol.Sampling{{Mode: "unknown"}, {Mode: SampleChunkFeatCat}, {Mode: SampleSource, MaxPerStratum: -1}} {
+		_, err = NewQueryBuilder(protocol.FilterPayload{BatchName: "test_batch_sampling_err", TargetSize: 1, Sampling: &sampling})
+		if err == nil {
+			t.Errorf("Expected error for sampling %#v", sampling)
+		}
+	}
+}
+
+func TestFilterFromBatchesAndScripts(t *testing.T) {
+	sents := []string{
+		"Stegvis förfining av Norrby",
+		"Stegvis förfining av Söderby",
+		"Stegvis förfining av Västby",
+		"Stegvis förfining av Österby",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL:        "testfilterfrom:testsource",
+		Paragraphs: []text.Paragraph{{Sentences: textSents}},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+
+	createBatch := func(batchName string, opts []protocol.FilterOpt) []string {
+		qb, err := NewQueryBuilder(protocol.FilterPayload{BatchName: batchName, TargetSize: 10, Opts: opts})
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		_, err = ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		return batchTexts(t, batchName)
+	}
+	createBatch("test_batch_from1", []protocol.FilterOpt{{Name: RequireChunkRE, Args: []string{"^Stegvis förfining av (Norrby|Söderby)$"}}})
+	createBatch("test_batch_from2", []protocol.FilterOpt{{Name: RequireChunkRE, Args: []string{"^Stegvis förfining av Västby$"}}})
+	batchSents, err := db.GetBatch("test_batch_from1", 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, err = db.SaveScript(protocol.ScriptMetadata{SelectorPayload: protocol.SelectorPayload{Options: protocol.SelectorOptions{ScriptName: "test_script_from1", FromBatch: "test_batch_from1"}}}, batchSents[0].ID)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// union of the batches
+	got := createBatch("test_batch_from3", []protocol.FilterOpt{{Name: FromBatches, Args: []string{"test_batch_from1", "test_batch_from2"}}, {Name: ExcludeWords, Args: []string{"norrby"}}})
+	if expect := []string{sents[1], sents[2]}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v, got %v", expect, got)
+	}
+	got = createBatch("test_batch_from4", []protocol.FilterOpt{{Name: FromScripts, Args: []string{"test_script_from1"}}})
+	if expect := []string{batchSents[0].Text}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v, got %v", expect, got)
+	}
+
+	payload := protocol.FilterPayload{
+		Opts: []protocol.FilterOpt{{Name: FromBatches, Args: []string{"test_batch_from1", "test_batch_from2"}}},
+		Expr: &protocol.FilterExpr{Or: []protocol.FilterExpr{
+			{Opt: &protocol.FilterOpt{Name: FromScripts, Args: []string{"test_script_from1"}}},
+			{Opt: &protocol.FilterOpt{Name: FromBatches, Args: []string{"test_batch_from1"}}},
+		}},
+	}
+	expect := []protocol.SetOperand{
+		{Kind: dbapi.KindBatch, Name: "test_batch_from1"},
+		{Kind: dbapi.KindBatch, Name: "test_batch_from2"},
+		{Kind: dbapi.KindScript, Name: "test_script_from1"},
+	}
+	if got := FromOperands(payload); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %#v, got %#v", expect, got)
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	a := text.Article{
+		URL:        "testvalidatepayload:testsource",
+		Paragraphs: []text.Paragraph{{Sentences: []text.Sentence{text.ComputeSentence("Ett valideringsord i en mening")}}},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{
+		{TargetFeatName: "test_validate_cat", FeatValue: "valideringsord"},
+	})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = db.SetBatchProperties("test_validate_batch", []byte(`{"batch_name": "test_validate_batch"}`))
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	payload := protocol.FilterPayload{
+		BatchName:  "test_batch_validate",
+		TargetSize: 10,
+		Opts: []protocol.FilterOpt{
+			{Name: ExcludeChunkRE, Args: []string{"[a-z"}},
+			{Name: ChunkFeatCats, Args: []string{"test_validate_cat", "test_validate_nocat", "min_hits=2"}},
+			{Name: FromBatches, Args: []string{"test_validate_batch", "test_validate_nobatch"}},
+			{Name: "word_cuont", Args: []string{"1", "2"}},
+			{Name: WordCount, Args: []string{"1"}},
+		},
+		Expr: &protocol.FilterExpr{Or: []protocol.FilterExpr{
+			{Opt: &protocol.FilterOpt{Name: FromScripts, Args: []string{"test_validate_noscript"}}},
+			{Not: &protocol.FilterExpr{}},
+		}},
+		Sampling: &protocol.Sampling{Mode: SampleChunkFeatCat, ChunkFeatCat: "test_validate_nocat2", MaxPerStratum: -1},
+	}
+	errs, err := ValidatePayload(db, payload, "filter")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Path)
+	}
+	expect := []string{
+		"filter.opts[0].args[0]",
+		"filter.opts[1].args[1]",
+		"filter.opts[2].args[1]",
+		"filter.opts[3].name",
+		"filter.opts[4].args",
+		"filter.expr.or[0].opt.args[0]",
+		"filter.expr.or[1].not",
+		"filter.sampling.chunkfeat_cat",
+		"filter.sampling.max_per_stratum",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v, got %v", expect, errs)
+	}
+
+	errs, err = ValidatePayload(db, protocol.FilterPayload{BatchName: "test_batch_validate", TargetSize: 1, Opts: []protocol.FilterOpt{{Name: ChunkFeatCats, Args: []string{"test_validate_cat"}}}}, "filter")
+	if err != nil || len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v, %v", errs, err)
+	}
+
+	// text_match requires the full-text index, which CreateDB only creates if FTS5 is available
+	hasFTS, err := db.HasFTSIndex()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	errs, err = ValidatePayload(db, protocol.FilterPayload{BatchName: "test_batch_validate", TargetSize: 1, Opts: []protocol.FilterOpt{{Name: TextMatch, Args: []string{"valideringsord"}}}}, "filter")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if hasFTS && len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+	if !hasFTS && (len(errs) != 1 || errs[0].Path != "filter.opts[0].name") {
+		t.Errorf("Expected missing full-text index error, got %v", errs)
+	}
+}
+
+func TestFilterPredicates(t *testing.T) {
+	sents := []string{
+		"Predikatet (i parentes) är balanserat",
+		"Predikatet (i parentes är obalanserat",
+		"PREDIKATET ÄR SKRIVET MED VERSALER",
+		"Predikatet [med {nästlade} parenteser] fungerar",
+	}
+	textSents := []text.Sentence{}
+	for _, s := range sents {
+		textSents = append(textSents, text.ComputeSentence(s))
+	}
+	a := text.Article{
+		URL:        "testfilterpredicates:testsource",
+		Paragraphs: []text.Paragraph{{Sentences: textSents}},
+	}
+	_, _, err := db.Add(a, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	lexFile := filepath.Join(t.TempDir(), "lexicon.txt")
+	err = os.WriteFile(lexFile, []byte("predikatet\ni\nparentes\när\nbalanserat\n"), 0644)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	sourceOpt := protocol.FilterOpt{Name: SourceRE, Args: []string{"^testfilterpredicates:"}}
+	for _, x := range []struct {
+		batchName  string
+		targetSize int
+		opts       []protocol.FilterOpt
+		expect     []string
+	}{
+		{"test_batch_pred_brackets", 10, []protocol.FilterOpt{{Name: PredicatePrefix + "balanced_brackets"}}, []string{sents[0], sents[2], sents[3]}},
+		{"test_batch_pred_caps", 10, []protocol.FilterOpt{{Name: PredicatePrefix + "balanced_brackets"}, {Name: PredicatePrefix + "capitalization_ratio", Args: []string{"0", "0.5"}}}, []string{sents[0], sents[3]}},
+		{"test_batch_pred_lexicon", 10, []protocol.FilterOpt{{Name: PredicatePrefix + "lexicon", Args: []string{lexFile}}}, []string{sents[0]}},
+		{"test_batch_pred_limit", 1, []protocol.FilterOpt{{Name: PredicatePrefix + "balanced_brackets"}}, []string{sents[0]}},
+	} {
+		payload := protocol.FilterPayload{BatchName: x.batchName, TargetSize: x.targetSize, Opts: append([]protocol.FilterOpt{sourceOpt}, x.opts...)}
+		qb, err := NewQueryBuilder(payload)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		n, err := ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		got := batchTexts(t, x.batchName)
+		if int(n) != len(x.expect) || !reflect.DeepEqual(got, x.expect) {
+			t.Errorf("%s: expected %v, got %d %v", x.batchName, x.expect, n, got)
+		}
+	}
+
+	// more passing sentences than are inserted by a single statement: the batch holds the first sentences by chunk id, up to the target size
+	manySents := []text.Sentence{}
+	for i := 0; i < insertBatchSize+30; i++ {
+		manySents = append(manySents, text.ComputeSentence(fmt.Sprintf("Strömmande predikatmening nummer %d", i)))
+	}
+	_, added, err := db.Add(text.Article{URL: "testfilterpredicatesmany:testsource", Paragraphs: []text.Paragraph{{Sentences: manySents}}}, true)
+	if err != nil {
+		t.Errorf("Add went wrong : %v", err)
+		return
+	}
+	for _, targetSize := range []int{insertBatchSize + 10, insertBatchSize + 100} {
+		batchName := fmt.Sprintf("test_batch_pred_many%d", targetSize)
+		payload := protocol.FilterPayload{BatchName: batchName, TargetSize: targetSize, Opts: []protocol.FilterOpt{
+			{Name: SourceRE, Args: []string{"^testfilterpredicatesmany:"}},
+			{Name: PredicatePrefix + "balanced_brackets"},
+		}}
+		qb, err := NewQueryBuilder(payload)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		n, err := ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		expect := []string{}
+		for i, s := range added {
+			if i < targetSize {
+				expect = append(expect, s.Text)
+			}
+		}
+		got := batchTexts(t, batchName)
+		if int(n) != len(expect) || !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expected %d sentences, got %d (%d in batch)", batchName, len(expect), n, len(got))
+		}
+	}
+
+	// predicates see the stored features, including chunkfeat categories, and can be combined with sampling
+	_, err = db.AddChunkFeatCats("word", []dbapi.ChunkFeatCat{{TargetFeatName: "test_pred_cat", FeatValue: "balanserat"}})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	err = RegisterPredicate(Predicate{Name: "test_pred_cat", New: noArgs(func(s text.Sentence) bool { return len(s.Feats["test_pred_cat"]) > 0 })})
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, x := range []struct {
+		batchName string
+		opt       protocol.FilterOpt
+		sampling  *protocol.Sampling
+		expect    []string
+	}{
+		{"test_batch_pred_cat", protocol.FilterOpt{Name: PredicatePrefix + "test_pred_cat"}, nil, []string{sents[0]}},
+		{"test_batch_pred_sampled", protocol.FilterOpt{Name: PredicatePrefix + "balanced_brackets"}, &protocol.Sampling{Mode: SampleRandom, Seed: 5}, []string{sents[0], sents[2], sents[3]}},
+	} {
+		qb, err := NewQueryBuilder(protocol.FilterPayload{BatchName: x.batchName, TargetSize: 10, Opts: []protocol.FilterOpt{sourceOpt, x.opt}, Sampling: x.sampling})
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		_, err = ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if got := batchTexts(t, x.batchName); !reflect.DeepEqual(got, x.expect) {
+			t.Errorf("%s: expected %v, got %v", x.batchName, x.expect, got)
+		}
+	}
+
+	res, err := Preview(db, protocol.FilterPayload{BatchName: "test_batch_pred_preview", TargetSize: 2, Opts: []protocol.FilterOpt{sourceOpt, {Name: PredicatePrefix + "balanced_brackets"}}}, 2)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if res.Count != 3 || res.OutputSize != 2 || len(res.Sample) != 2 {
+		t.Errorf("Unexpected preview %#v", res)
+	}
+
+	err = RegisterPredicate(Predicate{Name: "balanced_brackets", New: noArgs(balancedBrackets)})
+	if err == nil {
+		t.Errorf("Expected error for duplicate predicate")
+	}
+	found := false
+	for _, f := range AvailableFeats() {
+		if f.Name == PredicatePrefix+"lexicon" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected %slexicon in available feats", PredicatePrefix)
+	}
 
+	for _, payload := range []protocol.FilterPayload{
+		{BatchName: "test_batch_pred_err", Opts: []protocol.FilterOpt{{Name: PredicatePrefix + "unknown"}}},
+		{BatchName: "test_batch_pred_err", Opts: []protocol.FilterOpt{{Name: PredicatePrefix + "balanced_brackets", Args: []string{"1"}}}},
+		{BatchName: "test_batch_pred_err", Expr: &protocol.FilterExpr{Opt: &protocol.FilterOpt{Name: PredicatePrefix + "balanced_brackets"}}},
+	} {
+		_, err = NewQueryBuilder(payload)
+		if err == nil {
+			t.Errorf("Expected error for %#v", payload)
+		}
+	}
+}
+
+func TestFilterSourceFreq(t *testing.T) {
+	boilerplate := "Källfrekvenstest: läs mer på vår webbplats"
+	for _, src := range []string{"a", "b", "c"} {
+		a := text.Article{
+			URL: "testfiltersourcefreq:" + src,
+			Paragraphs: []text.Paragraph{{Sentences: []text.Sentence{
+				text.ComputeSentence(boilerplate),
+				text.ComputeSentence("Källfrekvenstest: unik mening från källa " + src),
+			}}},
+		}
+		_, _, err := db.Add(a, true)
+		if err != nil {
+			t.Errorf("Add went wrong : %v", err)
+			return
+		}
+	}
+
+	createBatch := func(batchName string, args []string) []string {
+		opts := []protocol.FilterOpt{
+			{Name: RequireChunkRE, Args: []string{"^Källfrekvenstest:"}},
+			{Name: SourceFreq, Args: args},
+		}
+		qb, err := NewQueryBuilder(protocol.FilterPayload{BatchName: batchName, TargetSize: 10, Opts: opts})
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		_, err = ExecQuery(db, qb)
+		if err != nil {
+			t.Errorf("%v", err)
+			return nil
+		}
+		return batchTexts(t, batchName)
+	}
+
+	// exclude boilerplate
+	got := createBatch("test_batch_source_freq1", []string{"-1", "1"})
+	if w, g := 3, len(got); w != g {
+		t.Errorf("Expected %d sentences, got %v", w, got)
+	}
+	for _, s := range got {
+		if s == boilerplate {
+			t.Errorf("Expected boilerplate to be excluded, got %v", got)
+		}
+	}
+
+	// target boilerplate
+	got = createBatch("test_batch_source_freq2", []string{"3", "-1"})
+	if expect := []string{boilerplate}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v, got %v", expect, got)
+	}
+
+	_, err := payloadOpt2filterOpt(protocol.FilterOpt{Name: SourceFreq, Args: []string{"-1", "-1"}})
+	if err == nil {
+		t.Errorf("Expected error for %s without limits", SourceFreq)
+	}
 }
@@ -0,0 +1,86 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// FunnelExpr is the criterion name used for the filter expression in the funnel report
+const FunnelExpr = "expr"
+
+// countChunks counts the non-blocked chunks matching all conditions
+func countChunks(db *dbapi.DB, conds []string, args []interface{}) (int64, error) {
+	var res int64
+	q := `SELECT COUNT(*) FROM chunk WHERE chunk.id NOT IN (SELECT chunk_id FROM batch WHERE name = ?)`
+	for _, c := range conds {
+		q += ` AND ` + c
+	}
+	rows, err := db.ExecQuery(q, append([]interface{}{text.BlockBatch}, args...))
+	if err != nil {
+		return res, fmt.Errorf("failed to count chunks : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&res)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+	}
+	return res, rows.Err()
+}
+
+// Funnel reports how many sentences remain after each criterion of the payload (the opts in order, followed by the expression),
+// and how many sentences each criterion rejects on its own. Blocked sentences are not counted, and the target size is ignored.
+// Go predicate opts are not included, since they would have to be run on all sentences.
+func Funnel(db *dbapi.DB, payload protocol.FilterPayload) ([]protocol.FunnelStep, error) {
+	res := []protocol.FunnelStep{}
+
+	total, err := countChunks(db, nil, nil)
+	if err != nil {
+		return res, err
+	}
+
+	type criterion struct {
+		step protocol.FunnelStep
+		expr protocol.FilterExpr
+	}
+	var criteria []criterion
+	for i := range payload.Opts {
+		o := payload.Opts[i]
+		if isPredicate(o) {
+			continue
+		}
+		criteria = append(criteria, criterion{step: protocol.FunnelStep{Criterion: o.Name, Args: o.Args}, expr: protocol.FilterExpr{Opt: &o}})
+	}
+	if payload.Expr != nil {
+		criteria = append(criteria, criterion{step: protocol.FunnelStep{Criterion: FunnelExpr}, expr: *payload.Expr})
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, c := range criteria {
+		cond, cArgs, err := exprCondition(c.expr)
+		if err != nil {
+			return res, fmt.Errorf("couldn't build filter criterion %s %s : %v", c.step.Criterion, strings.Join(c.step.Args, " "), err)
+		}
+		conds = append(conds, cond)
+		args = append(args, cArgs...)
+
+		step := c.step
+		step.Remaining, err = countChunks(db, conds, args)
+		if err != nil {
+			return res, err
+		}
+		alone, err := countChunks(db, []string{cond}, cArgs)
+		if err != nil {
+			return res, err
+		}
+		step.RejectedAlone = total - alone
+		res = append(res, step)
+	}
+	return res, nil
+}
@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+)
+
+// exprOpts returns the opts of the filter expression, in order
+func exprOpts(e protocol.FilterExpr) []protocol.FilterOpt {
+	var res []protocol.FilterOpt
+	if e.Opt != nil {
+		res = append(res, *e.Opt)
+	}
+	if e.Not != nil {
+		res = append(res, exprOpts(*e.Not)...)
+	}
+	for _, sub := range append(e.And, e.Or...) {
+		res = append(res, exprOpts(sub)...)
+	}
+	return res
+}
+
+// FromOperands returns the batches and scripts the payload filters from (from_batches and from_scripts opts, also in the filter expression)
+func FromOperands(payload protocol.FilterPayload) []protocol.SetOperand {
+	res := []protocol.SetOperand{}
+	opts := payload.Opts
+	if payload.Expr != nil {
+		opts = append(append([]protocol.FilterOpt{}, opts...), exprOpts(*payload.Expr)...)
+	}
+	seen := map[protocol.SetOperand]bool{}
+	for _, o := range opts {
+		kind := ""
+		switch o.Name {
+		case FromBatches:
+			kind = dbapi.KindBatch
+		case FromScripts:
+			kind = dbapi.KindScript
+		default:
+			continue
+		}
+		for _, name := range o.Args {
+			op := protocol.SetOperand{Kind: kind, Name: name}
+			if !seen[op] {
+				seen[op] = true
+				res = append(res, op)
+			}
+		}
+	}
+	return res
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/stts-se/wikispeech-manuscriptor/protocol"
 )
@@ -11,22 +12,87 @@ import (
 const (
 	WordCount      = "word_count"
 	CommaCount     = "comma_count"
+	CharCount      = "char_count"
 	SourceRE       = "source_re"
 	ParagraphCount = "paragraph_count"
 	SentenceCount  = "sentence_count"
+	SourceFreq     = "source_freq"
 	DigitCount     = "digit_count"
 	LowestWordFreq = "lowest_word_freq"
 	ExcludeChunkRE = "exclude_chunk_re"
+	RequireChunkRE = "require_chunk_re"
+	RequireWords   = "require_words"
+	ExcludeWords   = "exclude_words"
+	TextMatch      = "text_match"
 	ChunkFeatCats  = "chunkfeat_cats"
 	ExcludeBatches = "exclude_batches"
+	FromBatches    = "from_batches"
+	FromScripts    = "from_scripts"
+
+	ExcludeChunkFeatCats = "exclude_chunkfeat_cats"
+)
+
+const (
+	ChunkFeatCatsDocDesc    = "Choose sentences included in pre-defined feature categories (typically domains). A parent category matches all its descendant categories"
+	ChunkFeatCatsDocArgs    = "List of feature categories, optionally with min_hits=n, max_hits=n (number of distinct category values in a sentence, default 1 and unlimited), and match=all (each category must be matched) or match=any (default)"
+	ChunkFeatCatsDocExample = "se_place, se_weather, match=all"
+
+	// exclude_chunkfeat_cats takes no optional args
+	ExcludeChunkFeatCatsDocArgs = "List of feature categories"
 )
 
+// Optional chunkfeat_cats args
 const (
-	ChunkFeatCatsDocDesc    = "Choose sentences included in pre-defined feature categories (typically domains)"
-	ChunkFeatCatsDocArgs    = "List of feature categories"
-	ChunkFeatCatsDocExample = "se_place"
+	chunkFeatCatsMinHits = "min_hits="
+	chunkFeatCatsMaxHits = "max_hits="
+	chunkFeatCatsMatch   = "match="
 )
 
+// chunkFeatCatsArgs holds the parsed args of the chunkfeat_cats opt
+type chunkFeatCatsArgs struct {
+	cats    []string
+	minHits int
+	maxHits int // 0 means no limit
+	all     bool
+}
+
+func args2chunkFeatCats(args []string) (chunkFeatCatsArgs, error) {
+	res := chunkFeatCatsArgs{minHits: 1}
+	for _, arg := range args {
+		var err error
+		switch {
+		case strings.HasPrefix(arg, chunkFeatCatsMinHits):
+			res.minHits, err = strconv.Atoi(strings.TrimPrefix(arg, chunkFeatCatsMinHits))
+		case strings.HasPrefix(arg, chunkFeatCatsMaxHits):
+			res.maxHits, err = strconv.Atoi(strings.TrimPrefix(arg, chunkFeatCatsMaxHits))
+		case strings.HasPrefix(arg, chunkFeatCatsMatch):
+			switch m := strings.TrimPrefix(arg, chunkFeatCatsMatch); m {
+			case "all":
+				res.all = true
+			case "any":
+				res.all = false
+			default:
+				return res, fmt.Errorf("invalid match '%s', expected all or any", m)
+			}
+		default:
+			res.cats = append(res.cats, arg)
+		}
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse int : %v", err)
+		}
+	}
+	if len(res.cats) == 0 {
+		return res, fmt.Errorf("no feature categories")
+	}
+	if res.minHits < 1 {
+		return res, fmt.Errorf("min_hits must be at least 1, found %d", res.minHits)
+	}
+	if res.maxHits < 0 || res.maxHits > 0 && res.maxHits < res.minHits {
+		return res, fmt.Errorf("invalid max_hits %d", res.maxHits)
+	}
+	return res, nil
+}
+
 type Feat struct {
 	Name    string `json:"name"`
 	Desc    string `json:"desc"`
@@ -36,6 +102,12 @@ type Feat struct {
 
 func AvailableFeats() []Feat {
 	res := []Feat{
+		{
+			Name:    CharCount,
+			Desc:    "Number of characters in a sentence",
+			Args:    "Two integers defining a legal interval",
+			Example: "10, 120",
+		},
 		{
 			Name:    CommaCount,
 			Desc:    "Number of commas in a sentence",
@@ -60,6 +132,30 @@ func AvailableFeats() []Feat {
 			Args:    "Regular expression",
 			Example: `[\p{Greek}]`,
 		},
+		{
+			Name:    ExcludeChunkFeatCats,
+			Desc:    "Exclude sentences included in pre-defined feature categories. A parent category matches all its descendant categories",
+			Args:    ExcludeChunkFeatCatsDocArgs,
+			Example: "se_surname",
+		},
+		{
+			Name:    ExcludeWords,
+			Desc:    "Exclude sentences containing any of the words (case insensitive)",
+			Args:    "List of words",
+			Example: "jag, du",
+		},
+		{
+			Name:    FromBatches,
+			Desc:    "Choose sentences from existing batches",
+			Args:    "List of batch names",
+			Example: "test_batch_1, test_batch_2",
+		},
+		{
+			Name:    FromScripts,
+			Desc:    "Choose sentences from existing scripts",
+			Args:    "List of script names",
+			Example: "test_script_1",
+		},
 		{
 			Name:    LowestWordFreq,
 			Desc:    "Lowest word frequency allowed in a sentence",
@@ -72,18 +168,42 @@ func AvailableFeats() []Feat {
 			Args:    "Two integers defining a legal interval",
 			Example: "10, 20",
 		},
+		{
+			Name:    RequireChunkRE,
+			Desc:    "Required sentence pattern",
+			Args:    "Regular expression",
+			Example: `^[A-ZÅÄÖ]`,
+		},
+		{
+			Name:    RequireWords,
+			Desc:    "Require sentences to contain at least one of the words (case insensitive)",
+			Args:    "List of words",
+			Example: "regn, snö, blåst",
+		},
 		{
 			Name:    SentenceCount,
 			Desc:    "Choose sentences from texts (sources) containing a certain number of sentences",
 			Args:    "Two integers defining a legal interval",
 			Example: "9, -1",
 		},
+		{
+			Name:    SourceFreq,
+			Desc:    "Number of texts (sources) a sentence occurs in. Sentences occurring in many texts are typically boilerplate",
+			Args:    "Two integers defining a legal interval (-1 for no lower or upper limit)",
+			Example: "1, 3",
+		},
 		{
 			Name:    SourceRE,
 			Desc:    "Required pattern for text source",
 			Args:    "Regular expression",
 			Example: "00$",
 		},
+		{
+			Name:    TextMatch,
+			Desc:    "Required words or phrases, using the full-text index (requires FTS5, see scripttool build_fts_index)",
+			Args:    "Full-text query: words, \"phrases\", prefixes (word*), AND, OR, NOT",
+			Example: `"i dag" OR idag`,
+		},
 		{
 			Name:    WordCount,
 			Desc:    "Number of words in a sentence",
@@ -97,6 +217,9 @@ func AvailableFeats() []Feat {
 			Example: ChunkFeatCatsDocExample,
 		},
 	}
+	for _, p := range Predicates() {
+		res = append(res, Feat{Name: PredicatePrefix + p.Name, Desc: p.Desc + " (Go predicate, run after the other filter opts)", Args: p.Args, Example: p.Example})
+	}
 	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
 	return res
 }
@@ -138,6 +261,13 @@ func args2strings(args []string) ([]string, error) {
 	return args, nil
 }
 
+func args2nonEmptyStrings(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, fmt.Errorf("expected at least 1 arg, found 0")
+	}
+	return args, nil
+}
+
 func payloadOpt2filterOpt(o protocol.FilterOpt) (opt, error) {
 	var res opt
 	switch o.Name {
@@ -149,7 +279,7 @@ func payloadOpt2filterOpt(o protocol.FilterOpt) (opt, error) {
 		if i2 < 0 {
 			return res, fmt.Errorf("cannot create filter with word count lower than %v", i2)
 		}
-		return wordCountView(i1, i2), nil
+		return wordCount(i1, i2), nil
 	case CommaCount:
 		i1, i2, err := args2int2(o.Args)
 		if err != nil {
@@ -158,7 +288,16 @@ func payloadOpt2filterOpt(o protocol.FilterOpt) (opt, error) {
 		if i2 < 0 {
 			return res, fmt.Errorf("cannot create filter with comma count lower than %v", i2)
 		}
-		return commaCountView(i1, i2), nil
+		return commaCount(i1, i2), nil
+	case CharCount:
+		i1, i2, err := args2int2(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		if i2 < 0 {
+			return res, fmt.Errorf("cannot create filter with char count lower than %v", i2)
+		}
+		return charCount(i1, i2), nil
 	case SourceRE:
 		s, err := args2string(o.Args)
 		if err != nil {
@@ -189,44 +328,202 @@ func payloadOpt2filterOpt(o protocol.FilterOpt) (opt, error) {
 		} else {
 			return sentenceCountInterval(i1, i2), nil
 		}
+	case SourceFreq:
+		i1, i2, err := args2int2(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		if i1 < 0 && i2 < 0 {
+			return res, fmt.Errorf("cannot create %s filter without lower or upper limit", o.Name)
+		}
+		if i1 < 0 {
+			return sourceFreqMax(i2), nil
+		} else if i2 < 0 {
+			return sourceFreqMin(i1), nil
+		} else {
+			return sourceFreqInterval(i1, i2), nil
+		}
 	case DigitCount:
 		i, err := args2int(o.Args)
 		if err != nil {
 			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
 		}
-		return nDigitCountView(i), nil
+		return nDigitCount(i), nil
 	case LowestWordFreq:
 		i, err := args2int(o.Args)
 		if err != nil {
 			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
 		}
-		return lowestWordFreqCountView(i), nil
+		return lowestWordFreqCount(i), nil
 	case ExcludeChunkRE:
 		s, err := args2string(o.Args)
 		if err != nil {
 			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
 		}
 		return excludeChunkRE(s), nil
+	case RequireChunkRE:
+		s, err := args2string(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return requireChunkRE(s), nil
+	case RequireWords:
+		ss, err := args2nonEmptyStrings(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return requireWords(ss...), nil
+	case ExcludeWords:
+		ss, err := args2nonEmptyStrings(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return excludeWords(ss...), nil
+	case TextMatch:
+		s, err := args2string(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return textMatch(s), nil
 	case ExcludeBatches:
 		ss, err := args2strings(o.Args)
 		if err != nil {
 			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
 		}
 		return tailNotInBatches(ss...), nil
+	case FromBatches:
+		ss, err := args2nonEmptyStrings(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return fromBatchQ(ss...), nil
+	case FromScripts:
+		ss, err := args2nonEmptyStrings(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		return fromScriptQ(ss...), nil
 	case ChunkFeatCats:
-		ss, err := args2strings(o.Args)
+		a, err := args2chunkFeatCats(o.Args)
+		if err != nil {
+			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+		}
+		if a.minHits == 1 && a.maxHits == 0 && (!a.all || len(a.cats) == 1) {
+			return chunkFeatCat(a.cats...), nil
+		}
+		return chunkFeatCatHits(a.cats, a.minHits, a.maxHits, a.all), nil
+	case ExcludeChunkFeatCats:
+		ss, err := args2nonEmptyStrings(o.Args)
 		if err != nil {
 			return res, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
 		}
-		return chunkFeatCat(ss...), nil
+		return excludeChunkFeatCat(ss...), nil
 	default:
 		return res, fmt.Errorf("unknown option type: %s", o.Name)
 	}
 }
 
+// exprCondition compiles a filter expression into an SQL condition on chunk.id, along with its args.
+// Each opt is compiled into a sub query selecting the ids of the chunks matching the opt.
+func exprCondition(e protocol.FilterExpr) (string, []interface{}, error) {
+	n := 0
+	for _, set := range []bool{e.Opt != nil, len(e.And) > 0, len(e.Or) > 0, e.Not != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return "", nil, fmt.Errorf("expected exactly one of opt, and, or, not in filter expression, found %d", n)
+	}
+
+	switch {
+	case e.Opt != nil && isPredicate(*e.Opt):
+		return "", nil, fmt.Errorf("go predicate %s can only be used in the filter opts, not in the filter expression", e.Opt.Name)
+	case e.Opt != nil:
+		o, err := payloadOpt2filterOpt(*e.Opt)
+		if err != nil {
+			return "", nil, fmt.Errorf("couldn't build filter opt from %v : %v", *e.Opt, err)
+		}
+		sub, err := newFilterQueryBuilder(selectChunkIDsHead(), o)
+		if err != nil {
+			return "", nil, err
+		}
+		q, args := sub.query()
+		return "chunk.id IN (" + q + ")", args, nil
+	case e.Not != nil:
+		cond, args, err := exprCondition(*e.Not)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + cond + ")", args, nil
+	default:
+		exprs, operator := e.And, " AND "
+		if len(e.Or) > 0 {
+			exprs, operator = e.Or, " OR "
+		}
+		conds := []string{}
+		args := []interface{}{}
+		for _, e0 := range exprs {
+			cond, args0, err := exprCondition(e0)
+			if err != nil {
+				return "", nil, err
+			}
+			conds = append(conds, cond)
+			args = append(args, args0...)
+		}
+		return "(" + strings.Join(conds, operator) + ")", args, nil
+	}
+}
+
 func NewQueryBuilder(payload protocol.FilterPayload) (*queryBuilder, error) {
+	hasPredicates := false
+	for _, o := range payload.Opts {
+		if isPredicate(o) {
+			hasPredicates = true
+		}
+	}
+	if !hasPredicates {
+		return newPayloadQueryBuilder(payload, filterQHeadInto(payload.BatchName), true)
+	}
+	// the sentences selected by the query are checked by the Go predicates, and inserted by ExecQuery
+	qb, err := newPayloadQueryBuilder(payload, selectDistinctChunkIDsHead(), false)
+	if err != nil {
+		return qb, err
+	}
+	// sampled queries are ordered by sample order, the others by chunk id, so that the batch holds the first passing sentences
+	if !isSampled(payload) {
+		tailOrderByChunkID()(qb)
+	}
+	qb.batchName = payload.BatchName
+	qb.limit = payload.TargetSize
+	return qb, nil
+}
+
+// newPayloadQueryBuilder builds a query from the payload opts, using the query head opt head. If limit is true, the payload target size is used as LIMIT.
+// Go predicate opts are not part of the query, but added as checks to the query builder.
+func newPayloadQueryBuilder(payload protocol.FilterPayload, head opt, limit bool) (*queryBuilder, error) {
+	sqlPayload, checks, err := splitPredicates(payload)
+	if err != nil {
+		return &queryBuilder{}, err
+	}
+	var qb *queryBuilder
+	if isSampled(sqlPayload) {
+		qb, err = newSamplingQueryBuilder(sqlPayload, head, limit)
+	} else {
+		qb, err = newSQLQueryBuilder(sqlPayload, head, limit)
+	}
+	if err != nil {
+		return qb, err
+	}
+	qb.checks = checks
+	qb.config = payload
+	return qb, nil
+}
+
+// newSQLQueryBuilder builds a query from the payload opts, see newPayloadQueryBuilder
+func newSQLQueryBuilder(payload protocol.FilterPayload, head opt, limit bool) (*queryBuilder, error) {
 	filterOpts := []opt{
-		filterQHeadInto(payload.BatchName),
+		head,
 	}
 
 	seenExcludeBatches := false
@@ -243,10 +540,22 @@ func NewQueryBuilder(payload protocol.FilterPayload) (*queryBuilder, error) {
 	if !seenExcludeBatches {
 		filterOpts = append(filterOpts, tailNotInBatches())
 	}
+	if payload.Expr != nil {
+		cond, args, err := exprCondition(*payload.Expr)
+		if err != nil {
+			return &queryBuilder{}, fmt.Errorf("couldn't build filter expression : %v", err)
+		}
+		filterOpts = append(filterOpts, where(cond, args...))
+	}
 
-	if payload.TargetSize > 0 {
+	if limit && payload.TargetSize > 0 {
 		filterOpts = append(filterOpts, tailLimit(payload.TargetSize))
 	}
-	return newFilterQueryBuilder(filterOpts...)
+	qb, err := newFilterQueryBuilder(filterOpts...)
+	if err != nil {
+		return qb, err
+	}
+	qb.config = payload
+	return qb, nil
 
 }
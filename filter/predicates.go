@@ -0,0 +1,306 @@
+package filter
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// Go predicates are filter checks written in Go, for conditions that are awkward or slow to express in SQL.
+// They are used in the filter opts as PredicatePrefix + name, e.g. {"name": "go:balanced_brackets"},
+// and run as a streaming post-filter on the sentences matching the SQL filter opts.
+
+// PredicatePrefix is the filter opt name prefix of Go predicates
+const PredicatePrefix = "go:"
+
+// Predicate is a named Go check over sentences
+type Predicate struct {
+	Name    string // without PredicatePrefix
+	Desc    string
+	Args    string
+	Example string
+	// New creates the check from the filter opt args
+	New func(args []string) (func(text.Sentence) bool, error)
+}
+
+var predicates = struct {
+	sync.RWMutex
+	m map[string]Predicate
+}{
+	m: map[string]Predicate{},
+}
+
+// RegisterPredicate adds a Go predicate to the registry, so that it can be used in filter configs
+func RegisterPredicate(p Predicate) error {
+	predicates.Lock()
+	defer predicates.Unlock()
+	if p.Name == "" || p.New == nil {
+		return fmt.Errorf("predicate requires a name and a constructor")
+	}
+	if _, ok := predicates.m[p.Name]; ok {
+		return fmt.Errorf("predicate %s is already registered", p.Name)
+	}
+	predicates.m[p.Name] = p
+	return nil
+}
+
+// Predicates lists the registered Go predicates, sorted by name
+func Predicates() []Predicate {
+	predicates.RLock()
+	defer predicates.RUnlock()
+	res := []Predicate{}
+	for _, p := range predicates.m {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func isPredicate(o protocol.FilterOpt) bool {
+	return strings.HasPrefix(o.Name, PredicatePrefix)
+}
+
+// newPredicate creates the check of a Go predicate filter opt
+func newPredicate(o protocol.FilterOpt) (func(text.Sentence) bool, error) {
+	name := strings.TrimPrefix(o.Name, PredicatePrefix)
+	predicates.RLock()
+	p, ok := predicates.m[name]
+	predicates.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown predicate: %s", o.Name)
+	}
+	check, err := p.New(o.Args)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s opt : %v", o.Name, err)
+	}
+	return check, nil
+}
+
+// splitPredicates returns the payload without Go predicate opts, along with the checks of these opts
+func splitPredicates(payload protocol.FilterPayload) (protocol.FilterPayload, []func(text.Sentence) bool, error) {
+	var checks []func(text.Sentence) bool
+	var opts []protocol.FilterOpt
+	for _, o := range payload.Opts {
+		if !isPredicate(o) {
+			opts = append(opts, o)
+			continue
+		}
+		check, err := newPredicate(o)
+		if err != nil {
+			return payload, checks, err
+		}
+		checks = append(checks, check)
+	}
+	payload.Opts = opts
+	return payload, checks, nil
+}
+
+// predicateBatchSize is the number of sentences read from the db at a time when running Go predicates
+const predicateBatchSize = 500
+
+// streamPredicates runs the query q selecting distinct chunk ids in tx, and calls fn with each sentence passing all checks, in query order, until fn returns false or an error.
+// The sentences are read predicateBatchSize at a time, with the features stored in the db (see dbapi.GetSentsTx).
+func streamPredicates(db *dbapi.DB, tx *sql.Tx, q string, args []interface{}, checks []func(text.Sentence) bool, fn func(text.Sentence) (bool, error)) error {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query db : %v", err)
+	}
+	defer rows.Close()
+
+	// checkSents checks the sentences with the given ids, and returns false when fn is done
+	checkSents := func(ids []int64) (bool, error) {
+		sents, err := db.GetSentsTx(tx, ids...)
+		if err != nil {
+			return false, fmt.Errorf("failed to read sentences : %v", err)
+		}
+		for _, s := range sents {
+			ok := true
+			for _, check := range checks {
+				if !check(s) {
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+			more, err := fn(s)
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to scan row : %v", err)
+		}
+		ids = append(ids, id)
+		if len(ids) >= predicateBatchSize {
+			more, err := checkSents(ids)
+			if err != nil || !more {
+				return err
+			}
+			ids = ids[:0]
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error when reading db result row : %v", err)
+	}
+	if len(ids) > 0 {
+		_, err = checkSents(ids)
+		return err
+	}
+	return nil
+}
+
+// Built-in predicates
+
+var bracketPairs = map[rune]rune{')': '(', ']': '[', '}': '{', '»': '«', '”': '“'}
+
+func balancedBrackets(s text.Sentence) bool {
+	var stack []rune
+	for _, r := range s.Text {
+		switch r {
+		case '(', '[', '{', '«', '“':
+			stack = append(stack, r)
+		case ')', ']', '}', '»', '”':
+			// ” is also used as opening quote in Swedish, see balancedQuotes
+			if r == '”' && (len(stack) == 0 || stack[len(stack)-1] != '“') {
+				continue
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != bracketPairs[r] {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return len(stack) == 0
+}
+
+// balancedQuotes counts ” only in sentences without “, since ” is used both as opening and closing quote in Swedish
+func balancedQuotes(s text.Sentence) bool {
+	straight := strings.Count(s.Text, `"`)
+	swedish := 0
+	if !strings.ContainsRune(s.Text, '“') {
+		swedish = strings.Count(s.Text, "”")
+	}
+	return straight%2 == 0 && swedish%2 == 0
+}
+
+func capitalizationRatio(args []string) (func(text.Sentence) bool, error) {
+	var min, max float64
+	if len(args) != 2 {
+		return nil, fmt.Errorf("expected 2 args, found %d", len(args))
+	}
+	_, err := fmt.Sscanf(args[0]+" "+args[1], "%g %g", &min, &max)
+	if err != nil {
+		return nil, fmt.Errorf("expected two numbers, found %v : %v", args, err)
+	}
+	return func(s text.Sentence) bool {
+		var letters, upper int
+		for _, r := range s.Text {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		if letters == 0 {
+			return min <= 0
+		}
+		ratio := float64(upper) / float64(letters)
+		return ratio >= min && ratio <= max
+	}, nil
+}
+
+// lexicon requires all words of a sentence to be in a lexicon file, with one word per line (case insensitive)
+func lexicon(args []string) (func(text.Sentence) bool, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 arg, found %d", len(args))
+	}
+	fh, err := os.Open(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open lexicon file : %v", err)
+	}
+	defer fh.Close()
+	words := map[string]bool{}
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		if w := strings.TrimSpace(sc.Text()); w != "" {
+			words[strings.ToLower(w)] = true
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read lexicon file : %v", err)
+	}
+	return func(s text.Sentence) bool {
+		for w := range s.Feats[text.FeatWord] {
+			if !words[w] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func noArgs(check func(text.Sentence) bool) func([]string) (func(text.Sentence) bool, error) {
+	return func(args []string) (func(text.Sentence) bool, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("expected no args, found %d", len(args))
+		}
+		return check, nil
+	}
+}
+
+func init() {
+	for _, p := range []Predicate{
+		{
+			Name:    "balanced_brackets",
+			Desc:    "Require brackets and paired quotes («», “”) to be balanced and properly nested",
+			Args:    "None",
+			Example: "",
+			New:     noArgs(balancedBrackets),
+		},
+		{
+			Name:    "balanced_quotes",
+			Desc:    `Require an even number of straight (") and Swedish (”) double quotes`,
+			Args:    "None",
+			Example: "",
+			New:     noArgs(balancedQuotes),
+		},
+		{
+			Name:    "capitalization_ratio",
+			Desc:    "Ratio of upper case letters to all letters in a sentence",
+			Args:    "Two numbers defining a legal interval",
+			Example: "0, 0.2",
+			New:     capitalizationRatio,
+		},
+		{
+			Name:    "lexicon",
+			Desc:    "Require all words in a sentence to be in a lexicon (case insensitive)",
+			Args:    "Lexicon file, with one word per line",
+			Example: "lexicon.txt",
+			New:     lexicon,
+		},
+	} {
+		err := RegisterPredicate(p)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
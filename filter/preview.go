@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// PreviewSent is a sentence matching a filter
+type PreviewSent struct {
+	ID   int64  `json:"id"`
+	Text string `json:"text"`
+}
+
+// PreviewResult is the result of a filter dry-run
+type PreviewResult struct {
+	Count      int64         `json:"count"`       // total number of matching sentences, regardless of target size
+	OutputSize int64         `json:"output_size"` // the size of the batch that would be created
+	Sample     []PreviewSent `json:"sample"`      // random sample of matching sentences, or the first sentences of the batch if the payload uses sampling
+}
+
+// Preview runs the filter query of the payload as a SELECT, without creating a batch.
+// It returns the number of matching sentences, and a random sample of at most sampleSize matching sentences.
+// If the payload uses sampling, the batch would hold the first sentences in sample order, and these are returned instead of a random sample.
+func Preview(db *dbapi.DB, payload protocol.FilterPayload, sampleSize int) (PreviewResult, error) {
+	res := PreviewResult{Sample: []PreviewSent{}}
+
+	qb, err := newPayloadQueryBuilder(payload, selectChunkIDsHead(), false)
+	if err != nil {
+		return res, err
+	}
+	q, args := qb.query()
+
+	if len(qb.checks) > 0 {
+		if isSampled(payload) {
+			qb, err = newPayloadQueryBuilder(payload, selectDistinctChunkIDsHead(), false)
+			if err != nil {
+				return res, err
+			}
+			q, args = qb.query()
+			return previewPredicates(db, payload, q, args, qb.checks, sampleSize, true)
+		}
+		return previewPredicates(db, payload, `SELECT id FROM chunk WHERE id IN (`+q+`)`, args, qb.checks, sampleSize, false)
+	}
+
+	rows, err := db.ExecQuery(`SELECT COUNT(DISTINCT id) FROM (`+q+`)`, args)
+	if err != nil {
+		return res, fmt.Errorf("failed to count filter matches : %v", err)
+	}
+	for rows.Next() {
+		err = rows.Scan(&res.Count)
+		if err != nil {
+			rows.Close()
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+	}
+	rows.Close()
+	res.OutputSize = res.Count
+	if payload.TargetSize > 0 && int64(payload.TargetSize) < res.Count {
+		res.OutputSize = int64(payload.TargetSize)
+	}
+
+	if sampleSize < 1 {
+		return res, nil
+	}
+	if isSampled(payload) {
+		qb, err = newPayloadQueryBuilder(payload, selectChunksHead(), false)
+		if err != nil {
+			return res, err
+		}
+		q, args = qb.query()
+		if res.OutputSize < int64(sampleSize) {
+			sampleSize = int(res.OutputSize)
+		}
+		rows, err = db.ExecQuery(q+` LIMIT ?`, append(args, sampleSize))
+	} else {
+		rows, err = db.ExecQuery(`SELECT id, text FROM chunk WHERE id IN (`+q+`) ORDER BY RANDOM() LIMIT ?`, append(args, sampleSize))
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to sample filter matches : %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s PreviewSent
+		err = rows.Scan(&s.ID, &s.Text)
+		if err != nil {
+			return res, fmt.Errorf("failed to scan row : %v", err)
+		}
+		res.Sample = append(res.Sample, s)
+	}
+	if err = rows.Err(); err != nil {
+		return res, fmt.Errorf("error when reading db result row : %v", err)
+	}
+	return res, nil
+}
+
+// previewPredicates previews a filter with Go predicates, by checking all sentences selected (by id) by the query q.
+// If first is true, the sample holds the first passing sentences (the head of the batch), otherwise a random sample.
+func previewPredicates(db *dbapi.DB, payload protocol.FilterPayload, q string, args []interface{}, checks []func(text.Sentence) bool, sampleSize int, first bool) (PreviewResult, error) {
+	res := PreviewResult{Sample: []PreviewSent{}}
+	tx, err := db.Begin()
+	if err != nil {
+		return res, fmt.Errorf("failed to begin transaction : %v", err)
+	}
+	err = streamPredicates(db, tx, q, args, checks, func(s text.Sentence) (bool, error) {
+		res.Count++
+		switch {
+		case first:
+			if len(res.Sample) < sampleSize && (payload.TargetSize < 1 || res.Count <= int64(payload.TargetSize)) {
+				res.Sample = append(res.Sample, PreviewSent{ID: s.ID, Text: s.Text})
+			}
+		case len(res.Sample) < sampleSize:
+			res.Sample = append(res.Sample, PreviewSent{ID: s.ID, Text: s.Text})
+		default:
+			// reservoir sampling
+			if i := rand.Int63n(res.Count); i < int64(sampleSize) {
+				res.Sample[i] = PreviewSent{ID: s.ID, Text: s.Text}
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return res, fmt.Errorf("failed to run go predicates : %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return res, fmt.Errorf("couldn't commit transaction : %v", err)
+	}
+	res.OutputSize = res.Count
+	if payload.TargetSize > 0 && int64(payload.TargetSize) < res.Count {
+		res.OutputSize = int64(payload.TargetSize)
+	}
+	return res, nil
+}
@@ -15,14 +15,35 @@ type queryBuilder struct {
 	head  string
 	joins []string
 	tail  string
-	args  []interface{}
+	args  []interface{} // args of head and joins
+
+	// wheres are conditions on chunk.id, combined using AND
+	wheres    []string
+	whereArgs []interface{}
+	tailArgs  []interface{}
+
+	// batchName and config are recorded in the oplog
+	batchName string
+	config    interface{}
+
+	// checks are Go predicates run on the sentences selected by the query, see ExecQuery.
+	// The query then selects chunk ids, and limit is the max number of sentences inserted into the batch.
+	checks []func(text.Sentence) bool
+	limit  int
 }
 
 func (qb *queryBuilder) query() (string, []interface{}) {
 
-	qString := qb.head + " " + strings.Join(qb.joins, " ") + " " + qb.tail
+	qString := qb.head + " " + strings.Join(qb.joins, " ")
+	if len(qb.wheres) > 0 {
+		qString += " WHERE " + strings.Join(qb.wheres, " AND ")
+	}
+	qString += " " + qb.tail
 
-	return qString, qb.args
+	args := append([]interface{}{}, qb.args...)
+	args = append(args, qb.whereArgs...)
+	args = append(args, qb.tailArgs...)
+	return qString, args
 }
 
 func (qb *queryBuilder) populatedQueryString() string {
@@ -37,7 +58,7 @@ func newFilterQueryBuilder(options ...opt) (*queryBuilder, error) {
 	for _, o := range options {
 		o(res)
 	}
-	// todo: validering
+	// payloads are validated against the db by ValidatePayload
 	return res, nil
 }
 
@@ -45,15 +66,48 @@ func filterQHeadInto(intoBatch string) func(*queryBuilder) {
 	return func(qb *queryBuilder) {
 		qb.head = `INSERT OR IGNORE INTO batch (chunk_id, name) SELECT DISTINCT chunk.id, ? FROM chunk`
 		qb.args = append(qb.args, intoBatch)
+		qb.batchName = intoBatch
 	}
 }
 
-func fromBatchQ(batchName string) func(*queryBuilder) {
+// selectChunkIDsHead is used for sub queries selecting chunk ids, see exprCondition
+func selectChunkIDsHead() func(*queryBuilder) {
 	return func(qb *queryBuilder) {
-		j := `JOIN batch ON chunk.id = batch.chunk_id AND batch.name = ?`
-		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, batchName)
+		qb.head = `SELECT chunk.id FROM chunk`
+	}
+}
+
+// selectChunksHead selects chunk ids and texts
+func selectChunksHead() func(*queryBuilder) {
+	return func(qb *queryBuilder) {
+		qb.head = `SELECT DISTINCT chunk.id, chunk.text FROM chunk`
+	}
+}
+
+// selectDistinctChunkIDsHead selects the ids of the sentences to be checked by Go predicates
+func selectDistinctChunkIDsHead() func(*queryBuilder) {
+	return func(qb *queryBuilder) {
+		qb.head = `SELECT DISTINCT chunk.id FROM chunk`
+	}
+}
+
+// where adds a condition on chunk.id
+func where(condition string, args ...interface{}) func(*queryBuilder) {
+	return func(qb *queryBuilder) {
+		qb.wheres = append(qb.wheres, condition)
+		qb.whereArgs = append(qb.whereArgs, args...)
+	}
+}
+
+// fromBatchQ requires the chunk to be in any of the batches
+func fromBatchQ(batchNames ...string) func(*queryBuilder) {
+	var qs []string
+	var args []interface{}
+	for _, bn := range batchNames {
+		qs = append(qs, "?")
+		args = append(args, bn)
 	}
+	return where(`chunk.id IN (SELECT chunk_id FROM batch WHERE name IN (`+strings.Join(qs, ", ")+`))`, args...)
 }
 
 func fromSourceRE(sourceRE string) func(*queryBuilder) {
@@ -143,32 +197,50 @@ func sentenceCountMax(count int) func(*queryBuilder) {
 	return innerJoinSourcefeatCount("sentence_count", "<=", count)
 }
 
-func fromScriptQ(scriptName string) func(*queryBuilder) {
-	return func(qb *queryBuilder) {
-		j := `JOIN script ON chunk.id = script.chunk_id AND script.name = ?`
-		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, scriptName)
+// fromScriptQ requires the chunk to be in any of the scripts
+func fromScriptQ(scriptNames ...string) func(*queryBuilder) {
+	var qs []string
+	var args []interface{}
+	for _, sn := range scriptNames {
+		qs = append(qs, "?")
+		args = append(args, sn)
 	}
+	return where(`chunk.id IN (SELECT chunk_id FROM script WHERE name IN (`+strings.Join(qs, ", ")+`))`, args...)
 }
 
-func wordCountView(min, max int) func(*queryBuilder) {
+// chunkCountInterval joins the pre-computed chunk_count table, requiring column to be within the interval min-max
+func chunkCountInterval(column string, min, max int) func(*queryBuilder) {
+	tableName := fmt.Sprintf("chunk_count_%s", text.RandomString(10))
 	return func(qb *queryBuilder) {
-		j := `JOIN chunk_wordcount_view ON chunk.id = chunk_wordcount_view.id AND chunk_wordcount_view.freq >= ? AND chunk_wordcount_view.freq <= ?`
+		j := fmt.Sprintf(`JOIN chunk_count AS %s ON chunk.id = %s.chunk_id AND %s.%s >= ? AND %s.%s <= ?`, tableName, tableName, tableName, column, tableName, column)
 		qb.joins = append(qb.joins, j)
 		qb.args = append(qb.args, min)
 		qb.args = append(qb.args, max)
 	}
 }
 
-func commaCountView(min, max int) func(*queryBuilder) {
+// chunkCount joins the pre-computed chunk_count table, requiring column to satisfy the operand compared to count
+func chunkCount(column string, operand string, count int) func(*queryBuilder) {
+	tableName := fmt.Sprintf("chunk_count_%s", text.RandomString(10))
 	return func(qb *queryBuilder) {
-		j := `JOIN chunk_commacount_view ON chunk.id = chunk_commacount_view.id AND chunk_commacount_view.freq >= ? AND chunk_commacount_view.freq <= ?`
+		j := fmt.Sprintf(`JOIN chunk_count AS %s ON chunk.id = %s.chunk_id AND %s.%s %s ?`, tableName, tableName, tableName, column, operand)
 		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, min)
-		qb.args = append(qb.args, max)
+		qb.args = append(qb.args, count)
 	}
 }
 
+func wordCount(min, max int) func(*queryBuilder) {
+	return chunkCountInterval("word_count", min, max)
+}
+
+func commaCount(min, max int) func(*queryBuilder) {
+	return chunkCountInterval("comma_count", min, max)
+}
+
+func charCount(min, max int) func(*queryBuilder) {
+	return chunkCountInterval("char_count", min, max)
+}
+
 // experimental! only works with SELECT DISTINCT, and barely even then
 // func excludePuncts(puncts ...string) func(*queryBuilder) {
 // 	return func(qb *queryBuilder) {
@@ -202,29 +274,83 @@ func excludeChunkRE(re string) func(*queryBuilder) {
 	}
 }
 
-func nDigitCountView(n int) func(*queryBuilder) {
+func requireChunkRE(re string) func(*queryBuilder) {
+	tableName := fmt.Sprintf("chunk_rcre_%s", text.RandomString(10))
 	return func(qb *queryBuilder) {
-		j := `JOIN chunk_digitcount_view ON chunk.id = chunk_digitcount_view.id AND chunk_digitcount_view.freq = ?`
+		j := fmt.Sprintf(`JOIN chunk AS %s ON chunk.id = %s.id AND %s.text REGEXP ?`, tableName, tableName, tableName)
 		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, n)
+		qb.args = append(qb.args, re)
 	}
 }
 
-func digitCountView(gt, lt int) func(*queryBuilder) {
-	return func(qb *queryBuilder) {
-		j := `JOIN chunk_digitcount_view ON chunk.id = chunk_digitcount_view.id AND chunk_digitcount_view.freq >= ? AND chunk_digitcount_view.freq <= ?`
-		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, gt)
-		qb.args = append(qb.args, lt)
+// chunkWordsQ returns a sub query selecting the ids of chunks containing any of the words given as placeholders, using the chunkfeat word index
+func chunkWordsQ(qs []string) string {
+	return `SELECT chunk_chunkfeat.chunk_id FROM chunk_chunkfeat JOIN chunkfeat ON chunkfeat.id = chunk_chunkfeat.chunkfeat_id WHERE chunkfeat.name = '` + text.FeatWord + `' AND chunkfeat.value IN (` + strings.Join(qs, ", ") + `)`
+}
+
+func words2args(words []string) ([]string, []interface{}) {
+	var qs []string
+	var args []interface{}
+	for _, w := range words {
+		qs = append(qs, "?")
+		args = append(args, strings.ToLower(w))
 	}
+	return qs, args
+}
+
+// requireWords requires the chunk to contain at least one of the words (case insensitive)
+func requireWords(words ...string) func(*queryBuilder) {
+	qs, args := words2args(words)
+	return where(`chunk.id IN (`+chunkWordsQ(qs)+`)`, args...)
+}
+
+// excludeWords excludes chunks containing any of the words (case insensitive)
+func excludeWords(words ...string) func(*queryBuilder) {
+	qs, args := words2args(words)
+	return where(`chunk.id NOT IN (`+chunkWordsQ(qs)+`)`, args...)
 }
 
-func lowestWordFreqCountView(lowFreq int) func(*queryBuilder) {
+// textMatch requires the chunk to match an FTS5 query, using the full-text index (see dbapi.BuildFTSIndex)
+func textMatch(query string) func(*queryBuilder) {
+	tableName := fmt.Sprintf("chunk_fts_%s", text.RandomString(10))
 	return func(qb *queryBuilder) {
-		j := `JOIN chunk_lowestwordfreqcount_view ON chunk.id = chunk_lowestwordfreqcount_view.id AND chunk_lowestwordfreqcount_view.freq > ?`
+		j := fmt.Sprintf(`JOIN (SELECT rowid FROM chunk_fts WHERE chunk_fts MATCH ?) AS %s ON chunk.id = %s.rowid`, tableName, tableName)
 		qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, lowFreq)
+		qb.args = append(qb.args, query)
+	}
+}
+
+func nDigitCount(n int) func(*queryBuilder) {
+	return chunkCount("digit_count", "=", n)
+}
+
+func digitCount(gt, lt int) func(*queryBuilder) {
+	return chunkCountInterval("digit_count", gt, lt)
+}
+
+func lowestWordFreqCount(lowFreq int) func(*queryBuilder) {
+	return chunkCount("lowest_word_freq", ">", lowFreq)
+}
+
+func sourceFreqInterval(min, max int) func(*queryBuilder) {
+	return chunkCountInterval("source_freq", min, max)
+}
+
+func sourceFreqMin(count int) func(*queryBuilder) {
+	return chunkCount("source_freq", ">=", count)
+}
+
+func sourceFreqMax(count int) func(*queryBuilder) {
+	return chunkCount("source_freq", "<=", count)
+}
+
+// chunkFeatCatDescendantsQ returns a sub query selecting the categories given as placeholders, along with all their descendant categories
+func chunkFeatCatDescendantsQ(qs []string) string {
+	var values []string
+	for _, q := range qs {
+		values = append(values, "("+q+")")
 	}
+	return `WITH RECURSIVE descendants(name) AS (VALUES ` + strings.Join(values, ", ") + ` UNION SELECT chunkfeatcat_parent.name FROM chunkfeatcat_parent JOIN descendants ON chunkfeatcat_parent.parent = descendants.name) SELECT name FROM descendants`
 }
 
 func chunkFeatCat(featCatNames ...string) func(*queryBuilder) {
@@ -236,7 +362,7 @@ func chunkFeatCat(featCatNames ...string) func(*queryBuilder) {
 		}
 
 		// j := "JOIN chunk_chunkfeat AS ccf ON chunk.id = ccf.chunk_id JOIN chunkfeat AS cf ON cf.id = ccf.chunkfeat_id AND chunk.id NOT IN (SELECT c.id FROM chunk AS c JOIN chunk_chunkfeat AS ccfb, chunkfeat AS cfb ON c.id = ccfb.chunk_id AND cfb.id = ccfb.chunkfeat_id AND cfb.value IN ( " + strings.Join(qs, ", ") + " AND cfb.name = 'punct')"
-		j := `JOIN chunkfeatcat, chunkfeat, chunk_chunkfeat ON chunk.id = chunk_chunkfeat.chunk_id and chunkfeat.id = chunk_chunkfeat.chunkfeat_id and chunkfeat.id = chunkfeatcat.chunkfeat_id and chunkfeatcat.name IN (` + strings.Join(qs, ", ") + `)`
+		j := `JOIN chunkfeatcat, chunkfeat, chunk_chunkfeat ON chunk.id = chunk_chunkfeat.chunk_id and chunkfeat.id = chunk_chunkfeat.chunkfeat_id and chunkfeat.id = chunkfeatcat.chunkfeat_id and chunkfeatcat.name IN (` + chunkFeatCatDescendantsQ(qs) + `)`
 		qb.joins = append(qb.joins, j)
 		for _, fn := range featCatNames {
 			qb.args = append(qb.args, fn)
@@ -244,20 +370,64 @@ func chunkFeatCat(featCatNames ...string) func(*queryBuilder) {
 	}
 }
 
+// chunkFeatCatHitsQ returns a sub query selecting the ids of chunks with at least min and (if max > 0) at most max distinct feature values
+// in the categories given as placeholders, or their descendant categories
+func chunkFeatCatHitsQ(qs []string, min, max int) (string, []interface{}) {
+	q := `SELECT chunk_chunkfeat.chunk_id FROM chunk_chunkfeat JOIN chunkfeatcat ON chunkfeatcat.chunkfeat_id = chunk_chunkfeat.chunkfeat_id WHERE chunkfeatcat.name IN (` + chunkFeatCatDescendantsQ(qs) + `) GROUP BY chunk_chunkfeat.chunk_id HAVING COUNT(DISTINCT chunk_chunkfeat.chunkfeat_id) >= ?`
+	args := []interface{}{min}
+	if max > 0 {
+		q += ` AND COUNT(DISTINCT chunk_chunkfeat.chunkfeat_id) <= ?`
+		args = append(args, max)
+	}
+	return q, args
+}
+
+// chunkFeatCatHits requires the chunk to have at least min and (if max > 0) at most max distinct feature values in the categories.
+// If all is true, this is required for each category, otherwise for the categories taken together.
+func chunkFeatCatHits(featCatNames []string, min, max int, all bool) func(*queryBuilder) {
+	var conds []string
+	var args []interface{}
+	if all {
+		for _, fn := range featCatNames {
+			q, qArgs := chunkFeatCatHitsQ([]string{"?"}, min, max)
+			conds = append(conds, `chunk.id IN (`+q+`)`)
+			args = append(args, fn)
+			args = append(args, qArgs...)
+		}
+	} else {
+		var qs []string
+		for _, fn := range featCatNames {
+			qs = append(qs, "?")
+			args = append(args, fn)
+		}
+		q, qArgs := chunkFeatCatHitsQ(qs, min, max)
+		conds = append(conds, `chunk.id IN (`+q+`)`)
+		args = append(args, qArgs...)
+	}
+	return where(strings.Join(conds, " AND "), args...)
+}
+
+// excludeChunkFeatCat excludes chunks included in any of the feature categories, or their descendant categories
+func excludeChunkFeatCat(featCatNames ...string) func(*queryBuilder) {
+	var qs []string
+	var args []interface{}
+	for _, fn := range featCatNames {
+		qs = append(qs, "?")
+		args = append(args, fn)
+	}
+	return where(`chunk.id NOT IN (SELECT chunk_chunkfeat.chunk_id FROM chunk_chunkfeat JOIN chunkfeatcat ON chunkfeatcat.chunkfeat_id = chunk_chunkfeat.chunkfeat_id WHERE chunkfeatcat.name IN (`+chunkFeatCatDescendantsQ(qs)+`))`, args...)
+}
+
 func tailNotInBatches(batchNames ...string) func(*queryBuilder) {
 	var qs = []string{"?"}
 	for i := 0; i < len(batchNames); i++ {
 		qs = append(qs, "?")
 	}
-	return func(qb *queryBuilder) {
-		t := `WHERE chunk.id NOT IN ( SELECT chunk_id FROM batch WHERE name IN (` + strings.Join(qs, ", ") + `) )`
-		qb.tail = t
-		//qb.joins = append(qb.joins, j)
-		qb.args = append(qb.args, text.BlockBatch)
-		for _, bn := range batchNames {
-			qb.args = append(qb.args, bn)
-		}
+	args := []interface{}{text.BlockBatch}
+	for _, bn := range batchNames {
+		args = append(args, bn)
 	}
+	return where(`chunk.id NOT IN ( SELECT chunk_id FROM batch WHERE name IN (`+strings.Join(qs, ", ")+`) )`, args...)
 }
 
 // func tailNotInBatchOrderByLowestWordFreq(notInBatch string, limit int) func(*queryBuilder) {
@@ -270,10 +440,17 @@ func tailNotInBatches(batchNames ...string) func(*queryBuilder) {
 // 	}
 // }
 
+// tailOrderByChunkID orders the result by chunk id, so that the sentences checked by Go predicates come in a stable order
+func tailOrderByChunkID() func(*queryBuilder) {
+	return func(qb *queryBuilder) {
+		qb.tail += ` ORDER BY chunk.id`
+	}
+}
+
 func tailLimit(limit int) func(*queryBuilder) {
 	return func(qb *queryBuilder) {
 		j := ` LIMIT ?`
 		qb.tail += j
-		qb.args = append(qb.args, limit)
+		qb.tailArgs = append(qb.tailArgs, limit)
 	}
 }
@@ -17,10 +17,10 @@ func TestQueryBuilder(t *testing.T) {
 	//
 	qb1, err := newFilterQueryBuilder(
 		filterQHeadInto(batchName),
-		wordCountView(4, 19),
-		commaCountView(0, 3),
-		nDigitCountView(0),
-		lowestWordFreqCountView(500),
+		wordCount(4, 19),
+		commaCount(0, 3),
+		nDigitCount(0),
+		lowestWordFreqCount(500),
 		//tailNotInBatchOrderByLowestWordFreq(batchName, 10000),
 	)
 	if err != nil {
@@ -38,13 +38,13 @@ func TestQueryBuilder(t *testing.T) {
 	//
 	qb2, err := newFilterQueryBuilder(
 		filterQHeadInto(batchName),
-		wordCountView(4, 25),
-		commaCountView(-1, 4),
-		nDigitCountView(0),
+		wordCount(4, 25),
+		commaCount(-1, 4),
+		nDigitCount(0),
 		chunkFeatCat(text.FeatSEPlace),
 		//excludePuncts(";", "!"),
 		excludeChunkRE("ö"),
-		//lowestWordFreqCountView(15),
+		//lowestWordFreqCount(15),
 		tailNotInBatches(batchName),
 		tailLimit(100000),
 		//tailNotInBatchOrderByLowestWordFreq(excludeBatch, n),
@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"fmt"
+
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+)
+
+// Sampling modes, deciding which of the matching sentences are kept in the batch
+const (
+	// SampleFirst keeps the first matches (default)
+	SampleFirst = "first"
+	// SampleRandom keeps a uniform random sample
+	SampleRandom = "random"
+	// SampleSource stratifies by source, so that each source (article) contributes at most max_per_stratum sentences.
+	// A sentence found in several sources belongs to the first of them (the lowest source id)
+	SampleSource = "source"
+	// SampleChunkFeatCat stratifies by the values of a chunkfeat category; sentences without a value in the category form one stratum
+	SampleChunkFeatCat = "chunkfeat_cat"
+)
+
+// strataQ returns a sub query selecting (chunk_id, stratum) for the sampling mode.
+// A chunk must have a single stratum per source, or a source could contribute more than max_per_stratum chunks through chunks shared with other sources.
+func strataQ(sampling protocol.Sampling) (string, []interface{}, error) {
+	switch sampling.Mode {
+	case SampleSource:
+		return `SELECT chunk_id, MIN(source_id) AS stratum FROM source_chunk GROUP BY chunk_id`, nil, nil
+	case SampleChunkFeatCat:
+		if sampling.ChunkFeatCat == "" {
+			return "", nil, fmt.Errorf("sampling mode %s requires chunkfeat_cat", sampling.Mode)
+		}
+		return `SELECT DISTINCT chunk_chunkfeat.chunk_id, chunk_chunkfeat.chunkfeat_id AS stratum FROM chunk_chunkfeat JOIN chunkfeatcat ON chunkfeatcat.chunkfeat_id = chunk_chunkfeat.chunkfeat_id WHERE chunkfeatcat.name IN (` + chunkFeatCatDescendantsQ([]string{"?"}) + `)`, []interface{}{sampling.ChunkFeatCat}, nil
+	default:
+		return "", nil, fmt.Errorf("unknown sampling mode '%s'", sampling.Mode)
+	}
+}
+
+// sampleQ returns a sub query selecting (chunk_id, sample_order) for the chunk ids selected by matchQ, using the sampling mode.
+// Stratified samples are ordered so that the strata take turns, i.e., the target size is spread evenly over the strata.
+func sampleQ(sampling protocol.Sampling, matchQ string, matchArgs []interface{}) (string, []interface{}, error) {
+	if sampling.MaxPerStratum < 0 {
+		return "", nil, fmt.Errorf("invalid max_per_stratum %d", sampling.MaxPerStratum)
+	}
+	matches := `(SELECT DISTINCT id FROM (` + matchQ + `))`
+	if sampling.Mode == SampleRandom {
+		args := append([]interface{}{sampling.Seed}, matchArgs...)
+		return `SELECT id AS chunk_id, ROW_NUMBER() OVER (ORDER BY seeded_random(?, id)) AS sample_order FROM ` + matches, args, nil
+	}
+
+	strata, strataArgs, err := strataQ(sampling)
+	if err != nil {
+		return "", nil, err
+	}
+	q := `SELECT chunk_id, ROW_NUMBER() OVER (ORDER BY MIN(rnk), seeded_random(?, chunk_id)) AS sample_order FROM (SELECT m.id AS chunk_id, ROW_NUMBER() OVER (PARTITION BY s.stratum ORDER BY seeded_random(?, m.id)) AS rnk FROM ` + matches + ` m LEFT JOIN (` + strata + `) s ON s.chunk_id = m.id) GROUP BY chunk_id`
+	args := []interface{}{sampling.Seed, sampling.Seed}
+	args = append(args, matchArgs...)
+	args = append(args, strataArgs...)
+	if sampling.MaxPerStratum > 0 {
+		q += ` HAVING MIN(rnk) <= ?`
+		args = append(args, sampling.MaxPerStratum)
+	}
+	return q, args, nil
+}
+
+// isSampled returns true if the payload uses a sampling mode other than the default (the first matching sentences)
+func isSampled(payload protocol.FilterPayload) bool {
+	return payload.Sampling != nil && payload.Sampling.Mode != SampleFirst && payload.Sampling.Mode != ""
+}
+
+// sampled restricts the query to the chunks of the sample sub query, ordered by sample order
+func sampled(q string, args []interface{}) func(*queryBuilder) {
+	return func(qb *queryBuilder) {
+		qb.joins = append(qb.joins, `JOIN (`+q+`) AS sample ON sample.chunk_id = chunk.id`)
+		qb.args = append(qb.args, args...)
+		qb.tail += ` ORDER BY sample.sample_order`
+	}
+}
+
+// newSamplingQueryBuilder builds a query selecting a sample of the sentences matching the payload, using the query head opt head.
+// If limit is true, the payload target size is used as LIMIT.
+func newSamplingQueryBuilder(payload protocol.FilterPayload, head opt, limit bool) (*queryBuilder, error) {
+	matchPayload := payload
+	matchPayload.Sampling = nil
+	matchQB, err := newPayloadQueryBuilder(matchPayload, selectChunkIDsHead(), false)
+	if err != nil {
+		return matchQB, err
+	}
+	matchQ, matchArgs := matchQB.query()
+	q, args, err := sampleQ(*payload.Sampling, matchQ, matchArgs)
+	if err != nil {
+		return &queryBuilder{}, fmt.Errorf("couldn't build sampling query : %v", err)
+	}
+
+	filterOpts := []opt{head, sampled(q, args)}
+	if limit && payload.TargetSize > 0 {
+		filterOpts = append(filterOpts, tailLimit(payload.TargetSize))
+	}
+	qb, err := newFilterQueryBuilder(filterOpts...)
+	if err != nil {
+		return qb, err
+	}
+	qb.config = payload
+	return qb, nil
+}
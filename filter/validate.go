@@ -0,0 +1,197 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+	"github.com/stts-se/wikispeech-manuscriptor/text"
+)
+
+// validator collects the problems found in a filter payload
+type validator struct {
+	db   *dbapi.DB
+	cats map[string]bool // chunkfeat categories in the db, loaded when needed
+	res  []protocol.ConfigError
+}
+
+func (v *validator) add(path, format string, args ...interface{}) {
+	v.res = append(v.res, protocol.ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) catExists(name string) (bool, error) {
+	if v.cats == nil {
+		cats, err := v.db.ListChunkfeatCats()
+		if err != nil {
+			return false, err
+		}
+		v.cats = map[string]bool{}
+		for _, c := range cats {
+			v.cats[c] = true
+		}
+	}
+	return v.cats[name], nil
+}
+
+func (v *validator) validateOpt(o protocol.FilterOpt, path string) error {
+	known := false
+	for _, f := range AvailableFeats() {
+		if f.Name == o.Name {
+			known = true
+		}
+	}
+	if !known {
+		v.add(path+".name", "unknown filter opt '%s'", o.Name)
+		return nil
+	}
+	if isPredicate(o) {
+		_, err := newPredicate(o)
+		if err != nil {
+			v.add(path+".args", "%v", err)
+		}
+		return nil
+	}
+	_, err := payloadOpt2filterOpt(o)
+	if err != nil {
+		v.add(path+".args", "%v", err)
+		return nil
+	}
+	if o.Name == TextMatch {
+		ok, err := v.db.HasFTSIndex()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			v.add(path+".name", "%s requires the full-text index, run scripttool build_fts_index (built with -tags sqlite_fts5)", o.Name)
+		}
+	}
+
+	for i, arg := range o.Args {
+		argPath := fmt.Sprintf("%s.args[%d]", path, i)
+		switch o.Name {
+		case SourceRE, ExcludeChunkRE, RequireChunkRE:
+			_, err := regexp.Compile(arg)
+			if err != nil {
+				v.add(argPath, "invalid regular expression : %v", err)
+			}
+		case ChunkFeatCats, ExcludeChunkFeatCats:
+			if o.Name == ChunkFeatCats && (strings.HasPrefix(arg, chunkFeatCatsMinHits) || strings.HasPrefix(arg, chunkFeatCatsMaxHits) || strings.HasPrefix(arg, chunkFeatCatsMatch)) {
+				continue
+			}
+			exists, err := v.catExists(arg)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				v.add(argPath, "unknown chunkfeat category '%s'", arg)
+			}
+		case FromBatches, FromScripts:
+			kind := dbapi.KindBatch
+			if o.Name == FromScripts {
+				kind = dbapi.KindScript
+			}
+			exists, err := v.db.Exists(kind, arg)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				v.add(argPath, "no %s named %s", kind, arg)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) validateExpr(e protocol.FilterExpr, path string) error {
+	n := 0
+	for _, set := range []bool{e.Opt != nil, len(e.And) > 0, len(e.Or) > 0, e.Not != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		v.add(path, "expected exactly one of opt, and, or, not, found %d", n)
+		return nil
+	}
+	switch {
+	case e.Opt != nil && isPredicate(*e.Opt):
+		v.add(path+".opt.name", "go predicates can only be used in the filter opts, not in the filter expression")
+		return nil
+	case e.Opt != nil:
+		return v.validateOpt(*e.Opt, path+".opt")
+	case e.Not != nil:
+		return v.validateExpr(*e.Not, path+".not")
+	}
+	name, subs := "and", e.And
+	if len(e.Or) > 0 {
+		name, subs = "or", e.Or
+	}
+	for i, sub := range subs {
+		err := v.validateExpr(sub, fmt.Sprintf("%s.%s[%d]", path, name, i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) validateSampling(s protocol.Sampling, path string) error {
+	switch s.Mode {
+	case "", SampleFirst, SampleRandom, SampleSource:
+	case SampleChunkFeatCat:
+		if s.ChunkFeatCat == "" {
+			v.add(path+".chunkfeat_cat", "required for sampling mode %s", s.Mode)
+			break
+		}
+		exists, err := v.catExists(s.ChunkFeatCat)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			v.add(path+".chunkfeat_cat", "unknown chunkfeat category '%s'", s.ChunkFeatCat)
+		}
+	default:
+		v.add(path+".mode", "unknown sampling mode '%s'", s.Mode)
+	}
+	if s.MaxPerStratum < 0 {
+		v.add(path+".max_per_stratum", "must not be negative, found %d", s.MaxPerStratum)
+	}
+	return nil
+}
+
+// ValidatePayload checks a filter payload against the available filter opts and the db: opt names and args, regular expressions,
+// chunkfeat categories, the full-text index, and the batches and scripts to filter from. All problems found are returned, with JSON paths starting with path.
+// An error is returned only if the db lookups fail.
+func ValidatePayload(db *dbapi.DB, payload protocol.FilterPayload, path string) ([]protocol.ConfigError, error) {
+	v := &validator{db: db}
+	if payload.BatchName == "" {
+		v.add(path+".batch_name", "batch name not provided")
+	}
+	if payload.BatchName == text.BlockBatch {
+		v.add(path+".batch_name", "batch name %s is reserved for blocked sentences", text.BlockBatch)
+	}
+	if payload.TargetSize < 1 {
+		v.add(path+".target_size", "target size must be more than zero, found %d", payload.TargetSize)
+	}
+	for i, o := range payload.Opts {
+		err := v.validateOpt(o, fmt.Sprintf("%s.opts[%d]", path, i))
+		if err != nil {
+			return v.res, err
+		}
+	}
+	if payload.Expr != nil {
+		err := v.validateExpr(*payload.Expr, path+".expr")
+		if err != nil {
+			return v.res, err
+		}
+	}
+	if payload.Sampling != nil {
+		err := v.validateSampling(*payload.Sampling, path+".sampling")
+		if err != nil {
+			return v.res, err
+		}
+	}
+	return v.res, nil
+}
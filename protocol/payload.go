@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 // type Message struct {
@@ -19,20 +20,63 @@ type FilterPayload struct {
 	BatchName  string      `json:"batch_name"`
 	TargetSize int         `json:"target_size"`
 	Opts       []FilterOpt `json:"opts"`
+	// Expr is an optional boolean expression over filter opts, combined with Opts using AND
+	Expr *FilterExpr `json:"expr,omitempty"`
+	// Sampling decides which of the matching sentences are kept. By default, the first matches are kept.
+	Sampling *Sampling `json:"sampling,omitempty"`
 }
 
 func (f FilterPayload) Empty() bool {
-	return f.BatchName == "" && f.TargetSize == 0 && len(f.Opts) == 0
+	return f.BatchName == "" && f.TargetSize == 0 && len(f.Opts) == 0 && f.Expr == nil && f.Sampling == nil
+}
+
+// Sampling is a sampling mode for batch filtering, see the filter package for available modes
+type Sampling struct {
+	Mode string `json:"mode"`
+	// Seed makes random sampling reproducible
+	Seed int64 `json:"seed"`
+	// MaxPerStratum is the max number of sentences from each stratum (0 means no max)
+	MaxPerStratum int `json:"max_per_stratum,omitempty"`
+	// ChunkFeatCat is the category whose values are the strata, for stratifying by chunkfeat category
+	ChunkFeatCat string `json:"chunkfeat_cat,omitempty"`
 }
 
 type BatchMetadata struct {
 	FilterPayload
 	OutputSize int    `json:"output_size"`
 	Timestamp  string `json:"timestamp"`
+	// Funnel shows how many sentences each filter criterion lets through
+	Funnel []FunnelStep `json:"funnel,omitempty"`
+	// Lineage lists the batches and scripts this batch was filtered from (from_batches and from_scripts), followed by their ancestors
+	Lineage []SetOperand `json:"lineage,omitempty"`
+	// SetOp is set for batches created by a set operation instead of filtering
+	SetOp *SetOperation `json:"set_op,omitempty"`
 }
 
 func (meta BatchMetadata) Empty() bool {
-	return meta.Timestamp == "" && meta.OutputSize == 0 && meta.BatchName == "" && len(meta.Opts) == 0
+	return meta.Timestamp == "" && meta.OutputSize == 0 && meta.BatchName == "" && len(meta.Opts) == 0 && meta.Expr == nil && meta.Sampling == nil && meta.SetOp == nil
+}
+
+// FunnelStep reports the number of sentences passing a filter criterion (a filter opt, or the filter expression)
+type FunnelStep struct {
+	Criterion string   `json:"criterion"`
+	Args      []string `json:"args,omitempty"`
+	// Remaining is the number of sentences matching this and all previous criteria
+	Remaining int64 `json:"remaining"`
+	// RejectedAlone is the number of sentences rejected by this criterion on its own
+	RejectedAlone int64 `json:"rejected_alone"`
+}
+
+// SetOperand is a batch or script used in a set operation
+type SetOperand struct {
+	Kind string `json:"kind"` // "batch" or "script"
+	Name string `json:"name"`
+}
+
+// SetOperation describes a batch or script created from other batches and scripts (union, intersect, diff or copy)
+type SetOperation struct {
+	Operation string       `json:"operation"`
+	Operands  []SetOperand `json:"operands"`
 }
 
 type FilterOpt struct {
@@ -40,6 +84,14 @@ type FilterOpt struct {
 	Args []string `json:"args"`
 }
 
+// FilterExpr is a boolean expression over filter opts. Exactly one of Opt, And, Or and Not should be set.
+type FilterExpr struct {
+	Opt *FilterOpt   `json:"opt,omitempty"`
+	And []FilterExpr `json:"and,omitempty"`
+	Or  []FilterExpr `json:"or,omitempty"`
+	Not *FilterExpr  `json:"not,omitempty"`
+}
+
 // Selector
 
 type SelectorFeatOpt struct {
@@ -80,6 +132,16 @@ type SelectorPayload struct {
 	Options SelectorOptions `json:"options"`
 }
 
+// ConfigError is a problem found when validating a config, at the JSON path Path (e.g. filter.opts[0].args[1])
+type ConfigError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
 type Config struct {
 	Description  string          `json:"description"`
 	ClearBatches bool            `json:"clear_batches"`
@@ -98,9 +160,11 @@ type ScriptMetadata struct {
 	InputSize  int    `json:"input_size"`
 	OutputSize int    `json:"output_size"`
 	Timestamp  string `json:"timestamp"`
+	// SetOp is set for scripts created by a set operation instead of selection
+	SetOp *SetOperation `json:"set_op,omitempty"`
 }
 
 func (meta ScriptMetadata) Empty() bool {
 	return meta.Timestamp == "" && meta.InputSize == 0 && meta.OutputSize == 00 &&
-		meta.Options.FromBatch == "" && len(meta.Options.FeatureOpts) == 0 && meta.Options.Mode == ""
+		meta.Options.FromBatch == "" && len(meta.Options.FeatureOpts) == 0 && meta.Options.Mode == "" && meta.SetOp == nil
 }
@@ -16,6 +16,7 @@ type Feat struct {
 	Desc string `json:"desc"`
 }
 
+// AvailableFeats lists the built-in selector features. Feature categories in the db (chunkfeatcat) can also be used as selector features.
 func AvailableFeats() []Feat {
 	res := []Feat{
 		{Name: text.FeatBigram,
@@ -24,9 +25,6 @@ func AvailableFeats() []Feat {
 		{Name: text.FeatTrigram,
 			Desc: "Three-letter combinations",
 		},
-		{Name: text.FeatBigram + "_top800",
-			Desc: "The 800 most common bigrams",
-		},
 		{Name: text.FeatBigramTransition,
 			Desc: "Bigrams in transititions between words",
 		},
@@ -44,6 +42,7 @@ func AvailableFeats() []Feat {
 	return res
 }
 
+// DefaultFeatureOpts are the default selector features. The bigram_top800 category must be loaded into the db (from feat_data/bigram_top800.txt, or using scripttool add_freq_cat).
 var DefaultFeatureOpts = []protocol.SelectorFeatOpt{
 	{text.FeatBigramTransition, 0},
 	{text.FeatBigram + "_top800", 3},
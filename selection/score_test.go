@@ -1,9 +1,11 @@
 package selection
 
 import (
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
 	"github.com/stts-se/wikispeech-manuscriptor/protocol"
 	"github.com/stts-se/wikispeech-manuscriptor/text"
 )
@@ -50,3 +52,86 @@ func TestSumOfStats(t *testing.T) {
 		}
 	}
 }
+
+func TestProvenance(t *testing.T) {
+	opts := protocol.SelectorOptions{
+		Mode:        ModeExhaustive,
+		FeatureOpts: []protocol.SelectorFeatOpt{{Name: text.FeatInitialBigram}, {Name: text.FeatFinalTrigram}},
+	}
+	selector, err := NewSelector(nil, opts)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, txt := range []string{"Solen skiner.", "Soporna behöver tömmas."} {
+		s0 := text.ComputeSentence(txt)
+		s0.ID = int64(len(selector.Corpus) + 1)
+		selector.Corpus = append(selector.Corpus, Sent{Sentence: s0, Stats: StatsFromSent(s0)})
+	}
+
+	selector.cacheSelection(Chunk{Sents: selector.Corpus[0:1], ScoreSet: ScoreSet{text.FeatInitialBigram: 1, text.FeatFinalTrigram: 1}, SelectedFeature: text.FeatFinalTrigram}, []int{0}, map[int]bool{})
+	selector.cacheSelection(Chunk{Sents: selector.Corpus[0:1], ScoreSet: ScoreSet{text.FeatInitialBigram: 0.5, text.FeatFinalTrigram: 1}, SelectedFeature: text.FeatFinalTrigram}, []int{0}, map[int]bool{})
+
+	expect := []dbapi.Provenance{
+		{ChunkID: 1, Step: 1, Feature: text.FeatFinalTrigram,
+			Scores:    map[string]float64{text.FeatInitialBigram: 1, text.FeatFinalTrigram: 1},
+			NewValues: map[string][]string{text.FeatInitialBigram: {"so"}, text.FeatFinalTrigram: {"ner"}},
+		},
+		{ChunkID: 2, Step: 2, Feature: text.FeatFinalTrigram,
+			Scores:    map[string]float64{text.FeatInitialBigram: 0.5, text.FeatFinalTrigram: 1},
+			NewValues: map[string][]string{text.FeatFinalTrigram: {"mas"}},
+		},
+	}
+	if !reflect.DeepEqual(expect, selector.Provenance) {
+		t.Errorf("Expected %#v, found %#v", expect, selector.Provenance)
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	db, err := dbapi.CreateDB(filepath.Join(t.TempDir(), "tst_validate.db"))
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer db.Close()
+
+	opts := protocol.SelectorOptions{
+		Mode:               "exhaustiv",
+		ScriptName:         "test_script",
+		TargetSize:         10,
+		FromBatch:          "test_batch_missing",
+		AccumulatedScripts: []string{"test_script_missing"},
+		FeatureOpts: []protocol.SelectorFeatOpt{
+			{Name: text.FeatWord},
+			{Name: "bigram_top8000"},
+			{Name: text.FeatWord, TargetAmount: -1},
+		},
+	}
+	errs, err := ValidateOptions(db, opts, "selector", "")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Path)
+	}
+	expect := []string{
+		"selector.mode",
+		"selector.from_batch",
+		"selector.accumulated_scripts[0]",
+		"selector.feature_opts[1].name",
+		"selector.feature_opts[2].name",
+		"selector.feature_opts[2].target_amount",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected %v, got %v", expect, errs)
+	}
+
+	// the input batch will be created by the filter
+	opts = protocol.SelectorOptions{Mode: ModeRand, ScriptName: "test_script", TargetSize: 10, FromBatch: "test_batch_new", FeatureOpts: []protocol.SelectorFeatOpt{{Name: text.FeatBigram}}}
+	errs, err = ValidateOptions(db, opts, "selector", "test_batch_new")
+	if err != nil || len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v, %v", errs, err)
+	}
+}
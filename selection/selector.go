@@ -5,6 +5,7 @@ import (
 	//"log"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -40,15 +41,19 @@ type Selector struct {
 	AccumulatedScriptsSize  int
 	Selection               []Sent
 	SelectionStats          Stats
+	Provenance              []dbapi.Provenance // why each sentence in Selection was selected
 	currentChunkSize        int
+	step                    int
+
+	db *dbapi.DB
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// NewSelector creates a new Selector instance based on the input options
-func NewSelector(options protocol.SelectorOptions) (Selector, error) {
+// NewSelector creates a new Selector instance based on the input options, reading from and writing to db
+func NewSelector(db *dbapi.DB, options protocol.SelectorOptions) (Selector, error) {
 	switch options.Mode {
 	case ModeRand:
 	case ModeExhaustive:
@@ -60,8 +65,10 @@ func NewSelector(options protocol.SelectorOptions) (Selector, error) {
 		Options:                options,
 		Corpus:                 []Sent{},
 		Selection:              []Sent{},
+		Provenance:             []dbapi.Provenance{},
 		InputBatchSize:         0,
 		AccumulatedScriptsSize: 0,
+		db:                     db,
 	}
 	res.SelectionStats = NewStats(options.FeatureOpts)
 	res.InputBatchStats = NewStats(options.FeatureOpts)
@@ -99,7 +106,7 @@ func (selector *Selector) getInputBatch() ([]Sent, error) {
 	//log.Printf("selector.getInputBatch debug populatedQuery\t%s", populateQueryString(query, args))
 
 	// exec query
-	tx, err := dbapi.Begin()
+	tx, err := selector.db.Begin()
 	if err != nil {
 		return res, fmt.Errorf("couldn't create db connection : %v", err)
 	}
@@ -134,8 +141,8 @@ func (selector *Selector) getInputBatch() ([]Sent, error) {
 	// shuffle needed for chunked selection
 	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
 
-	//sents, err := dbapi.GetSents(ids...)
-	sents, err := dbapi.GetSentsInBatches(20000, ids...)
+	//sents, err := selector.db.GetSents(ids...)
+	sents, err := selector.db.GetSentsInBatches(20000, ids...)
 	if err != nil {
 		return res, fmt.Errorf("failed to get sents : %v", err)
 	}
@@ -175,7 +182,7 @@ func (selector *Selector) loadAccumulatedScripts() error {
 	//log.Printf("selector.loadAccumulatedScripts debug populatedQuery\t%s", populateQueryString(query, args))
 
 	// exec query
-	tx, err := dbapi.Begin()
+	tx, err := selector.db.Begin()
 	if err != nil {
 		return fmt.Errorf("couldn't create db connection : %v", err)
 	}
@@ -205,7 +212,7 @@ func (selector *Selector) loadAccumulatedScripts() error {
 		return fmt.Errorf("couldn't commit transaction : %v", err)
 	}
 
-	sents, err := dbapi.GetSents(ids...)
+	sents, err := selector.db.GetSents(ids...)
 	if err != nil {
 		return fmt.Errorf("failed to get sents : %v", err)
 	}
@@ -339,8 +346,10 @@ func (selector *Selector) cacheSelection(sents Chunk, sentIndexInCorpus []int, r
 	// 	debug(fmt.Sprintf("REMOVING INDICES\t%v", removableIndices))
 	// }
 
+	selector.step++
 	for _, sent := range sents.Sents {
 		selector.Selection = append(selector.Selection, sent)
+		selector.Provenance = append(selector.Provenance, selector.provenance(sents, sent))
 	}
 
 	lenBefore := len(selector.Corpus)
@@ -368,6 +377,32 @@ func (selector *Selector) cacheSelection(sents Chunk, sentIndexInCorpus []int, r
 	return nil
 }
 
+// provenance describes why sent (part of the selected chunk) was selected in the current step. Must be called before the chunk is added to the selection stats.
+func (selector *Selector) provenance(chunk Chunk, sent Sent) dbapi.Provenance {
+	res := dbapi.Provenance{
+		ChunkID:   sent.Sentence.ID,
+		Step:      selector.step,
+		Feature:   chunk.SelectedFeature,
+		Scores:    map[string]float64{},
+		NewValues: map[string][]string{},
+	}
+	for name, score := range chunk.ScoreSet {
+		res.Scores[name] = float64(score)
+	}
+	for name, m := range selector.SelectionStats.SetDiff(sent.Stats) {
+		if len(m) == 0 {
+			continue
+		}
+		values := []string{}
+		for v := range m {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		res.NewValues[name] = values
+	}
+	return res
+}
+
 func (selector *Selector) WriteScriptToDB(metadata protocol.ScriptMetadata) (int, error) {
 	if metadata.Timestamp == "" {
 		metadata.Timestamp = time.Now().Format("2006-01-02 15:04:05")
@@ -377,5 +412,5 @@ func (selector *Selector) WriteScriptToDB(metadata protocol.ScriptMetadata) (int
 		ids = append(ids, s.Sentence.ID)
 	}
 
-	return dbapi.SaveScript(metadata, ids...)
+	return selector.db.SaveScriptWithProvenance(metadata, ids, selector.Provenance)
 }
@@ -0,0 +1,81 @@
+package selection
+
+import (
+	"fmt"
+
+	"github.com/stts-se/wikispeech-manuscriptor/dbapi"
+	"github.com/stts-se/wikispeech-manuscriptor/protocol"
+)
+
+// ValidateOptions checks selector options against the available features and the db: mode, feature names, and the input batch and accumulated scripts.
+// newBatch is a batch that will be created before the selection starts (by the filter of the same config), or empty.
+// All problems found are returned, with JSON paths starting with path. An error is returned only if the db lookups fail.
+func ValidateOptions(db *dbapi.DB, o protocol.SelectorOptions, path, newBatch string) ([]protocol.ConfigError, error) {
+	var res []protocol.ConfigError
+	add := func(path, format string, args ...interface{}) {
+		res = append(res, protocol.ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if o.ScriptName == "" {
+		add(path+".script_name", "script name not provided")
+	}
+	if o.TargetSize < 1 {
+		add(path+".target_size", "target amount must be more than zero, found %d", o.TargetSize)
+	}
+	switch o.Mode {
+	case ModeRand, ModeExhaustive:
+	default:
+		add(path+".mode", "unknown selector mode '%s'", o.Mode)
+	}
+
+	if o.FromBatch == "" {
+		add(path+".from_batch", "input batch not provided")
+	} else if o.FromBatch != newBatch {
+		exists, err := db.Exists(dbapi.KindBatch, o.FromBatch)
+		if err != nil {
+			return res, err
+		}
+		if !exists {
+			add(path+".from_batch", "no batch named %s", o.FromBatch)
+		}
+	}
+	for i, name := range o.AccumulatedScripts {
+		exists, err := db.Exists(dbapi.KindScript, name)
+		if err != nil {
+			return res, err
+		}
+		if !exists {
+			add(fmt.Sprintf("%s.accumulated_scripts[%d]", path, i), "no script named %s", name)
+		}
+	}
+
+	feats := map[string]bool{}
+	for _, f := range AvailableFeats() {
+		feats[f.Name] = true
+	}
+	cats, err := db.ListChunkfeatCats()
+	if err != nil {
+		return res, err
+	}
+	for _, c := range cats {
+		feats[c] = true
+	}
+	if len(o.FeatureOpts) == 0 {
+		add(path+".feature_opts", "no selector features provided")
+	}
+	seen := map[string]bool{}
+	for i, f := range o.FeatureOpts {
+		featPath := fmt.Sprintf("%s.feature_opts[%d]", path, i)
+		if !feats[f.Name] {
+			add(featPath+".name", "unknown selector feature '%s'", f.Name)
+		}
+		if seen[f.Name] {
+			add(featPath+".name", "duplicate selector feature '%s'", f.Name)
+		}
+		seen[f.Name] = true
+		if f.TargetAmount < 0 {
+			add(featPath+".target_amount", "must not be negative, found %d", f.TargetAmount)
+		}
+	}
+	return res, nil
+}